@@ -0,0 +1,328 @@
+package creds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+type AuditOutcome string
+
+const (
+	AuditSuccess AuditOutcome = "success"
+	AuditDenied  AuditOutcome = "denied"
+	AuditFailure AuditOutcome = "failure"
+)
+
+// One API operation. Events form a chain where each event's hash covers the hash of the event before it, so changing
+// or removing an event shows up when the chain is verified.
+//
+// Token ids are bearer credentials, so tokens are only ever recorded by their fingerprint.
+type AuditEvent struct {
+	Id           int64        `json:"id" pg:",pk"`
+	ActorToken   string       `json:"actorToken,omitempty"`
+	ActorUserId  *uuid.UUID   `json:"actorUserId,omitempty" pg:"type:uuid"`
+	Action       string       `json:"action" pg:",notnull"`
+	Target       string       `json:"target,omitempty"`
+	RequestId    string       `json:"requestId" pg:",notnull"`
+	SourceIp     string       `json:"sourceIp" pg:",notnull"`
+	Outcome      AuditOutcome `json:"outcome" pg:",notnull"`
+	Status       int          `json:"status" pg:",notnull"`
+	Detail       string       `json:"detail,omitempty"`
+	OccurredAt   time.Time    `json:"occurredAt" pg:",notnull"`
+	PreviousHash []byte       `json:"previousHash"`
+	Hash         []byte       `json:"hash" pg:",notnull"`
+}
+
+// The single row holding the hash of the newest event. Appending locks just this row, which is all that has to be
+// serialized for the chain to stay linear.
+type AuditChainHead struct {
+	Id   int `pg:",pk"`
+	Hash []byte
+}
+
+const auditChainHeadId = 1
+
+type AuditChainError struct {
+	Id     int64
+	Reason string
+}
+
+func (auditChainError AuditChainError) Error() string {
+	return fmt.Sprintf("Audit event %d %s", auditChainError.Id, auditChainError.Reason)
+}
+
+const maximumAuditDetailLength = 512
+
+// Fingerprint that identifies a token in the audit log without revealing it
+func tokenFingerprint(tokenId uuid.UUID) string {
+	sum := sha256.Sum256(tokenId[:])
+
+	return hex.EncodeToString(sum[:16])
+}
+
+func auditUserTarget(userId uuid.UUID) string {
+	return "user:" + userId.String()
+}
+
+func auditTokenTarget(tokenId uuid.UUID) string {
+	return "token:" + tokenFingerprint(tokenId)
+}
+
+func hashAuditEvent(event *AuditEvent) []byte {
+	actorUserId := ""
+	if event.ActorUserId != nil {
+		actorUserId = event.ActorUserId.String()
+	}
+
+	// A fixed struct gives a stable field order; the timestamp is formatted in UTC at the database's precision
+	content, _ := json.Marshal(struct {
+		ActorToken  string
+		ActorUserId string
+		Action      string
+		Target      string
+		RequestId   string
+		SourceIp    string
+		Outcome     AuditOutcome
+		Status      int
+		Detail      string
+		OccurredAt  string
+	}{
+		ActorToken:  event.ActorToken,
+		ActorUserId: actorUserId,
+		Action:      event.Action,
+		Target:      event.Target,
+		RequestId:   event.RequestId,
+		SourceIp:    event.SourceIp,
+		Outcome:     event.Outcome,
+		Status:      event.Status,
+		Detail:      event.Detail,
+		OccurredAt:  event.OccurredAt.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+	})
+
+	hash := sha256.New()
+	hash.Write(event.PreviousHash)
+	hash.Write(content)
+
+	return hash.Sum(nil)
+}
+
+// Locks the chain head for the rest of the transaction, creating it from the newest event if there isn't one yet
+func lockAuditChainHead(transaction *pg.Tx) (*AuditChainHead, error) {
+	head := AuditChainHead{Id: auditChainHeadId}
+	err := transaction.Model(&head).WherePK().For("UPDATE").Select()
+	if err != pg.ErrNoRows {
+		return &head, err
+	}
+
+	if _, err := transaction.Exec(`
+		INSERT INTO audit_chain_heads (id, hash)
+		SELECT ?, (SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1)
+		ON CONFLICT DO NOTHING`,
+		auditChainHeadId,
+	); err != nil {
+		return nil, err
+	}
+
+	return &head, transaction.Model(&head).WherePK().For("UPDATE").Select()
+}
+
+func appendAuditEvent(database *pg.DB, event *AuditEvent) error {
+	return database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		head, err := lockAuditChainHead(transaction)
+		if err != nil {
+			return err
+		}
+
+		event.PreviousHash = head.Hash
+		event.Hash = hashAuditEvent(event)
+		if _, err := transaction.Model(event).Insert(); err != nil {
+			return err
+		}
+
+		head.Hash = event.Hash
+		_, err = transaction.Model(head).Column("hash").WherePK().Update()
+
+		return err
+	})
+}
+
+// Checks that a run of consecutive events links up, starting from the hash of the event before them
+func verifyAuditEvents(previousHash []byte, events []AuditEvent) error {
+	for i := range events {
+		event := &events[i]
+		if !bytes.Equal(event.PreviousHash, previousHash) {
+			return AuditChainError{Id: event.Id, Reason: "doesn't follow the event before it"}
+		}
+		if !bytes.Equal(event.Hash, hashAuditEvent(event)) {
+			return AuditChainError{Id: event.Id, Reason: "has been modified"}
+		}
+		previousHash = event.Hash
+	}
+
+	return nil
+}
+
+// Walks the whole audit chain, returning how many events were verified
+func VerifyAuditLog(database *pg.DB) (int, error) {
+	verified := 0
+	lastId := int64(0)
+	var previousHash []byte
+	for {
+		events := make([]AuditEvent, 0)
+		if err := database.Model(&events).Where("id > ?", lastId).Order("id").Limit(1000).Select(); err != nil {
+			return verified, err
+		}
+		if len(events) == 0 {
+			return verified, nil
+		}
+
+		if err := verifyAuditEvents(previousHash, events); err != nil {
+			return verified, err
+		}
+
+		verified += len(events)
+		lastId = events[len(events)-1].Id
+		previousHash = events[len(events)-1].Hash
+	}
+}
+
+type auditContextKey struct{}
+
+type auditRecord struct {
+	target string
+	detail string
+}
+
+// Records what a request operated on, for handlers where the request path doesn't say
+func setAuditTarget(request *http.Request, target string) {
+	if record, ok := request.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		record.target = target
+	}
+}
+
+// Records what a successful request changed, for operations where the outcome alone isn't enough to reconstruct it
+func setAuditDetail(request *http.Request, detail string) {
+	if record, ok := request.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		record.detail = detail
+	}
+}
+
+// Keeps the status of a response and the start of an error body, which is what failed operations are recorded with
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	detail bytes.Buffer
+}
+
+func (writer *auditResponseWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *auditResponseWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	if writer.status >= 400 && writer.detail.Len() < maximumAuditDetailLength {
+		remaining := maximumAuditDetailLength - writer.detail.Len()
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		writer.detail.Write(data[:remaining])
+	}
+
+	return writer.ResponseWriter.Write(data)
+}
+
+// Lets streaming handlers flush through the audit writer
+func (writer *auditResponseWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func getRequestId(request *http.Request) string {
+	requestId := request.Header.Get("X-Request-Id")
+	if requestId == "" || len(requestId) > 128 {
+		return uuid.New().String()
+	}
+
+	return requestId
+}
+
+func getSourceIp(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+
+	return host
+}
+
+func auditOutcome(status int) AuditOutcome {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuditDenied
+	case status >= 400:
+		return AuditFailure
+	default:
+		return AuditSuccess
+	}
+}
+
+// Wraps a route's handler so every request to it is appended to the audit log
+func auditRoute(database *pg.DB, method string, path string, handler http.HandlerFunc) http.HandlerFunc {
+	action := fmt.Sprintf("%s %s", method, path)
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		event := AuditEvent{
+			Action:     action,
+			RequestId:  getRequestId(request),
+			SourceIp:   getSourceIp(request),
+			OccurredAt: time.Now().UTC().Truncate(time.Microsecond),
+		}
+		writer.Header().Set("X-Request-Id", event.RequestId)
+
+		// The actor is looked up before the handler runs, which might delete the token
+		if tokenId := getAdminTokenId(request); tokenId != uuid.Nil {
+			event.ActorToken = tokenFingerprint(tokenId)
+			if token, err := getTokenById(database, tokenId); err == nil {
+				event.ActorUserId = &token.UserId
+			}
+		}
+
+		record := &auditRecord{target: request.URL.Path}
+		auditWriter := &auditResponseWriter{ResponseWriter: writer}
+		handler(auditWriter, request.WithContext(context.WithValue(request.Context(), auditContextKey{}, record)))
+
+		if auditWriter.status == 0 {
+			auditWriter.status = http.StatusOK
+		}
+		event.Target = record.target
+		event.Status = auditWriter.status
+		event.Outcome = auditOutcome(auditWriter.status)
+		// Denials echo whatever token was presented, so only failures keep their message
+		if event.Outcome == AuditFailure {
+			event.Detail = strings.TrimSpace(auditWriter.detail.String())
+		} else if event.Outcome == AuditSuccess {
+			event.Detail = record.detail
+		}
+
+		if err := appendAuditEvent(database, &event); err != nil {
+			fmt.Printf("Unable to append audit event for request '%s': %s\n", event.RequestId, err.Error())
+		}
+	}
+}
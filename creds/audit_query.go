@@ -0,0 +1,306 @@
+package creds
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+)
+
+const defaultAuditPageSize = 100
+const maximumAuditPageSize = 1000
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// What audit events are searched for. Tokens are matched by fingerprint, so either a token id or its fingerprint can
+// be given.
+type auditFilter struct {
+	actorUserId *uuid.UUID
+	actorToken  string
+	target      string
+	action      string
+	outcome     AuditOutcome
+	since       time.Time
+	until       time.Time
+}
+
+func parseTokenFilter(value string) (string, error) {
+	// `uuid.Parse` also takes 32 hex digits without dashes, which is what a fingerprint looks like
+	if tokenId, err := uuid.Parse(value); err == nil && len(value) == 36 {
+		return tokenFingerprint(tokenId), nil
+	}
+
+	if _, err := hex.DecodeString(value); err != nil || len(value) != 32 {
+		return "", fmt.Errorf("'%s' is neither a token id nor a token fingerprint", value)
+	}
+
+	return value, nil
+}
+
+func parseTimeFilter(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' has to be an RFC 3339 timestamp", name)
+	}
+
+	return parsed, nil
+}
+
+func parseAuditFilter(query url.Values) (auditFilter, error) {
+	filter := auditFilter{action: query.Get("action"), outcome: AuditOutcome(query.Get("outcome"))}
+
+	if actor := query.Get("actor"); actor != "" {
+		actorUserId, err := uuid.Parse(actor)
+		if err != nil {
+			return filter, errors.New("'actor' has to be a user id")
+		}
+		filter.actorUserId = &actorUserId
+	}
+
+	if actorToken := query.Get("actorToken"); actorToken != "" {
+		fingerprint, err := parseTokenFilter(actorToken)
+		if err != nil {
+			return filter, err
+		}
+		filter.actorToken = fingerprint
+	}
+
+	if user, token := query.Get("user"), query.Get("token"); user != "" && token != "" {
+		return filter, errors.New("only one of 'user' and 'token' can be given")
+	} else if user != "" {
+		userId, err := uuid.Parse(user)
+		if err != nil {
+			return filter, errors.New("'user' has to be a user id")
+		}
+		filter.target = auditUserTarget(userId)
+	} else if token != "" {
+		fingerprint, err := parseTokenFilter(token)
+		if err != nil {
+			return filter, err
+		}
+		filter.target = "token:" + fingerprint
+	}
+
+	switch filter.outcome {
+	case "", AuditSuccess, AuditDenied, AuditFailure:
+	default:
+		return filter, fmt.Errorf("'outcome' has to be '%s', '%s' or '%s'", AuditSuccess, AuditDenied, AuditFailure)
+	}
+
+	var err error
+	if filter.since, err = parseTimeFilter(query, "since"); err != nil {
+		return filter, err
+	}
+	if filter.until, err = parseTimeFilter(query, "until"); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+func (filter auditFilter) apply(query *orm.Query) *orm.Query {
+	if filter.actorUserId != nil {
+		query = query.Where("actor_user_id = ?", *filter.actorUserId)
+	}
+	if filter.actorToken != "" {
+		query = query.Where("actor_token = ?", filter.actorToken)
+	}
+	if filter.target != "" {
+		query = query.Where("target = ?", filter.target)
+	}
+	if filter.action != "" {
+		query = query.Where("action = ?", filter.action)
+	}
+	if filter.outcome != "" {
+		query = query.Where("outcome = ?", filter.outcome)
+	}
+	if !filter.since.IsZero() {
+		query = query.Where("occurred_at >= ?", filter.since)
+	}
+	if !filter.until.IsZero() {
+		query = query.Where("occurred_at < ?", filter.until)
+	}
+
+	return query
+}
+
+// Cursors are opaque to clients; they hold the id of the last event on the previous page
+func encodeAuditCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeAuditCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	bytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+
+	id, err := strconv.ParseInt(string(bytes), 10, 64)
+	if err != nil || id < 0 {
+		return 0, errInvalidCursor
+	}
+
+	return id, nil
+}
+
+func getAuditEvents(database *pg.DB, filter auditFilter, afterId int64, limit int) ([]AuditEvent, error) {
+	events := make([]AuditEvent, 0)
+	query := filter.apply(database.Model(&events).Where("id > ?", afterId)).Order("id").Limit(limit)
+	if err := query.Select(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+type auditPage struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+var auditCsvHeader = []string{
+	"id", "occurredAt", "actorToken", "actorUserId", "action", "target", "requestId", "sourceIp", "outcome", "status",
+	"detail", "hash",
+}
+
+func auditCsvRecord(event AuditEvent) []string {
+	actorUserId := ""
+	if event.ActorUserId != nil {
+		actorUserId = event.ActorUserId.String()
+	}
+
+	return []string{
+		strconv.FormatInt(event.Id, 10),
+		event.OccurredAt.UTC().Format(time.RFC3339Nano),
+		event.ActorToken,
+		actorUserId,
+		event.Action,
+		event.Target,
+		event.RequestId,
+		event.SourceIp,
+		string(event.Outcome),
+		strconv.Itoa(event.Status),
+		event.Detail,
+		hex.EncodeToString(event.Hash),
+	}
+}
+
+// Searches the audit log. Results come a page at a time as JSON, or with `format=ndjson` or `format=csv` every
+// matching event is streamed from the cursor onwards.
+func handleGetAuditEvents(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, err := authenticateRequest(database, request)
+		if err != nil || !(token.hasScope(settings.AuditReadScope) || token.hasScope(adminScope)) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		query := request.URL.Query()
+		filter, err := parseAuditFilter(query)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		afterId, err := decodeAuditCursor(query.Get("cursor"))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		switch format := query.Get("format"); format {
+		case "", "json":
+			limit := defaultAuditPageSize
+			if limitString := query.Get("limit"); limitString != "" {
+				limit, err = strconv.Atoi(limitString)
+				if err != nil || limit < 1 || limit > maximumAuditPageSize {
+					response := fmt.Sprintf("'limit' has to be between 1 and %d", maximumAuditPageSize)
+					http.Error(writer, response, http.StatusBadRequest)
+
+					return
+				}
+			}
+
+			events, err := getAuditEvents(database, filter, afterId, limit)
+			if err != nil {
+				response := fmt.Sprintf("Error getting audit events: %s", err.Error())
+				http.Error(writer, response, http.StatusInternalServerError)
+
+				return
+			}
+
+			page := auditPage{Events: events}
+			if len(events) == limit {
+				page.NextCursor = encodeAuditCursor(events[len(events)-1].Id)
+			}
+
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(page)
+		case "ndjson", "csv":
+			streamAuditEvents(writer, database, filter, afterId, format)
+		default:
+			http.Error(writer, "'format' has to be 'json', 'ndjson' or 'csv'", http.StatusBadRequest)
+		}
+	}
+}
+
+func streamAuditEvents(writer http.ResponseWriter, database *pg.DB, filter auditFilter, afterId int64, format string) {
+	encoder := json.NewEncoder(writer)
+	csvWriter := csv.NewWriter(writer)
+	if format == "csv" {
+		writer.Header().Set("Content-Type", "text/csv")
+		_ = csvWriter.Write(auditCsvHeader)
+	} else {
+		writer.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	for {
+		events, err := getAuditEvents(database, filter, afterId, maximumAuditPageSize)
+		if err != nil {
+			// The status has already been sent, so all that can be done is to cut the export short
+			fmt.Printf("Unable to get audit events for export: %s\n", err.Error())
+
+			return
+		}
+
+		for _, event := range events {
+			if format == "csv" {
+				_ = csvWriter.Write(auditCsvRecord(event))
+			} else if err := encoder.Encode(event); err != nil {
+				return
+			}
+		}
+		csvWriter.Flush()
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if len(events) < maximumAuditPageSize {
+			return
+		}
+		afterId = events[len(events)-1].Id
+	}
+}
@@ -0,0 +1,128 @@
+package creds
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAuditChainVerification(t *testing.T) {
+	userId := uuid.New()
+	events := make([]AuditEvent, 0)
+	var previousHash []byte
+	for i, action := range []string{"POST /users", "DELETE /users", "GET /tokens"} {
+		event := AuditEvent{
+			Id:          int64(i + 1),
+			ActorToken:  tokenFingerprint(uuid.New()),
+			ActorUserId: &userId,
+			Action:      action,
+			RequestId:   uuid.New().String(),
+			SourceIp:    "127.0.0.1",
+			Outcome:     AuditSuccess,
+			Status:      200,
+			OccurredAt:  time.Now(),
+		}
+		event.PreviousHash = previousHash
+		event.Hash = hashAuditEvent(&event)
+		previousHash = event.Hash
+		events = append(events, event)
+	}
+
+	if err := verifyAuditEvents(nil, events); err != nil {
+		log.Panicf("Untouched chain failed verification: %s", err.Error())
+	}
+
+	modified := append([]AuditEvent{}, events...)
+	modified[1].Outcome = AuditFailure
+	if err := verifyAuditEvents(nil, modified); err == nil || err.(AuditChainError).Id != 2 {
+		log.Panicf("Modified event wasn't detected: %v", err)
+	}
+
+	removed := []AuditEvent{events[0], events[2]}
+	if err := verifyAuditEvents(nil, removed); err == nil || err.(AuditChainError).Id != 3 {
+		log.Panicf("Removed event wasn't detected: %v", err)
+	}
+}
+
+func TestAppendAuditEvent(t *testing.T) {
+	d := initializeTestData(nil)
+
+	for _, action := range []string{"POST /users", "DELETE /users", "GET /tokens"} {
+		event := AuditEvent{
+			Action:     action,
+			RequestId:  uuid.New().String(),
+			SourceIp:   "127.0.0.1",
+			Outcome:    AuditSuccess,
+			Status:     200,
+			OccurredAt: time.Now(),
+		}
+		if err := appendAuditEvent(d.database, &event); err != nil {
+			log.Panicf("Unable to append audit event: %s", err.Error())
+		}
+
+		head := AuditChainHead{Id: auditChainHeadId}
+		if err := d.database.Model(&head).WherePK().Select(); err != nil || !bytes.Equal(head.Hash, event.Hash) {
+			log.Panicf("Chain head doesn't point at the newest event: %v", err)
+		}
+	}
+
+	if verified, err := VerifyAuditLog(d.database); err != nil || verified != 3 {
+		log.Panicf("Appended events didn't verify, %d verified: %v", verified, err)
+	}
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	tokenId := uuid.New()
+	if tokenFingerprint(tokenId) != tokenFingerprint(tokenId) || tokenFingerprint(tokenId) == tokenFingerprint(uuid.New()) {
+		log.Panicf("Fingerprints aren't stable and distinct")
+	}
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	userId := uuid.New()
+	tokenId := uuid.New()
+	query := url.Values{
+		"actor":      {userId.String()},
+		"actorToken": {tokenId.String()},
+		"token":      {tokenFingerprint(tokenId)},
+		"outcome":    {"denied"},
+		"since":      {"2026-01-01T00:00:00Z"},
+	}
+
+	filter, err := parseAuditFilter(query)
+	if err != nil {
+		log.Panicf("Unable to parse filter: %s", err.Error())
+	}
+	if *filter.actorUserId != userId || filter.actorToken != tokenFingerprint(tokenId) ||
+		filter.target != auditTokenTarget(tokenId) || filter.outcome != AuditDenied || filter.since.Year() != 2026 {
+		log.Panicf("Unexpected filter: %+v", filter)
+	}
+
+	invalid := []url.Values{
+		{"actor": {"someone"}},
+		{"user": {userId.String()}, "token": {tokenId.String()}},
+		{"token": {"abc"}},
+		{"outcome": {"maybe"}},
+		{"until": {"yesterday"}},
+	}
+	for _, query := range invalid {
+		if _, err := parseAuditFilter(query); err == nil {
+			log.Panicf("Invalid filter was accepted: %v", query)
+		}
+	}
+}
+
+func TestAuditCursor(t *testing.T) {
+	id, err := decodeAuditCursor(encodeAuditCursor(4711))
+	if err != nil || id != 4711 {
+		log.Panicf("Cursor didn't round trip: %d, %v", id, err)
+	}
+
+	if _, err := decodeAuditCursor("not a cursor"); err == nil {
+		log.Panicf("Invalid cursor was accepted")
+	}
+}
@@ -0,0 +1,468 @@
+package creds
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+)
+
+// Every client certificate the CA has issued, so that they can be revoked and their status looked up. Certificates
+// are revoked along with the token they were issued with, and kept when their user is deleted, revoked, so that they
+// stay on the CRL.
+type IssuedCertificate struct {
+	Serial           string    `json:"serial" pg:",pk"`
+	UserId           uuid.UUID `json:"userId" pg:"type:uuid,notnull"`
+	TokenId          uuid.UUID `json:"tokenId" pg:"type:uuid,notnull"`
+	Subject          string    `json:"subject" pg:",notnull"`
+	Scopes           []string  `json:"scopes" pg:",array"`
+	NotBefore        time.Time `json:"notBefore" pg:",notnull"`
+	NotAfter         time.Time `json:"notAfter" pg:",notnull"`
+	RevokedAt        time.Time `json:"revokedAt,omitempty"`
+	RevocationReason int       `json:"revocationReason,omitempty"`
+}
+
+var errInvalidCertificateRequest = errors.New("invalid certificate signing request")
+
+// URIs put in the SAN of issued certificates to identify the user and what they're allowed to do
+func userUri(userId uuid.UUID) *url.URL {
+	return &url.URL{Scheme: "urn", Opaque: fmt.Sprintf("creds:user:%s", userId)}
+}
+
+func scopeUri(scope string) *url.URL {
+	return &url.URL{Scheme: "urn", Opaque: fmt.Sprintf("creds:scope:%s", url.PathEscape(scope))}
+}
+
+func parseCertificateRequest(csrPem string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPem))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errInvalidCertificateRequest
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	return csr, nil
+}
+
+// Issues a client certificate for the public key in the CSR. Only the key is taken from the CSR; everything else is
+// decided by who is asking, and the certificate never outlives the token it was requested with.
+func issueClientCertificate(
+	database *pg.DB,
+	keyStore *keyStore,
+	token *Token,
+	user *User,
+	csr *x509.CertificateRequest,
+	lifetime time.Duration,
+) ([]byte, *x509.Certificate, error) {
+	caCertificate, caKey, err := keyStore.certificateAuthority()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(lifetime)
+	if token.End.Before(notAfter) {
+		notAfter = token.End
+	}
+	if caCertificate.NotAfter.Before(notAfter) {
+		notAfter = caCertificate.NotAfter
+	}
+
+	scopes := parseScopes(token.Scope)
+	uris := []*url.URL{userUri(user.Id)}
+	for _, scope := range scopes {
+		uris = append(uris, scopeUri(scope))
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: user.Username},
+		URIs:         uris,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, &template, caCertificate, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issuedCertificate := IssuedCertificate{
+		Serial:    serial.Text(16),
+		UserId:    user.Id,
+		TokenId:   token.Id,
+		Subject:   user.Username,
+		Scopes:    scopes,
+		NotBefore: template.NotBefore,
+		NotAfter:  template.NotAfter,
+	}
+	if _, err := database.Model(&issuedCertificate).Insert(); err != nil {
+		return nil, nil, err
+	}
+
+	return certificateBytes, caCertificate, nil
+}
+
+func createCertificateRevocationList(database *pg.DB, keyStore *keyStore) ([]byte, error) {
+	caCertificate, caKey, err := keyStore.certificateAuthority()
+	if err != nil {
+		return nil, err
+	}
+
+	revokedCertificates := make([]IssuedCertificate, 0)
+	if err := database.Model(&revokedCertificates).
+		Where("revoked_at IS NOT NULL AND not_after > ?", time.Now()).
+		Order("revoked_at").
+		Select(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]pkix.RevokedCertificate, 0, len(revokedCertificates))
+	for _, revokedCertificate := range revokedCertificates {
+		serial, ok := new(big.Int).SetString(revokedCertificate.Serial, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: revokedCertificate.RevokedAt,
+		})
+	}
+
+	now := time.Now()
+	template := x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(time.Hour),
+	}
+
+	return x509.CreateRevocationList(rand.Reader, &template, caCertificate, caKey)
+}
+
+// CRL reason code for certificates revoked because their user no longer exists
+const cessationOfOperation = 5
+
+// CRL reason code for certificates revoked along with the token they were issued with
+const privilegeWithdrawn = 9
+
+// Certificates carry their token's scopes, so they go on the CRL when the token is revoked
+func revokeTokenCertificates(transaction *pg.Tx, tokenIds ...uuid.UUID) error {
+	_, err := transaction.Model((*IssuedCertificate)(nil)).
+		Set("revoked_at = ?", time.Now()).
+		Set("revocation_reason = ?", privilegeWithdrawn).
+		Where("token_id IN (?) AND revoked_at IS NULL", pg.In(tokenIds)).
+		Update()
+
+	return err
+}
+
+func revokeUserCertificates(transaction *pg.Tx, userId uuid.UUID) error {
+	_, err := transaction.Model((*IssuedCertificate)(nil)).
+		Set("revoked_at = ?", time.Now()).
+		Set("revocation_reason = ?", cessationOfOperation).
+		Where("user_id = ? AND revoked_at IS NULL", userId).
+		Update()
+
+	return err
+}
+
+type issueCertificateParameters struct {
+	Csr string
+}
+
+func handleIssueCertificate(database *pg.DB, keyStore *keyStore, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, err := authenticateRequest(database, request)
+		if err != nil {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters issueCertificateParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for issuing certificate: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		csr, err := parseCertificateRequest(parameters.Csr)
+		if err != nil {
+			response := fmt.Sprintf("Unable to use certificate signing request: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		user, err := getUserById(database, token.UserId)
+		if err != nil {
+			response := fmt.Sprintf("Error getting user: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		certificate, caCertificate, err := issueClientCertificate(database,
+			keyStore,
+			token,
+			user,
+			csr,
+			settings.ClientCertificateLifetime,
+		)
+		if err != nil {
+			response := fmt.Sprintf("Unable to issue certificate: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_ = pem.Encode(writer, &pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+		_ = pem.Encode(writer, &pem.Block{Type: "CERTIFICATE", Bytes: caCertificate.Raw})
+	}
+}
+
+type certificateStatusResponse struct {
+	Serial    string    `json:"serial"`
+	Status    string    `json:"status"`
+	NotAfter  time.Time `json:"notAfter,omitempty"`
+	RevokedAt time.Time `json:"revokedAt,omitempty"`
+}
+
+// Status of a certificate in the style of OCSP: `good`, `revoked` or `unknown`. Expired certificates are reported
+// as `good` along with their expiry, the same way OCSP responders do.
+func handleGetCertificateStatus(database *pg.DB) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		parameters := getParameters(request)
+		if parameters == nil {
+			http.Error(writer, "No `Serial` given as path parameter", http.StatusBadRequest)
+
+			return
+		}
+
+		serial, ok := new(big.Int).SetString(parameters.ByName("Serial"), 16)
+		if !ok {
+			http.Error(writer, "Unable to get `Serial` from parameter", http.StatusBadRequest)
+
+			return
+		}
+
+		issuedCertificate := IssuedCertificate{Serial: serial.Text(16)}
+		if err := database.Model(&issuedCertificate).WherePK().Select(); err != nil {
+			if err == pg.ErrNoRows {
+				_ = json.NewEncoder(writer).Encode(certificateStatusResponse{Serial: serial.Text(16), Status: "unknown"})
+
+				return
+			}
+			response := fmt.Sprintf("Error getting certificate: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		status := "good"
+		if !issuedCertificate.RevokedAt.IsZero() {
+			status = "revoked"
+		}
+
+		_ = json.NewEncoder(writer).Encode(certificateStatusResponse{
+			Serial:    issuedCertificate.Serial,
+			Status:    status,
+			NotAfter:  issuedCertificate.NotAfter,
+			RevokedAt: issuedCertificate.RevokedAt,
+		})
+	}
+}
+
+type revokeCertificateParameters struct {
+	// One of the CRL reason codes from RFC 5280
+	Reason null.Int
+}
+
+func handleRevokeCertificate(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		parameters := getParameters(request)
+		if parameters == nil {
+			http.Error(writer, "No `Serial` given as path parameter", http.StatusBadRequest)
+
+			return
+		}
+
+		serial, ok := new(big.Int).SetString(parameters.ByName("Serial"), 16)
+		if !ok {
+			http.Error(writer, "Unable to get `Serial` from parameter", http.StatusBadRequest)
+
+			return
+		}
+
+		var revokeParameters revokeCertificateParameters
+		if request.ContentLength != 0 {
+			if err := json.NewDecoder(request.Body).Decode(&revokeParameters); err != nil {
+				response := fmt.Sprintf("Error decoding parameters for revoking certificate: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		result, err := database.Model((*IssuedCertificate)(nil)).
+			Set("revoked_at = ?", time.Now()).
+			Set("revocation_reason = ?", revokeParameters.Reason.Int64).
+			Where("serial = ? AND revoked_at IS NULL", serial.Text(16)).
+			Update()
+		if err != nil {
+			response := fmt.Sprintf("Unable to revoke certificate: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if result.RowsAffected() == 0 {
+			response := fmt.Sprintf("Unrevoked certificate with serial '%s' not found", serial.Text(16))
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
+
+func handleGetCertificateAuthority(keyStore *keyStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		caCertificate, _, err := keyStore.certificateAuthority()
+		if err != nil {
+			response := fmt.Sprintf("Unable to get CA certificate: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		_ = pem.Encode(writer, &pem.Block{Type: "CERTIFICATE", Bytes: caCertificate.Raw})
+	}
+}
+
+type importCertificateAuthorityParameters struct {
+	Certificate string
+	Key         string
+}
+
+// Replaces the CA with an intermediate signed elsewhere. Certificates issued by the previous CA stay valid for
+// anyone who still trusts it.
+func handleImportCertificateAuthority(database *pg.DB, adminScope string, keyStore *keyStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters importCertificateAuthorityParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for importing CA: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		certificateBlock, _ := pem.Decode([]byte(parameters.Certificate))
+		keyBlock, _ := pem.Decode([]byte(parameters.Key))
+		if certificateBlock == nil || keyBlock == nil {
+			http.Error(writer, "'certificate' and 'key' have to be PEM encoded", http.StatusBadRequest)
+
+			return
+		}
+
+		certificate, err := x509.ParseCertificate(certificateBlock.Bytes)
+		if err != nil {
+			response := fmt.Sprintf("Unable to parse certificate: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			response := fmt.Sprintf("Unable to parse PKCS #8 key: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok || !certificate.IsCA || certificate.KeyUsage&x509.KeyUsageCertSign == 0 {
+			http.Error(writer, "Certificate and key can't be used as a CA", http.StatusBadRequest)
+
+			return
+		}
+
+		if publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok ||
+			!publicKey.Equal(certificate.PublicKey) {
+			http.Error(writer, "Key doesn't match certificate", http.StatusBadRequest)
+
+			return
+		}
+
+		if _, err := keyStore.put(certificateAuthorityKeyName, signer, certificate.Raw, true); err != nil {
+			response := fmt.Sprintf("Unable to store CA: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+	}
+}
+
+func handleGetCertificateRevocationList(database *pg.DB, keyStore *keyStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		crl, err := createCertificateRevocationList(database, keyStore)
+		if err != nil {
+			response := fmt.Sprintf("Unable to create CRL: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/pkix-crl")
+		_, _ = writer.Write(crl)
+	}
+}
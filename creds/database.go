@@ -1,6 +1,7 @@
 package creds
 
 import (
+	"crypto/rand"
 	"fmt"
 	"log"
 	"time"
@@ -21,9 +22,39 @@ func ConnectToDatabase(options DatabaseOptions) *pg.DB {
 	})
 }
 
-func CreateSchema(database *pg.DB, options *orm.CreateTableOptions) error {
-	models := []interface{}{(*User)(nil), (*Token)(nil)}
+var models = []interface{}{
+	(*User)(nil),
+	(*Token)(nil),
+	(*TotpEnrollment)(nil),
+	(*RecoveryCode)(nil),
+	(*SigningKey)(nil),
+	(*UsedNonce)(nil),
+	(*StoredKey)(nil),
+	(*IssuedCertificate)(nil),
+	(*SshCertificate)(nil),
+	(*Secret)(nil),
+	(*EngineRole)(nil),
+	(*Lease)(nil),
+	(*TransitKey)(nil),
+	(*SealConfiguration)(nil),
+	(*AuditEvent)(nil),
+	(*AuditChainHead)(nil),
+	(*WebhookSubscription)(nil),
+	(*WebhookDelivery)(nil),
+	(*OutboxEvent)(nil),
+	(*TokenExpiryNotice)(nil),
+	(*ArchivedToken)(nil),
+}
+
+// Models with a `user_id` column, which are deleted along with their user
+var userOwnedModels = []interface{}{
+	(*Token)(nil),
+	(*TotpEnrollment)(nil),
+	(*RecoveryCode)(nil),
+	(*SigningKey)(nil),
+}
 
+func CreateSchema(database *pg.DB, options *orm.CreateTableOptions) error {
 	for _, m := range models {
 		err := database.Model(m).CreateTable(options)
 		if err != nil {
@@ -31,14 +62,95 @@ func CreateSchema(database *pg.DB, options *orm.CreateTableOptions) error {
 		}
 	}
 
+	for _, migration := range columnMigrations {
+		if _, err := database.Exec(migration); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range indexes {
+		if _, err := database.Exec(index); err != nil {
+			return err
+		}
+	}
+
+	for _, statement := range auditLogProtection {
+		if _, err := database.Exec(statement); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// `CreateTable` leaves existing tables alone, so columns added to a model after its table was first created have to
+// be added here as well for existing databases to pick them up.
+var columnMigrations = []string{
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS kind text NOT NULL DEFAULT 'human'",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS owner_id uuid",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS owner_group text",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active'",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS status_reason text",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS status_changed_at timestamptz",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now()",
+	// Users used to only be disabled or not
+	`DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'disabled') THEN
+			UPDATE users SET status = 'deactivated', status_changed_at = now() WHERE disabled;
+			ALTER TABLE users DROP COLUMN disabled;
+		END IF;
+	END
+	$$`,
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash text",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS default_scopes text[]",
+	"ALTER TABLE tokens ADD COLUMN IF NOT EXISTS certificate_thumbprint text",
+	"ALTER TABLE tokens ADD COLUMN IF NOT EXISTS jwk_thumbprint text",
+	"ALTER TABLE tokens ADD COLUMN IF NOT EXISTS metadata jsonb",
+	"ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now()",
+	"ALTER TABLE archived_tokens ADD COLUMN IF NOT EXISTS metadata jsonb",
+	"ALTER TABLE outbox ADD COLUMN IF NOT EXISTS claimed_until timestamptz",
+}
+
+// For the orders lists are paged through in, for looking up a user's tokens and for finding what the outbox relay
+// publishes next
+var indexes = []string{
+	"CREATE INDEX IF NOT EXISTS users_created_at_id ON users (created_at, id)",
+	"CREATE INDEX IF NOT EXISTS tokens_created_at_id ON tokens (created_at, id)",
+	`CREATE INDEX IF NOT EXISTS tokens_end_id ON tokens ("end", id)`,
+	"CREATE INDEX IF NOT EXISTS tokens_user_id ON tokens (user_id)",
+	`CREATE INDEX IF NOT EXISTS outbox_unpublished_aggregate ON outbox (aggregate_type, aggregate_id, sequence)
+	WHERE published_at IS NULL`,
+	// Deliveries are deduplicated on subscription and event, which databases from before the constraint may need
+	// cleaning up for first
+	`DELETE FROM webhook_deliveries duplicate USING webhook_deliveries original
+	WHERE duplicate.subscription_id = original.subscription_id AND duplicate.event_id = original.event_id
+	AND (duplicate.created_at, duplicate.id) > (original.created_at, original.id)`,
+	"CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_subscription_event ON webhook_deliveries (subscription_id, event_id)",
+}
+
+// Makes the audit log append-only for everyone going through the database, short of dropping the triggers
+var auditLogProtection = []string{
+	`CREATE OR REPLACE FUNCTION reject_audit_event_change() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END
+	$$ LANGUAGE plpgsql`,
+	"DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events",
+	`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE PROCEDURE reject_audit_event_change()`,
+	"DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events",
+	`CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE PROCEDURE reject_audit_event_change()`,
+}
+
 type setUpData struct {
 	adminId    uuid.UUID
 	adminToken uuid.UUID
 	database   *pg.DB
 	adminScope string
+	settings   Settings
 }
 
 func initializeTestData(database *pg.DB) setUpData {
@@ -54,7 +166,6 @@ func initializeTestData(database *pg.DB) setUpData {
 	if database == nil {
 		database = ConnectToDatabase(databaseOptions)
 	}
-	models := []interface{}{(*User)(nil), (*Token)(nil)}
 	for _, model := range models {
 		if err := database.Model(model).CreateTable(
 			&orm.CreateTableOptions{Temp: true, IfNotExists: true, FKConstraints: true},
@@ -68,10 +179,25 @@ func initializeTestData(database *pg.DB) setUpData {
 		log.Panicf("Unable to create admin user: %s", err.Error())
 	}
 
-	adminToken, err := insertToken(database, adminId, adminScope, time.Time{}, time.Time{})
+	adminToken, err := insertToken(database, adminId, adminScope, time.Time{}, time.Time{}, tokenBinding{})
 	if err != nil {
 		log.Panicf("Unable to create admin token: %s", err.Error())
 	}
 
-	return setUpData{adminId: adminId, adminToken: adminToken, database: database, adminScope: adminScope}
+	// Cheap hashing parameters to keep tests that set passwords fast
+	settings := DefaultSettings()
+	settings.PasswordParameters.Time = 1
+	settings.PasswordParameters.Memory = 1024
+	settings.MasterKey = make([]byte, 32)
+	if _, err := rand.Read(settings.MasterKey); err != nil {
+		log.Panicf("Unable to generate master key: %s", err.Error())
+	}
+
+	return setUpData{
+		adminId:    adminId,
+		adminToken: adminToken,
+		database:   database,
+		adminScope: adminScope,
+		settings:   settings,
+	}
 }
@@ -49,7 +49,13 @@ func TestAddAndGetToken(t *testing.T) {
 		log.Panicf("User with id '%s' does not exist or has incorrect data: %+v", id, user)
 	}
 
-	tokenId, err := insertToken(d.database, user.Id, "TestingScope", time.Now(), time.Now().AddDate(1, 0, 0))
+	tokenId, err := insertToken(d.database,
+		user.Id,
+		"TestingScope",
+		time.Now(),
+		time.Now().AddDate(1, 0, 0),
+		tokenBinding{},
+	)
 	if err != nil {
 		log.Panicf("Unable to insert token: %s", err.Error())
 	}
@@ -66,3 +72,42 @@ func TestAddAndGetToken(t *testing.T) {
 		log.Panicf("Returned token is incorrect:\n%+v", token)
 	}
 }
+
+func TestReapTokens(t *testing.T) {
+	d := initializeTestData(nil)
+
+	expiredToken, err := insertToken(d.database,
+		d.adminId,
+		"TestingScope",
+		time.Now().AddDate(0, -3, 0),
+		time.Now().AddDate(0, -2, 0),
+		tokenBinding{},
+	)
+	if err != nil {
+		log.Panicf("Unable to insert token: %s", err.Error())
+	}
+
+	candidates, err := reapTokens(d.database, 30*24*time.Hour, true)
+	if err != nil || candidates != 1 {
+		log.Panicf("Dry run found %d candidates: %v", candidates, err)
+	}
+	if _, err := getTokenById(d.database, expiredToken); err != nil {
+		log.Panicf("Dry run archived a token")
+	}
+
+	reaped, err := reapTokens(d.database, 30*24*time.Hour, false)
+	if err != nil || reaped != 1 {
+		log.Panicf("Reaped %d tokens: %v", reaped, err)
+	}
+	if _, err := getTokenById(d.database, expiredToken); err == nil {
+		log.Panicf("Expired token is still in `tokens`")
+	}
+	if _, err := getTokenById(d.database, d.adminToken); err != nil {
+		log.Panicf("Valid token was reaped")
+	}
+
+	archivedToken := ArchivedToken{Id: expiredToken}
+	if err := d.database.Model(&archivedToken).WherePK().Select(); err != nil || archivedToken.Reason != ExpiredToken {
+		log.Panicf("Expired token wasn't archived: %v", err)
+	}
+}
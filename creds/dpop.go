@@ -0,0 +1,253 @@
+package creds
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// DPoP proofs (RFC 9449) are only accepted when issued within this long of the request they're sent with, which is
+// also how long their `jti`s are remembered to prevent replay.
+const dpopProofLifetime = 5 * time.Minute
+
+var errInvalidDpopProof = errors.New("invalid DPoP proof")
+var errMissingDpopProof = errors.New("token is DPoP bound but no DPoP proof was given")
+var errDpopKeyMismatch = errors.New("token is bound to a different DPoP key")
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	// Private key members; a proof carrying any of these is rejected
+	D string `json:"d,omitempty"`
+}
+
+type dpopHeader struct {
+	Typ string     `json:"typ"`
+	Alg string     `json:"alg"`
+	Jwk jsonWebKey `json:"jwk"`
+}
+
+type dpopClaims struct {
+	Jti string `json:"jti"`
+	Htm string `json:"htm"`
+	Htu string `json:"htu"`
+	Iat int64  `json:"iat"`
+	Ath string `json:"ath,omitempty"`
+}
+
+type dpopProof struct {
+	claims     dpopClaims
+	thumbprint string
+}
+
+// The JWK thumbprint from RFC 7638: the SHA-256 hash of the required members in lexicographic order
+func (key jsonWebKey) thumbprint() (string, error) {
+	var canonical string
+	switch key.Kty {
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, key.Crv, key.X, key.Y)
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, key.E, key.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, key.Crv, key.X)
+	default:
+		return "", fmt.Errorf("unsupported key type '%s'", key.Kty)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func decodeBigInt(encoded string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+func (key jsonWebKey) verify(alg string, signingInput []byte, signature []byte) error {
+	digest := sha256.Sum256(signingInput)
+
+	switch {
+	case alg == "ES256" && key.Kty == "EC" && key.Crv == "P-256":
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return err
+		}
+		publicKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !publicKey.Curve.IsOnCurve(x, y) || len(signature) != 64 {
+			return errInvalidDpopProof
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(&publicKey, digest[:], r, s) {
+			return errInvalidDpopProof
+		}
+
+		return nil
+
+	case alg == "RS256" && key.Kty == "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() {
+			return errInvalidDpopProof
+		}
+		publicKey := rsa.PublicKey{N: n, E: int(e.Int64())}
+
+		return rsa.VerifyPKCS1v15(&publicKey, crypto.SHA256, digest[:], signature)
+
+	case alg == "EdDSA" && key.Kty == "OKP" && key.Crv == "Ed25519":
+		publicKey, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return errInvalidDpopProof
+		}
+		if !ed25519.Verify(publicKey, signingInput, signature) {
+			return errInvalidDpopProof
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unsupported DPoP algorithm '%s' for key type '%s'", alg, key.Kty)
+}
+
+// Parses a DPoP proof and verifies its signature against the key embedded in it. What the proof claims still has to
+// be checked against the request it was sent with.
+func parseDpopProof(proof string) (*dpopProof, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidDpopProof
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidDpopProof
+	}
+	claimBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidDpopProof
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidDpopProof
+	}
+
+	header := dpopHeader{}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, errInvalidDpopProof
+	}
+	if header.Typ != "dpop+jwt" || header.Jwk.D != "" {
+		return nil, errInvalidDpopProof
+	}
+
+	if err := header.Jwk.verify(header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := dpopClaims{}
+	if err := json.Unmarshal(claimBytes, &claims); err != nil {
+		return nil, errInvalidDpopProof
+	}
+	if claims.Jti == "" {
+		return nil, errInvalidDpopProof
+	}
+
+	thumbprint, err := header.Jwk.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dpopProof{claims: claims, thumbprint: thumbprint}, nil
+}
+
+// The URL the request was made to without query and fragment, as the client would put it in `htu`. Forwarding
+// headers only count when a trusted proxy sent them, see `trustedProxies`.
+func requestHtu(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	host := request.Host
+
+	if forwarded, ok := request.Context().Value(forwardedContextKey{}).(forwardedTarget); ok {
+		if forwarded.scheme != "" {
+			scheme = forwarded.scheme
+		}
+		if forwarded.host != "" {
+			host = forwarded.host
+		}
+	}
+
+	return fmt.Sprintf("%s://%s%s", strings.ToLower(scheme), strings.ToLower(host), request.URL.Path)
+}
+
+// Checks the `DPoP` header of a request: that the proof is for this request, is recent and hasn't been used before.
+// `accessToken` is the token the proof has to be bound to through `ath`, or empty when a token is being issued.
+func verifyRequestDpopProof(database *pg.DB, request *http.Request, accessToken string) (*dpopProof, error) {
+	proofs := request.Header.Values("DPoP")
+	if len(proofs) == 0 {
+		return nil, errMissingDpopProof
+	}
+	if len(proofs) > 1 {
+		return nil, errInvalidDpopProof
+	}
+
+	proof, err := parseDpopProof(proofs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if proof.claims.Htm != request.Method || strings.TrimRight(proof.claims.Htu, "/") != strings.TrimRight(requestHtu(request), "/") {
+		return nil, errInvalidDpopProof
+	}
+
+	now := time.Now()
+	issuedAt := time.Unix(proof.claims.Iat, 0)
+	if issuedAt.Before(now.Add(-dpopProofLifetime)) || issuedAt.After(now.Add(dpopProofLifetime)) {
+		return nil, errInvalidDpopProof
+	}
+
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if proof.claims.Ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return nil, errInvalidDpopProof
+		}
+	}
+
+	namespace := fmt.Sprintf("dpop:%s", proof.thumbprint)
+	if err := useNonce(database, namespace, proof.claims.Jti, issuedAt.Add(dpopProofLifetime)); err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
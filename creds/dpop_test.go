@@ -0,0 +1,173 @@
+package creds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+func createDpopProof(key *ecdsa.PrivateKey, claims dpopClaims) string {
+	header := dpopHeader{
+		Typ: "dpop+jwt",
+		Alg: "ES256",
+		Jwk: jsonWebKey{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		},
+	}
+	headerBytes, _ := json.Marshal(header)
+	claimBytes, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." +
+		base64.RawURLEncoding.EncodeToString(claimBytes)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		log.Panicf("Unable to sign DPoP proof: %s", err.Error())
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseDpopProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Panicf("Unable to generate key: %s", err.Error())
+	}
+
+	claims := dpopClaims{Jti: "a-jti", Htm: "GET", Htu: "https://creds.example/users", Iat: time.Now().Unix()}
+	proof := createDpopProof(key, claims)
+
+	parsed, err := parseDpopProof(proof)
+	if err != nil {
+		log.Panicf("Unable to parse DPoP proof: %s", err.Error())
+	}
+	if parsed.claims != claims || parsed.thumbprint == "" {
+		log.Panicf("Parsed DPoP proof doesn't match: %+v", parsed)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Panicf("Unable to generate key: %s", err.Error())
+	}
+	otherProof := createDpopProof(otherKey, claims)
+	if otherParsed, err := parseDpopProof(otherProof); err != nil || otherParsed.thumbprint == parsed.thumbprint {
+		log.Panicf("Proofs with different keys have the same thumbprint")
+	}
+
+	otherClaims := claims
+	otherClaims.Htm = "DELETE"
+	parts := strings.Split(proof, ".")
+	tampered := parts[0] + "." + strings.Split(createDpopProof(key, otherClaims), ".")[1] + "." + parts[2]
+	if _, err := parseDpopProof(tampered); err == nil {
+		log.Panicf("Tampered DPoP proof is accepted")
+	}
+}
+
+func TestDpopBoundAdminToken(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Panicf("Unable to generate key: %s", err.Error())
+	}
+	proof, err := parseDpopProof(createDpopProof(key, dpopClaims{Jti: "thumbprint"}))
+	if err != nil {
+		log.Panicf("Unable to parse DPoP proof: %s", err.Error())
+	}
+	adminToken, err := insertToken(setup.database,
+		setup.adminId,
+		setup.adminScope,
+		time.Now(),
+		time.Now().Add(time.Hour),
+		tokenBinding{jwkThumbprint: proof.thumbprint},
+	)
+	if err != nil {
+		log.Panicf("Unable to add token: %s", err.Error())
+	}
+
+	ath := sha256.Sum256([]byte(adminToken.String()))
+	post := func(url string, body string, contentType string, jti string, expected int) *httptest.ResponseRecorder {
+		proof := createDpopProof(key, dpopClaims{
+			Jti: jti,
+			Htm: "POST",
+			Htu: url,
+			Iat: time.Now().Unix(),
+			Ath: base64.RawURLEncoding.EncodeToString(ath[:]),
+		})
+
+		headers := []headerEntry{
+			{key: "Authorization", value: fmt.Sprintf("DPoP %s", adminToken)},
+			{key: "DPoP", value: proof},
+			{key: "Content-Type", value: contentType},
+		}
+
+		return expectStatus("POST", url, body, headers, router, expected)
+	}
+
+	// The proof authenticating the admin is only verified once, and binds the new token to the same key
+	body := fmt.Sprintf(`{"userId": "%s", "scope": "reader"}`, setup.adminId)
+	recorder := post("http://creds.test/tokens", body, "application/json", "add-token", http.StatusOK)
+	tokenId := uuid.UUID{}
+	if err := json.NewDecoder(recorder.Body).Decode(&tokenId); err != nil {
+		log.Panicf("Unable to decode token: %s", err.Error())
+	}
+	token, err := getTokenById(setup.database, tokenId)
+	if err != nil || token.JwkThumbprint != proof.thumbprint {
+		log.Panicf("New token not bound to the DPoP key: %+v, %v", token, err)
+	}
+
+	// Admins can introspect without the introspection scope, with one proof per request
+	form := fmt.Sprintf("token=%s", tokenId)
+	recorder = post("http://creds.test/introspect", form, "application/x-www-form-urlencoded", "introspect", http.StatusOK)
+	response := introspectionResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || !response.Active {
+		log.Panicf("Unexpected introspection: %+v, %v", response, err)
+	}
+	post("http://creds.test/introspect", form, "application/x-www-form-urlencoded", "introspect", http.StatusUnauthorized)
+}
+
+func TestRequestHtu(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		log.Panicf("Unable to parse trusted proxies: %s", err.Error())
+	}
+	if _, err := parseTrustedProxies([]string{"proxy.example"}); err == nil {
+		log.Panicln("Invalid trusted proxy parsed")
+	}
+
+	for remoteAddr, expected := range map[string]string{
+		"10.1.2.3:4567":    "https://creds.example/tokens",
+		"192.0.2.1:4567":   "https://creds.example/tokens",
+		"192.0.2.2:4567":   "http://internal:8080/tokens",
+		"203.0.113.9:4567": "http://internal:8080/tokens",
+	} {
+		request := httptest.NewRequest("POST", "http://internal:8080/tokens?x=1", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set("X-Forwarded-Host", "creds.example")
+
+		if htu := requestHtu(proxies.withForwardedTarget(request)); htu != expected {
+			log.Panicf("Unexpected htu for a request from %s: %s, expected %s", remoteAddr, htu, expected)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package creds
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"sync"
+)
+
+var errNoMasterKey = errors.New("no master key configured")
+var errSealed = errors.New("creds is sealed")
+var errInvalidCiphertext = errors.New("invalid ciphertext")
+
+// Holds the master key that secrets stored in the database are encrypted with. Ciphertexts are AES-256-GCM with the
+// nonce prepended; the associated data ties a ciphertext to the row it belongs to so it can't be moved elsewhere.
+// Once sealing is initialized the master key is only held in memory while unsealed, see `seal.go`.
+type keyring struct {
+	lock         sync.RWMutex
+	masterKey    []byte
+	seal         *SealConfiguration
+	unsealShares [][]byte
+}
+
+func newKeyring(masterKey []byte) *keyring {
+	return &keyring{masterKey: masterKey}
+}
+
+func (keyring *keyring) getMasterKey() ([]byte, error) {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	if len(keyring.masterKey) == 0 {
+		if keyring.seal != nil {
+			return nil, errSealed
+		}
+
+		return nil, errNoMasterKey
+	}
+
+	return keyring.masterKey, nil
+}
+
+func (keyring *keyring) encrypt(plaintext []byte, associatedData []byte) ([]byte, error) {
+	masterKey, err := keyring.getMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptWithKey(masterKey, plaintext, associatedData)
+}
+
+func (keyring *keyring) decrypt(ciphertext []byte, associatedData []byte) ([]byte, error) {
+	masterKey, err := keyring.getMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptWithKey(masterKey, ciphertext, associatedData)
+}
+
+func encryptWithKey(key []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func decryptWithKey(key []byte, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errInvalidCiphertext
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, sealed, associatedData)
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
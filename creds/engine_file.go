@@ -0,0 +1,96 @@
+package creds
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Writes credentials to files in a local directory, one per lease, and removes them on revocation. Meant for testing
+// and for trying out roles and leases without touching a real backend.
+type fileEngine struct {
+	directory string
+}
+
+type fileEngineConfig struct {
+	Prefix string `json:"prefix"`
+}
+
+type fileEngineCredentials struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+func newFileEngine(directory string) *fileEngine {
+	return &fileEngine{directory: directory}
+}
+
+func (engine *fileEngine) ConfigSchema() []EngineConfigField {
+	return []EngineConfigField{
+		{Name: "prefix", Type: StringField, Required: false, Description: "Prefix for generated usernames"},
+	}
+}
+
+func (engine *fileEngine) path(lease *Lease) string {
+	return filepath.Join(engine.directory, lease.Id.String()+".json")
+}
+
+func (engine *fileEngine) write(lease *Lease, credentials fileEngineCredentials) error {
+	bytes, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(engine.path(lease), bytes, 0600)
+}
+
+func (engine *fileEngine) Issue(role EngineRole, lease *Lease) (map[string]interface{}, error) {
+	config := fileEngineConfig{}
+	if err := decodeEngineConfig(role.Config, &config); err != nil {
+		return nil, err
+	}
+
+	passwordBytes := make([]byte, 16)
+	if _, err := rand.Read(passwordBytes); err != nil {
+		return nil, err
+	}
+
+	credentials := fileEngineCredentials{
+		Username:  config.Prefix + lease.Id.String(),
+		Password:  hex.EncodeToString(passwordBytes),
+		ExpiresAt: lease.ExpiresAt.String(),
+	}
+	if err := engine.write(lease, credentials); err != nil {
+		return nil, err
+	}
+	lease.Data = map[string]string{"username": credentials.Username}
+
+	return map[string]interface{}{"username": credentials.Username, "password": credentials.Password}, nil
+}
+
+func (engine *fileEngine) Renew(role EngineRole, lease *Lease) error {
+	bytes, err := ioutil.ReadFile(engine.path(lease))
+	if err != nil {
+		return err
+	}
+
+	credentials := fileEngineCredentials{}
+	if err := json.Unmarshal(bytes, &credentials); err != nil {
+		return err
+	}
+	credentials.ExpiresAt = lease.ExpiresAt.String()
+
+	return engine.write(lease, credentials)
+}
+
+func (engine *fileEngine) Revoke(role EngineRole, lease *Lease) error {
+	if err := os.Remove(engine.path(lease)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package creds
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// Creates PostgreSQL logins in a target database, over a connection of its own that never uses creds' role.
+// Statements can use `{{name}}`, `{{password}}` and `{{expiration}}`, which are replaced with the login's name,
+// password and expiry.
+type postgresEngine struct {
+	database *pg.DB
+}
+
+type postgresEngineConfig struct {
+	CreationStatements   []string `json:"creationStatements"`
+	RenewStatements      []string `json:"renewStatements"`
+	RevocationStatements []string `json:"revocationStatements"`
+}
+
+var defaultPostgresRenewStatements = []string{
+	`ALTER ROLE "{{name}}" VALID UNTIL '{{expiration}}'`,
+}
+
+var defaultPostgresRevocationStatements = []string{
+	`DROP OWNED BY "{{name}}"`,
+	`DROP ROLE IF EXISTS "{{name}}"`,
+}
+
+func newPostgresEngine(database *pg.DB) *postgresEngine {
+	return &postgresEngine{database: database}
+}
+
+func (engine *postgresEngine) ConfigSchema() []EngineConfigField {
+	return []EngineConfigField{
+		{
+			Name:        "creationStatements",
+			Type:        StringListField,
+			Required:    true,
+			Description: `Statements creating the login, like CREATE ROLE "{{name}}" LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}'`,
+		},
+		{
+			Name:        "renewStatements",
+			Type:        StringListField,
+			Required:    false,
+			Description: "Statements extending the login; by default its VALID UNTIL is moved",
+		},
+		{
+			Name:        "revocationStatements",
+			Type:        StringListField,
+			Required:    false,
+			Description: "Statements removing the login; by default everything it owns is dropped along with it",
+		},
+	}
+}
+
+func renderPostgresStatement(statement string, name string, password string, expiration time.Time) string {
+	return strings.NewReplacer(
+		"{{name}}", name,
+		"{{password}}", password,
+		"{{expiration}}", expiration.UTC().Format("2006-01-02 15:04:05-07"),
+	).Replace(statement)
+}
+
+// Names and passwords only contain characters that are safe to put in quoted identifiers and literals, since the
+// statements they're substituted into are run as they are.
+func generatePostgresLogin(role string) (string, string, error) {
+	nameBytes := make([]byte, 6)
+	if _, err := rand.Read(nameBytes); err != nil {
+		return "", "", err
+	}
+
+	passwordBytes := make([]byte, 24)
+	if _, err := rand.Read(passwordBytes); err != nil {
+		return "", "", err
+	}
+
+	name := fmt.Sprintf("v_%s_%s", role, hex.EncodeToString(nameBytes))
+	if len(name) > 63 {
+		name = name[:63]
+	}
+
+	return name, hex.EncodeToString(passwordBytes), nil
+}
+
+func (engine *postgresEngine) run(statements []string, name string, password string, expiration time.Time) error {
+	return engine.database.RunInTransaction(engine.database.Context(), func(transaction *pg.Tx) error {
+		for _, statement := range statements {
+			if _, err := transaction.Exec(renderPostgresStatement(statement, name, password, expiration)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (engine *postgresEngine) Issue(role EngineRole, lease *Lease) (map[string]interface{}, error) {
+	config := postgresEngineConfig{}
+	if err := decodeEngineConfig(role.Config, &config); err != nil {
+		return nil, err
+	}
+
+	name, password, err := generatePostgresLogin(role.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := engine.run(config.CreationStatements, name, password, lease.ExpiresAt); err != nil {
+		return nil, err
+	}
+	lease.Data = map[string]string{"username": name}
+
+	return map[string]interface{}{"username": name, "password": password}, nil
+}
+
+func (engine *postgresEngine) Renew(role EngineRole, lease *Lease) error {
+	config := postgresEngineConfig{}
+	if err := decodeEngineConfig(role.Config, &config); err != nil {
+		return err
+	}
+
+	statements := config.RenewStatements
+	if len(statements) == 0 {
+		statements = defaultPostgresRenewStatements
+	}
+
+	return engine.run(statements, lease.Data["username"], "", lease.ExpiresAt)
+}
+
+func (engine *postgresEngine) Revoke(role EngineRole, lease *Lease) error {
+	config := postgresEngineConfig{}
+	if err := decodeEngineConfig(role.Config, &config); err != nil {
+		return err
+	}
+
+	statements := config.RevocationStatements
+	if len(statements) == 0 {
+		statements = defaultPostgresRevocationStatements
+	}
+
+	return engine.run(statements, lease.Data["username"], "", lease.ExpiresAt)
+}
@@ -0,0 +1,122 @@
+package creds
+
+import (
+	"encoding/hex"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+func TestRenderPostgresStatement(t *testing.T) {
+	expiration := time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	rendered := renderPostgresStatement(
+		`CREATE ROLE "{{name}}" LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}'`,
+		"v_app_0a1b2c", "secret", expiration,
+	)
+
+	expected := `CREATE ROLE "v_app_0a1b2c" LOGIN PASSWORD 'secret' VALID UNTIL '2030-01-02 02:04:05+00'`
+	if rendered != expected {
+		log.Panicf("Statement was rendered as %s", rendered)
+	}
+}
+
+func TestGeneratePostgresLogin(t *testing.T) {
+	name, password, err := generatePostgresLogin("app")
+	if err != nil {
+		log.Panicf("Unable to generate login: %s", err.Error())
+	}
+	if !strings.HasPrefix(name, "v_app_") || len(name) != len("v_app_")+12 {
+		log.Panicf("Unexpected login name: %s", name)
+	}
+	if _, err := hex.DecodeString(password); err != nil || len(password) != 48 {
+		log.Panicf("Unexpected password: %s", password)
+	}
+
+	otherName, otherPassword, _ := generatePostgresLogin("app")
+	if otherName == name || otherPassword == password {
+		log.Panicf("Logins aren't random")
+	}
+
+	// Identifiers longer than 63 bytes would be truncated by PostgreSQL itself, breaking revocation
+	longName, _, err := generatePostgresLogin(strings.Repeat("r", 64))
+	if err != nil || len(longName) != 63 {
+		log.Panicf("Long login name wasn't truncated: %s", longName)
+	}
+}
+
+func TestDefaultEngineRegistryDatabaseMount(t *testing.T) {
+	database := pg.Connect(&pg.Options{Addr: "creds.test:5432", User: "creds"})
+	defer database.Close()
+
+	settings := DefaultSettings()
+	if _, err := newDefaultEngineRegistry(database, settings).get("database"); err == nil {
+		log.Panicf("Database engine was mounted without a connection for it")
+	}
+
+	settings.PostgresEngineDatabase = DatabaseOptions{Host: "creds.test", Port: 5432, User: "engine"}
+	registry := newDefaultEngineRegistry(database, settings)
+	if _, err := registry.get("database"); err != nil {
+		log.Panicf("Database engine wasn't mounted: %s", err.Error())
+	}
+	_ = registry.mounts["database"].(*postgresEngine).database.Close()
+
+	settings.PostgresEngineDatabase.User = "creds"
+	defer func() {
+		if recover() == nil {
+			log.Panicf("Database engine was mounted with creds' own role")
+		}
+	}()
+	newDefaultEngineRegistry(database, settings)
+}
+
+func TestPostgresEngineLifecycle(t *testing.T) {
+	d := initializeTestData(nil)
+
+	engineDatabase := pg.Connect(d.database.Options())
+	defer engineDatabase.Close()
+
+	engine := newPostgresEngine(engineDatabase)
+	role := EngineRole{Mount: "database", Name: "test", Config: map[string]interface{}{
+		"creationStatements": []interface{}{
+			`CREATE ROLE "{{name}}" LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}'`,
+		},
+	}}
+	lease := Lease{Id: uuid.New(), ExpiresAt: time.Now().Add(time.Hour)}
+
+	credentials, err := engine.Issue(role, &lease)
+	if err != nil {
+		log.Panicf("Unable to issue credentials: %s", err.Error())
+	}
+	if credentials["username"] != lease.Data["username"] || credentials["password"] == "" {
+		log.Panicf("Unexpected credentials: %v", credentials)
+	}
+
+	var validUntil time.Time
+	if _, err := d.database.QueryOne(
+		pg.Scan(&validUntil), "SELECT rolvaliduntil FROM pg_roles WHERE rolname = ?", lease.Data["username"],
+	); err != nil {
+		log.Panicf("Login wasn't created: %s", err.Error())
+	}
+
+	lease.ExpiresAt = lease.ExpiresAt.Add(time.Hour)
+	if err := engine.Renew(role, &lease); err != nil {
+		log.Panicf("Unable to renew credentials: %s", err.Error())
+	}
+	if _, err := d.database.QueryOne(
+		pg.Scan(&validUntil), "SELECT rolvaliduntil FROM pg_roles WHERE rolname = ?", lease.Data["username"],
+	); err != nil || validUntil.Unix() != lease.ExpiresAt.Unix() {
+		log.Panicf("Login wasn't renewed until %s: %v", lease.ExpiresAt, validUntil)
+	}
+
+	if err := engine.Revoke(role, &lease); err != nil {
+		log.Panicf("Unable to revoke credentials: %s", err.Error())
+	}
+	count, err := d.database.Query(pg.Discard, "SELECT 1 FROM pg_roles WHERE rolname = ?", lease.Data["username"])
+	if err != nil || count.RowsReturned() != 0 {
+		log.Panicf("Login still exists after revocation: %v", err)
+	}
+}
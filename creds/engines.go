@@ -0,0 +1,182 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// A backend that hands out short-lived credentials. Engines are mounted at a path in an `engineRegistry`; roles
+// configure what an engine issues, and every set of credentials issued is tracked as a `Lease` by the
+// `leaseManager`, which renews and revokes them through the engine.
+type SecretEngine interface {
+	// Describes the configuration roles of this engine take
+	ConfigSchema() []EngineConfigField
+	// Creates credentials for a new lease. Anything needed to renew or revoke them later has to be put in `lease.Data`.
+	Issue(role EngineRole, lease *Lease) (map[string]interface{}, error)
+	// Extends credentials to `lease.ExpiresAt`
+	Renew(role EngineRole, lease *Lease) error
+	Revoke(role EngineRole, lease *Lease) error
+}
+
+type EngineConfigFieldType string
+
+const (
+	StringField     EngineConfigFieldType = "string"
+	StringListField EngineConfigFieldType = "string-list"
+)
+
+type EngineConfigField struct {
+	Name        string                `json:"name"`
+	Type        EngineConfigFieldType `json:"type"`
+	Required    bool                  `json:"required"`
+	Description string                `json:"description"`
+}
+
+// A named configuration of the engine mounted at `Mount`
+type EngineRole struct {
+	Mount             string                 `json:"mount" pg:",pk"`
+	Name              string                 `json:"name" pg:",pk"`
+	Config            map[string]interface{} `json:"config" pg:",notnull"`
+	DefaultTtlSeconds int                    `json:"defaultTtlSeconds" pg:",notnull"`
+	MaxTtlSeconds     int                    `json:"maxTtlSeconds" pg:",notnull,use_zero"`
+	CreatedAt         time.Time              `json:"createdAt" pg:",notnull"`
+}
+
+var engineNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+type NoSuchMountError struct {
+	Mount string
+}
+
+func (noSuchMountError NoSuchMountError) Error() string {
+	return fmt.Sprintf("No secret engine is mounted at '%s'", noSuchMountError.Mount)
+}
+
+type NoSuchEngineRoleError struct {
+	Mount string
+	Name  string
+}
+
+func (noSuchEngineRoleError NoSuchEngineRoleError) Error() string {
+	return fmt.Sprintf("Role '%s' does not exist for '%s'", noSuchEngineRoleError.Name, noSuchEngineRoleError.Mount)
+}
+
+type InvalidEngineConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (invalidEngineConfigError InvalidEngineConfigError) Error() string {
+	return fmt.Sprintf("'%s' %s", invalidEngineConfigError.Field, invalidEngineConfigError.Reason)
+}
+
+type engineRegistry struct {
+	mounts map[string]SecretEngine
+}
+
+func newEngineRegistry() *engineRegistry {
+	return &engineRegistry{mounts: make(map[string]SecretEngine)}
+}
+
+// The engines every instance has; which ones are mounted only depends on the settings, so every instance ends up
+// with the same mounts.
+func newDefaultEngineRegistry(database *pg.DB, settings Settings) *engineRegistry {
+	registry := newEngineRegistry()
+	if engineDatabase := settings.PostgresEngineDatabase; engineDatabase.Host != "" {
+		// Role templates are run as they are, so as creds' own role they could change or drop creds' tables
+		options := database.Options()
+		if engineDatabase.User == options.User && fmt.Sprintf("%s:%d", engineDatabase.Host, engineDatabase.Port) == options.Addr {
+			log.Panicf("The database secret engine has to connect as a different role than creds itself")
+		}
+		registry.mount("database", newPostgresEngine(ConnectToDatabase(engineDatabase)))
+	}
+	if settings.FileEngineDirectory != "" {
+		registry.mount("file", newFileEngine(settings.FileEngineDirectory))
+	}
+
+	return registry
+}
+
+func (registry *engineRegistry) mount(path string, engine SecretEngine) {
+	if !engineNamePattern.MatchString(path) {
+		log.Panicf("Invalid mount path '%s'", path)
+	}
+
+	registry.mounts[path] = engine
+}
+
+func (registry *engineRegistry) get(path string) (SecretEngine, error) {
+	engine, ok := registry.mounts[path]
+	if !ok {
+		return nil, NoSuchMountError{Mount: path}
+	}
+
+	return engine, nil
+}
+
+func (registry *engineRegistry) paths() []string {
+	paths := make([]string, 0, len(registry.mounts))
+	for path := range registry.mounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func validateEngineConfig(schema []EngineConfigField, config map[string]interface{}) error {
+	known := make(map[string]bool)
+	for _, field := range schema {
+		known[field.Name] = true
+
+		value, ok := config[field.Name]
+		if !ok {
+			if field.Required {
+				return InvalidEngineConfigError{Field: field.Name, Reason: "is required"}
+			}
+
+			continue
+		}
+
+		switch field.Type {
+		case StringField:
+			if _, ok := value.(string); !ok {
+				return InvalidEngineConfigError{Field: field.Name, Reason: "has to be a string"}
+			}
+		case StringListField:
+			values, ok := value.([]interface{})
+			if !ok {
+				return InvalidEngineConfigError{Field: field.Name, Reason: "has to be a list of strings"}
+			}
+			for _, value := range values {
+				if _, ok := value.(string); !ok {
+					return InvalidEngineConfigError{Field: field.Name, Reason: "has to be a list of strings"}
+				}
+			}
+		}
+	}
+
+	for name := range config {
+		if !known[name] {
+			return InvalidEngineConfigError{Field: name, Reason: "is not a known setting"}
+		}
+	}
+
+	return nil
+}
+
+// Decodes a role's configuration into an engine's own configuration type
+func decodeEngineConfig(config map[string]interface{}, into interface{}) error {
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bytes, into)
+}
@@ -0,0 +1,179 @@
+package creds
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestValidateEngineConfig(t *testing.T) {
+	schema := []EngineConfigField{
+		{Name: "statements", Type: StringListField, Required: true},
+		{Name: "prefix", Type: StringField},
+	}
+
+	valid := map[string]interface{}{"statements": []interface{}{"CREATE ROLE"}, "prefix": "app-"}
+	if err := validateEngineConfig(schema, valid); err != nil {
+		log.Panicf("Valid configuration was rejected: %s", err.Error())
+	}
+
+	invalid := []map[string]interface{}{
+		{},
+		{"statements": "CREATE ROLE"},
+		{"statements": []interface{}{1}},
+		{"statements": []interface{}{}, "prefix": 5},
+		{"statements": []interface{}{}, "unknown": "value"},
+	}
+	for _, config := range invalid {
+		if err := validateEngineConfig(schema, config); err == nil {
+			log.Panicf("Invalid configuration was accepted: %v", config)
+		}
+	}
+}
+
+func TestLeaseTtl(t *testing.T) {
+	cases := []struct {
+		requested int
+		expected  time.Duration
+	}{
+		{0, time.Hour},
+		{-1, time.Hour},
+		{60, time.Minute},
+		{7200, 2 * time.Hour},
+		{86400, 2 * time.Hour},
+	}
+	for _, c := range cases {
+		if ttl := leaseTtl(c.requested, 3600, 7200); ttl != c.expected {
+			log.Panicf("Unexpected TTL for %d seconds: %s", c.requested, ttl)
+		}
+	}
+
+	if ttl := leaseTtl(86400, 3600, 0); ttl != 24*time.Hour {
+		log.Panicf("TTL limited without a maximum: %s", ttl)
+	}
+}
+
+func TestFileEngineLifecycle(t *testing.T) {
+	directory, err := ioutil.TempDir("", "creds-file-engine")
+	if err != nil {
+		log.Panicf("Unable to create directory: %s", err.Error())
+	}
+	defer os.RemoveAll(directory)
+
+	engine := newFileEngine(directory)
+	role := EngineRole{Mount: "file", Name: "test", Config: map[string]interface{}{"prefix": "app-"}}
+	lease := Lease{Id: uuid.New(), ExpiresAt: time.Now().Add(time.Hour)}
+
+	credentials, err := engine.Issue(role, &lease)
+	if err != nil {
+		log.Panicf("Unable to issue credentials: %s", err.Error())
+	}
+	if credentials["username"] != "app-"+lease.Id.String() || lease.Data["username"] != credentials["username"] {
+		log.Panicf("Unexpected username: %v", credentials["username"])
+	}
+
+	lease.ExpiresAt = lease.ExpiresAt.Add(time.Hour)
+	if err := engine.Renew(role, &lease); err != nil {
+		log.Panicf("Unable to renew credentials: %s", err.Error())
+	}
+
+	if err := engine.Revoke(role, &lease); err != nil {
+		log.Panicf("Unable to revoke credentials: %s", err.Error())
+	}
+	if _, err := os.Stat(engine.path(&lease)); !os.IsNotExist(err) {
+		log.Panicf("Credentials file still exists after revocation")
+	}
+	if err := engine.Revoke(role, &lease); err != nil {
+		log.Panicf("Revoking twice failed: %s", err.Error())
+	}
+}
+
+func TestIssueCredentialsPerMount(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	directory, err := ioutil.TempDir("", "creds-file-engine")
+	if err != nil {
+		log.Panicf("Unable to create directory: %s", err.Error())
+	}
+	defer os.RemoveAll(directory)
+	setup.settings.FileEngineDirectory = directory
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	role := EngineRole{Mount: "file", Name: "test", Config: map[string]interface{}{}, CreatedAt: time.Now()}
+	if _, err := setup.database.Model(&role).Insert(); err != nil {
+		log.Panicf("Unable to add role: %s", err.Error())
+	}
+	userId, err := insertUser(setup.database, "Engine User", "engine-user")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	tokenId, err := insertToken(setup.database, userId, "file:test", time.Now(), time.Now().Add(time.Hour), tokenBinding{})
+	if err != nil {
+		log.Panicf("Unable to add token: %s", err.Error())
+	}
+
+	// A token for one mount can't issue from another, however the requests before it were routed
+	for _, mount := range []struct {
+		path     string
+		expected int
+	}{{"file", http.StatusOK}, {"database", http.StatusUnauthorized}, {"file", http.StatusOK}} {
+		url := fmt.Sprintf("/engines/%s/creds/test", mount.path)
+		expectStatus("POST", url, "", []headerEntry{bearerToken(tokenId)}, router, mount.expected)
+	}
+}
+
+func TestLeaseRequestsDontRevealLeases(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	directory, err := ioutil.TempDir("", "creds-file-engine")
+	if err != nil {
+		log.Panicf("Unable to create directory: %s", err.Error())
+	}
+	defer os.RemoveAll(directory)
+	setup.settings.FileEngineDirectory = directory
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	role := EngineRole{Mount: "file", Name: "test", Config: map[string]interface{}{}, CreatedAt: time.Now()}
+	if _, err := setup.database.Model(&role).Insert(); err != nil {
+		log.Panicf("Unable to add role: %s", err.Error())
+	}
+	var tokens []uuid.UUID
+	for _, username := range []string{"lease-holder", "lease-prober"} {
+		userId, err := insertUser(setup.database, username, username)
+		if err != nil {
+			log.Panicf("Unable to add user: %s", err.Error())
+		}
+		tokenId, err := insertToken(setup.database, userId, "file:test", time.Now(), time.Now().Add(time.Hour), tokenBinding{})
+		if err != nil {
+			log.Panicf("Unable to add token: %s", err.Error())
+		}
+		tokens = append(tokens, tokenId)
+	}
+
+	holder := []headerEntry{bearerToken(tokens[0])}
+	expectStatus("POST", "/engines/file/creds/test", "", holder, router, http.StatusOK)
+	lease := Lease{}
+	if err := setup.database.Model(&lease).Limit(1).Select(); err != nil {
+		log.Panicf("Unable to get lease: %s", err.Error())
+	}
+
+	// Whether a lease exists is only told to admins
+	existing, unknown := fmt.Sprintf("/leases/%s/renew", lease.Id), fmt.Sprintf("/leases/%s/renew", uuid.New())
+	for _, headers := range [][]headerEntry{{}, {bearerToken(tokens[1])}} {
+		expectStatus("POST", existing, "", headers, router, http.StatusUnauthorized)
+		expectStatus("POST", unknown, "", headers, router, http.StatusUnauthorized)
+	}
+	expectStatus("POST", unknown, "", []headerEntry{bearerToken(setup.adminToken)}, router, http.StatusNotFound)
+	expectStatus("POST", existing, "", holder, router, http.StatusOK)
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func GetRequiredEnvironmentIntegerEnvironmentVariable(key string) int {
@@ -24,3 +26,53 @@ func GetRequiredEnvironmentVariable(key string) string {
 
 	return value
 }
+
+func GetOptionalEnvironmentVariable(key string, defaultValue string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	return value
+}
+
+func GetOptionalIntegerEnvironmentVariable(key string, defaultValue int) int {
+	if _, ok := os.LookupEnv(key); !ok {
+		return defaultValue
+	}
+
+	return GetRequiredEnvironmentIntegerEnvironmentVariable(key)
+}
+
+func GetOptionalDurationEnvironmentVariable(key string, defaultValue time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Panicf("Environment variable '%s' is not parsable as duration: %s", key, err.Error())
+	}
+
+	return duration
+}
+
+// Space separated durations, like `720h 168h 24h`
+func GetOptionalDurationListEnvironmentVariable(key string, defaultValue []time.Duration) []time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	durations := make([]time.Duration, 0)
+	for _, field := range strings.Fields(value) {
+		duration, err := time.ParseDuration(field)
+		if err != nil {
+			log.Panicf("Environment variable '%s' is not parsable as durations: %s", key, err.Error())
+		}
+		durations = append(durations, duration)
+	}
+
+	return durations
+}
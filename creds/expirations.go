@@ -0,0 +1,261 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+)
+
+// Records that a token's expiry has been announced for a window, so each window fires once per token
+type TokenExpiryNotice struct {
+	Token         string    `pg:",pk"`
+	WindowSeconds int64     `pg:",pk"`
+	NotifiedAt    time.Time `pg:",notnull"`
+}
+
+type tokenExpiringEventData struct {
+	Token      string    `json:"token"`
+	UserId     uuid.UUID `json:"userId"`
+	End        time.Time `json:"end"`
+	WindowDays int       `json:"windowDays"`
+}
+
+func (data tokenExpiringEventData) aggregate() (string, string) {
+	return "token", data.Token
+}
+
+// Something that tells people about expiring tokens. Notifiers are called inside the transaction recording the
+// notice, so a failing notifier makes the notice go out again on the next run.
+type expiryNotifier interface {
+	notify(transaction orm.DB, notice tokenExpiringEventData) error
+}
+
+// Announces expiring tokens as `token.expiring` events, which reach webhooks and the outbox sinks
+type eventNotifier struct{}
+
+func (notifier eventNotifier) notify(transaction orm.DB, notice tokenExpiringEventData) error {
+	return recordEvent(transaction, TokenExpiringEvent, notice)
+}
+
+type logNotifier struct{}
+
+func (notifier logNotifier) notify(transaction orm.DB, notice tokenExpiringEventData) error {
+	fmt.Printf("Token '%s' of user '%s' expires at %s\n", notice.Token, notice.UserId, notice.End.Format(time.RFC3339))
+
+	return nil
+}
+
+type smtpNotifier struct {
+	address string
+	auth    smtp.Auth
+	from    string
+	to      []string
+}
+
+func (notifier smtpNotifier) notify(transaction orm.DB, notice tokenExpiringEventData) error {
+	message := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: creds token expires in %d days\r\n\r\n"+
+			"Token '%s' of user '%s' expires at %s.\r\n",
+		notifier.from,
+		strings.Join(notifier.to, ", "),
+		notice.WindowDays,
+		notice.Token,
+		notice.UserId,
+		notice.End.Format(time.RFC3339),
+	)
+
+	return smtp.SendMail(notifier.address, notifier.auth, notifier.from, notifier.to, []byte(message))
+}
+
+// Notifiers are given as `event`, `log` or `smtp://[user:password@]host:port?from=<address>&to=<address>,<address>`
+func parseExpiryNotifiers(specifications []string) ([]expiryNotifier, error) {
+	notifiers := make([]expiryNotifier, 0, len(specifications))
+	for _, specification := range specifications {
+		switch {
+		case specification == "event":
+			notifiers = append(notifiers, eventNotifier{})
+		case specification == "log":
+			notifiers = append(notifiers, logNotifier{})
+		case strings.HasPrefix(specification, "smtp://"):
+			smtpUrl, err := url.Parse(specification)
+			if err != nil || smtpUrl.Port() == "" || smtpUrl.Query().Get("from") == "" || smtpUrl.Query().Get("to") == "" {
+				return nil, fmt.Errorf("SMTP notifiers need a host, port, 'from' and 'to', got '%s'", specification)
+			}
+
+			notifier := smtpNotifier{
+				address: smtpUrl.Host,
+				from:    smtpUrl.Query().Get("from"),
+				to:      strings.Split(smtpUrl.Query().Get("to"), ","),
+			}
+			if smtpUrl.User != nil {
+				password, _ := smtpUrl.User.Password()
+				notifier.auth = smtp.PlainAuth("", smtpUrl.User.Username(), password, smtpUrl.Hostname())
+			}
+			notifiers = append(notifiers, notifier)
+		default:
+			return nil, fmt.Errorf("unknown expiry notifier '%s'", specification)
+		}
+	}
+
+	return notifiers, nil
+}
+
+// The smallest window a token expiring in `remaining` falls into, or 0 if it's outside all of them. Tokens that
+// are first seen inside a small window only get that window's notice rather than every larger one at once.
+func expiryWindow(windows []time.Duration, remaining time.Duration) time.Duration {
+	sorted := append([]time.Duration{}, windows...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for _, window := range sorted {
+		if remaining <= window {
+			return window
+		}
+	}
+
+	return 0
+}
+
+func maximumWindow(windows []time.Duration) time.Duration {
+	maximum := time.Duration(0)
+	for _, window := range windows {
+		if window > maximum {
+			maximum = window
+		}
+	}
+
+	return maximum
+}
+
+type expiryScheduler struct {
+	database  *pg.DB
+	windows   []time.Duration
+	notifiers []expiryNotifier
+}
+
+func newExpiryScheduler(database *pg.DB, windows []time.Duration, notifiers []expiryNotifier) *expiryScheduler {
+	return &expiryScheduler{database: database, windows: windows, notifiers: notifiers}
+}
+
+func (scheduler *expiryScheduler) notifyExpiringTokens() {
+	now := time.Now()
+	tokens := make([]Token, 0)
+	if err := scheduler.database.Model(&tokens).
+		Where(`"end" > ? AND "end" <= ?`, now, now.Add(maximumWindow(scheduler.windows))).
+		Select(); err != nil {
+		fmt.Printf("Unable to get expiring tokens: %s\n", err.Error())
+
+		return
+	}
+
+	for _, token := range tokens {
+		window := expiryWindow(scheduler.windows, token.End.Sub(now))
+		if window == 0 {
+			continue
+		}
+
+		if err := scheduler.notify(token, window); err != nil {
+			fmt.Printf("Unable to notify about expiring token '%s': %s\n", tokenFingerprint(token.Id), err.Error())
+		}
+	}
+
+	// Notices are only needed while their token can still be in a window
+	if _, err := scheduler.database.Model((*TokenExpiryNotice)(nil)).
+		Where("notified_at < ?", now.Add(-maximumWindow(scheduler.windows)-24*time.Hour)).
+		Delete(); err != nil {
+		fmt.Printf("Unable to clean up token expiry notices: %s\n", err.Error())
+	}
+}
+
+func (scheduler *expiryScheduler) notify(token Token, window time.Duration) error {
+	return scheduler.database.RunInTransaction(scheduler.database.Context(), func(transaction *pg.Tx) error {
+		notice := TokenExpiryNotice{
+			Token:         tokenFingerprint(token.Id),
+			WindowSeconds: int64(window / time.Second),
+			NotifiedAt:    time.Now(),
+		}
+		result, err := transaction.Model(&notice).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return nil
+		}
+
+		data := tokenExpiringEventData{
+			Token:      notice.Token,
+			UserId:     token.UserId,
+			End:        token.End,
+			WindowDays: int(window / (24 * time.Hour)),
+		}
+		for _, notifier := range scheduler.notifiers {
+			if err := notifier.notify(transaction, data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+type tokenExpirationResponse struct {
+	Token  string    `json:"token"`
+	UserId uuid.UUID `json:"userId"`
+	End    time.Time `json:"end"`
+}
+
+// Tokens expiring within `within`, which defaults to the largest notification window, soonest first
+func handleGetTokenExpirations(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		within := maximumWindow(settings.TokenExpiryWindows)
+		if withinString := request.URL.Query().Get("within"); withinString != "" {
+			var err error
+			within, err = time.ParseDuration(withinString)
+			if err != nil || within <= 0 {
+				http.Error(writer, "'within' has to be a positive duration, like '168h'", http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		now := time.Now()
+		tokens := make([]Token, 0)
+		if err := database.Model(&tokens).
+			Where(`"end" > ? AND "end" <= ?`, now, now.Add(within)).
+			OrderExpr(`"end"`).
+			Select(); err != nil {
+			response := fmt.Sprintf("Error getting expiring tokens")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		expirations := make([]tokenExpirationResponse, 0, len(tokens))
+		for _, token := range tokens {
+			expirations = append(expirations, tokenExpirationResponse{
+				Token:  tokenFingerprint(token.Id),
+				UserId: token.UserId,
+				End:    token.End,
+			})
+		}
+
+		_ = json.NewEncoder(writer).Encode(expirations)
+	}
+}
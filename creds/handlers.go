@@ -1,9 +1,9 @@
 package creds
 
 import (
+	"crypto/hmac"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
@@ -18,6 +18,9 @@ type addTokenParameters struct {
 	Scope  null.String
 	Start  time.Time
 	End    time.Time
+	// Binds the token to the client certificate the request is made with
+	BindCertificate       bool
+	CertificateThumbprint null.String
 }
 
 type addTokenParametersError struct {
@@ -41,10 +44,12 @@ func (parametersError addTokenParametersError) Error() string {
 
 func (parameters *addTokenParameters) UnmarshalJSON(bytes []byte) error {
 	var toUnmarshal struct {
-		UserId uuid.UUID
-		Scope  null.String
-		Start  time.Time
-		End    time.Time
+		UserId                uuid.UUID
+		Scope                 null.String
+		Start                 time.Time
+		End                   time.Time
+		BindCertificate       bool
+		CertificateThumbprint null.String
 	}
 	if err := json.Unmarshal(bytes, &toUnmarshal); err != nil {
 		return err
@@ -54,6 +59,8 @@ func (parameters *addTokenParameters) UnmarshalJSON(bytes []byte) error {
 	parameters.Scope = toUnmarshal.Scope
 	parameters.Start = toUnmarshal.Start
 	parameters.End = toUnmarshal.End
+	parameters.BindCertificate = toUnmarshal.BindCertificate
+	parameters.CertificateThumbprint = toUnmarshal.CertificateThumbprint
 
 	if parameters.UserId.ID() == 0 || !parameters.Scope.Valid {
 		return addTokenParametersError{
@@ -65,12 +72,12 @@ func (parameters *addTokenParameters) UnmarshalJSON(bytes []byte) error {
 	return nil
 }
 
-func handleAddToken(database *pg.DB, adminScope string) http.HandlerFunc {
+func handleAddToken(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		adminToken := getAdminTokenId(request)
-		hasAdminScope := tokenHasScope(database, adminToken, adminScope)
-		if !hasAdminScope {
-			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+		// A DPoP proof can only be verified once, so the one the admin token was sent with is kept to bind the new token
+		adminToken, proof, err := authenticateRequestWithProof(database, request)
+		if err != nil || !adminToken.hasScope(adminScope) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
 			http.Error(writer, response, http.StatusUnauthorized)
 
 			return
@@ -84,39 +91,141 @@ func handleAddToken(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
-		tokenId, err := insertToken(database,
-			parameters.UserId,
-			parameters.Scope.String,
-			parameters.Start,
-			parameters.End,
-		)
+		addToken(writer, request, database, settings, parameters, proof)
+	}
+}
+
+// The same as `addTokenParameters`, for when the user is given by the path
+type addUserTokenParameters struct {
+	Scope                 null.String
+	Start                 time.Time
+	End                   time.Time
+	BindCertificate       bool
+	CertificateThumbprint null.String
+}
+
+func handleAddUserToken(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		// A DPoP proof can only be verified once, so the one the admin token was sent with is kept to bind the new token
+		adminToken, proof, err := authenticateRequestWithProof(database, request)
+		if err != nil || !adminToken.hasScope(adminScope) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
 		if err != nil {
-			if _, ok := err.(NoSuchUserError); ok {
-				response := fmt.Sprintf("Unable to create token: %s", err.Error())
-				http.Error(writer, response, http.StatusNotFound)
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
 
-				return
-			}
-			response := fmt.Sprintf("Unable to create token: %s", err.Error())
+			return
+		}
+
+		var parameters addUserTokenParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for adding token: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if !parameters.Scope.Valid {
+			http.Error(writer, "Error decoding parameters for adding token: 'scope' missing", http.StatusBadRequest)
+
+			return
+		}
+
+		addToken(writer, request, database, settings, addTokenParameters{
+			UserId:                id,
+			Scope:                 parameters.Scope,
+			Start:                 parameters.Start,
+			End:                   parameters.End,
+			BindCertificate:       parameters.BindCertificate,
+			CertificateThumbprint: parameters.CertificateThumbprint,
+		}, proof)
+	}
+}
+
+// Issues a token as asked for by an admin, binding it to whatever the request proves possession of. `proof` is the
+// DPoP proof already verified while authenticating the request, if any.
+func addToken(
+	writer http.ResponseWriter,
+	request *http.Request,
+	database *pg.DB,
+	settings Settings,
+	parameters addTokenParameters,
+	proof *dpopProof,
+) {
+	binding := tokenBinding{certificateThumbprint: parameters.CertificateThumbprint.String}
+	if proof == nil && len(request.Header.Values("DPoP")) != 0 {
+		var err error
+		proof, err = verifyRequestDpopProof(database, request, "")
+		if err != nil {
+			response := fmt.Sprintf("Unable to bind token to DPoP key: %s", err.Error())
 			http.Error(writer, response, http.StatusBadRequest)
 
 			return
 		}
+	}
+	if proof != nil {
+		binding.jwkThumbprint = proof.thumbprint
+	}
+	if parameters.BindCertificate {
+		binding.certificateThumbprint = requestCertificateThumbprint(request)
+		if binding.certificateThumbprint == "" {
+			http.Error(writer, "No client certificate to bind the token to", http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	// Tokens without an end given are valid for as long as the policy allows
+	start, end := defaultTokenValidity(parameters.Start, parameters.End)
+	if parameters.End.IsZero() && settings.MaxTokenLifetime != 0 && end.Sub(start) > settings.MaxTokenLifetime {
+		end = start.Add(settings.MaxTokenLifetime)
+	}
+	if err := checkTokenLifetime(settings, start, end); err != nil {
+		response := fmt.Sprintf("Unable to create token: %s", err.Error())
+		http.Error(writer, response, http.StatusBadRequest)
+
+		return
+	}
 
-		if err := json.NewEncoder(writer).Encode(tokenId); err != nil {
-			fmt.Printf("Couldn't write token '%s' for request", tokenId)
+	setAuditTarget(request, auditUserTarget(parameters.UserId))
+	tokenId, err := createToken(database, parameters.UserId, parameters.Scope.String, start, end, binding)
+	if err != nil {
+		if _, ok := err.(NoSuchUserError); ok {
+			response := fmt.Sprintf("Unable to create token: %s", err.Error())
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
 		}
+		response := fmt.Sprintf("Unable to create token: %s", err.Error())
+		http.Error(writer, response, http.StatusBadRequest)
+
+		return
+	}
+
+	if err := json.NewEncoder(writer).Encode(tokenId); err != nil {
+		fmt.Printf("Couldn't write token '%s' for request", tokenId)
 	}
 }
 
 type addUserParameters struct {
-	Username null.String
-	Name     null.String
+	Username      null.String
+	Name          null.String
+	Kind          UserKind
+	OwnerId       *uuid.UUID
+	OwnerGroup    null.String
+	DefaultScopes []string
 }
 
 type addUserParametersError struct {
 	Username bool
 	Name     bool
+	Kind     bool
+	Owner    bool
 }
 
 func (parametersError addUserParametersError) Error() string {
@@ -130,14 +239,26 @@ func (parametersError addUserParametersError) Error() string {
 		errors = append(errors, "'name' missing")
 	}
 
+	if parametersError.Kind {
+		errors = append(errors, "'kind' invalid")
+	}
+
+	if parametersError.Owner {
+		errors = append(errors, "'ownerId' or 'ownerGroup' required for service accounts")
+	}
+
 	return strings.Join(errors, ", ")
 }
 
 func (parameters *addUserParameters) UnmarshalJSON(bytes []byte) error {
 	var toUnmarshal struct {
-		Username   null.String
-		Name       null.String
-		AdminToken uuid.UUID
+		Username      null.String
+		Name          null.String
+		Kind          UserKind
+		OwnerId       *uuid.UUID
+		OwnerGroup    null.String
+		DefaultScopes []string
+		AdminToken    uuid.UUID
 	}
 	if err := json.Unmarshal(bytes, &toUnmarshal); err != nil {
 		return err
@@ -145,11 +266,29 @@ func (parameters *addUserParameters) UnmarshalJSON(bytes []byte) error {
 
 	parameters.Username = toUnmarshal.Username
 	parameters.Name = toUnmarshal.Name
+	parameters.Kind = toUnmarshal.Kind
+	parameters.OwnerId = toUnmarshal.OwnerId
+	parameters.OwnerGroup = toUnmarshal.OwnerGroup
+	parameters.DefaultScopes = toUnmarshal.DefaultScopes
+
+	if parameters.Kind == "" {
+		parameters.Kind = HumanUser
+	}
 
-	if !parameters.Username.Valid || !parameters.Name.Valid {
+	return parameters.validate()
+}
+
+// Checks what every new user needs, however it's added
+func (parameters *addUserParameters) validate() error {
+	missingOwner := parameters.Kind.policy().requiresOwner &&
+		parameters.OwnerId == nil &&
+		parameters.OwnerGroup.String == ""
+	if !parameters.Username.Valid || !parameters.Name.Valid || !parameters.Kind.isValid() || missingOwner {
 		return addUserParametersError{
 			Username: !parameters.Username.Valid,
 			Name:     !parameters.Name.Valid,
+			Kind:     !parameters.Kind.isValid(),
+			Owner:    missingOwner,
 		}
 	}
 
@@ -159,7 +298,7 @@ func (parameters *addUserParameters) UnmarshalJSON(bytes []byte) error {
 func handleAddUser(database *pg.DB, adminScope string) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		adminToken := getAdminTokenId(request)
-		hasAdminScope := tokenHasScope(database, adminToken, adminScope)
+		hasAdminScope := requestHasScope(database, request, adminScope)
 		if !hasAdminScope {
 			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
 			http.Error(writer, response, http.StatusUnauthorized)
@@ -175,14 +314,48 @@ func handleAddUser(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
-		userId, err := insertUser(database, parameters.Name.String, parameters.Username.String)
+		var userId uuid.UUID
+		err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+			var err error
+			if parameters.Kind == ServiceAccount {
+				userId, err = insertServiceAccount(transaction,
+					parameters.Name.String,
+					parameters.Username.String,
+					parameters.OwnerId,
+					parameters.OwnerGroup.String,
+					parameters.DefaultScopes...,
+				)
+			} else {
+				userId, err = insertUser(transaction,
+					parameters.Name.String,
+					parameters.Username.String,
+					parameters.DefaultScopes...,
+				)
+			}
+			if err != nil {
+				return err
+			}
+
+			return recordEvent(transaction, UserCreatedEvent, userEventData{
+				UserId: userId,
+				Name:   parameters.Name.String,
+				Kind:   parameters.Kind,
+			})
+		})
 		if err != nil {
+			if _, ok := err.(InvalidOwnerError); ok {
+				response := fmt.Sprintf("Error inserting user: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
 			response := fmt.Sprintf("Error inserting user: %s", err.Error())
 			http.Error(writer, response, http.StatusInternalServerError)
 
 			return
 		}
 
+		setAuditTarget(request, auditUserTarget(userId))
 		_ = json.NewEncoder(writer).Encode(userId)
 	}
 }
@@ -190,7 +363,7 @@ func handleAddUser(database *pg.DB, adminScope string) http.HandlerFunc {
 func handleDeleteUser(database *pg.DB, adminScope string) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		adminToken := getAdminTokenId(request)
-		hasAdminScope := tokenHasScope(database, adminToken, adminScope)
+		hasAdminScope := requestHasScope(database, request, adminScope)
 		if !hasAdminScope {
 			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
 			http.Error(writer, response, http.StatusUnauthorized)
@@ -198,36 +371,64 @@ func handleDeleteUser(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
-		bodyBytes, err := ioutil.ReadAll(request.Body)
+		id, err := getIdParameterOrBody(request)
 		if err != nil {
-			response := fmt.Sprintf("Unable to read body: %s", err.Error())
+			response := fmt.Sprintf("Unable to get Id of user: %s", err.Error())
 			http.Error(writer, response, http.StatusBadRequest)
 
 			return
 		}
+		setAuditTarget(request, auditUserTarget(id))
 
-		id, err := uuid.ParseBytes(bodyBytes)
-		if err != nil {
-			response := fmt.Sprintf("Unable to decode parameter as Id: %s", err.Error())
-			http.Error(writer, response, http.StatusBadRequest)
+		// Deleting a user takes all of their tokens, certificates and history with them, so it has to be asked for
+		// explicitly; suspending or deactivating them is usually what's wanted.
+		if request.URL.Query().Get("confirm") != id.String() {
+			response := fmt.Sprintf("Deleting user '%s' is irreversible, confirm it with `?confirm=%s`", id, id)
+			http.Error(writer, response, http.StatusPreconditionRequired)
 
 			return
 		}
 
 		context := database.Context()
 		if err := database.RunInTransaction(context, func(transaction *pg.Tx) error {
-			tokens := make([]Token, 0)
-			if _, err := database.Model(&tokens).Where("user_id = ?", id).Delete(); err != nil {
+			serviceAccounts, err := getOwnedServiceAccountIds(transaction, id)
+			if err != nil {
+				return err
+			}
+			if len(serviceAccounts) != 0 {
+				return OwnedServiceAccountsError{UserId: id, ServiceAccounts: serviceAccounts}
+			}
+
+			if err := revokeUserCertificates(transaction, id); err != nil {
+				return err
+			}
+			if err := archiveUserTokens(transaction, id); err != nil {
 				return err
 			}
 
+			for _, model := range userOwnedModels {
+				if _, err := transaction.Model(model).Where("user_id = ?", id).Delete(); err != nil {
+					return err
+				}
+			}
+
 			user := User{Id: id}
-			if _, err := database.Model(&user).WherePK().Delete(); err != nil {
+			result, err := transaction.Model(&user).WherePK().Delete()
+			if err != nil {
 				return err
 			}
+			if result.RowsAffected() == 0 {
+				return nil
+			}
 
-			return nil
+			return recordEvent(transaction, UserDeletedEvent, userEventData{UserId: id})
 		}); err != nil {
+			if _, ok := err.(OwnedServiceAccountsError); ok {
+				response := fmt.Sprintf("Unable to delete user: %s", err.Error())
+				http.Error(writer, response, http.StatusConflict)
+
+				return
+			}
 			response := fmt.Sprintf("Unable to delete user: %s", err.Error())
 			http.Error(writer, response, http.StatusInternalServerError)
 
@@ -239,7 +440,7 @@ func handleDeleteUser(database *pg.DB, adminScope string) http.HandlerFunc {
 func handleGetUser(database *pg.DB, adminScope string) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		adminToken := getAdminTokenId(request)
-		hasAdminScope := tokenHasScope(database, adminToken, adminScope)
+		hasAdminScope := requestHasScope(database, request, adminScope)
 		if !hasAdminScope {
 			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
 			http.Error(writer, response, http.StatusUnauthorized)
@@ -263,6 +464,8 @@ func handleGetUser(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
+		setAuditTarget(request, auditUserTarget(*id))
+
 		users := make([]User, 0)
 		if err := database.Model(&users).Where("id = ?", id).Relation("Tokens").Select(); err != nil {
 			response := fmt.Sprintf("Error getting user: %s", err.Error())
@@ -278,14 +481,210 @@ func handleGetUser(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
+		writer.Header().Set("ETag", userETag(&users[0]))
 		_ = json.NewEncoder(writer).Encode(users[0])
 	}
 }
 
+type setOwnerParameters struct {
+	OwnerId    *uuid.UUID
+	OwnerGroup null.String
+}
+
+func handleSetServiceAccountOwner(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		var parameters setOwnerParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for setting owner: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if parameters.OwnerId == nil && parameters.OwnerGroup.String == "" {
+			http.Error(writer, "'ownerId' or 'ownerGroup' required", http.StatusBadRequest)
+
+			return
+		}
+
+		if parameters.OwnerId != nil {
+			if err := validateOwner(database, *parameters.OwnerId); err != nil {
+				response := fmt.Sprintf("Unable to set owner: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		user := User{Id: id, OwnerId: parameters.OwnerId, OwnerGroup: parameters.OwnerGroup.String}
+		result, err := database.Model(&user).
+			Set("owner_id = ?owner_id, owner_group = ?owner_group, version = version + 1").
+			Where("id = ? AND kind = ?", id, ServiceAccount).
+			Update()
+		if err != nil {
+			response := fmt.Sprintf("Unable to set owner: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if result.RowsAffected() == 0 {
+			response := fmt.Sprintf("Service account with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
+
+type setStatusParameters struct {
+	Status UserStatus
+	Reason string
+}
+
+func handleSetUserStatus(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		var parameters setStatusParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for user status: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		if !parameters.Status.isValid() {
+			response := fmt.Sprintf("Unknown user status '%s'", parameters.Status)
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		found, err := setUserStatus(database, id, parameters.Status, parameters.Reason)
+		if err != nil {
+			response := fmt.Sprintf("Unable to update user: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if !found {
+			response := fmt.Sprintf("User with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
+
+type setDisabledParameters struct {
+	Disabled bool
+}
+
+// Kept for clients from before users had a status; disabling a user deactivates them.
+func handleSetUserDisabled(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		var parameters setDisabledParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for disabling user: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		status := ActiveUser
+		if parameters.Disabled {
+			status = DeactivatedUser
+		}
+
+		found, err := setUserStatus(database, id, status, "")
+		if err != nil {
+			response := fmt.Sprintf("Unable to update user: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if !found {
+			response := fmt.Sprintf("User with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
+
+var userSortColumns = map[string]string{"username": "username", "name": "name", "createdAt": "created_at"}
+
+func userSortValue(user User, field string) interface{} {
+	switch field {
+	case "name":
+		return user.Name
+	case "createdAt":
+		return user.CreatedAt
+	default:
+		return user.Username
+	}
+}
+
+// Lists users a page at a time, with a `Link` header pointing to the next page. Users come with their tokens unless
+// `includeTokens=false` is given.
 func handleGetUsers(database *pg.DB, adminScope string) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		adminToken := getAdminTokenId(request)
-		hasAdminScope := tokenHasScope(database, adminToken, adminScope)
+		hasAdminScope := requestHasScope(database, request, adminScope)
 		if !hasAdminScope {
 			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
 			http.Error(writer, response, http.StatusUnauthorized)
@@ -293,24 +692,89 @@ func handleGetUsers(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
+		parameters := request.URL.Query()
+		kind := UserKind(parameters.Get("kind"))
+		if kind != "" && !kind.isValid() {
+			response := fmt.Sprintf("Unknown user kind '%s'", kind)
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		status := UserStatus(parameters.Get("status"))
+		if status != "" && !status.isValid() {
+			response := fmt.Sprintf("Unknown user status '%s'", status)
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		createdAfter, createdBefore, err := parseCreatedRange(parameters)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		page, err := parsePageRequest(parameters, userSortColumns, "username")
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
 		users := make([]User, 0)
-		if err := database.Model(&users).Relation("Tokens").Select(); err != nil {
+		query := database.Model(&users)
+		if parameters.Get("includeTokens") != "false" {
+			query = query.Relation("Tokens")
+		}
+		if kind != "" {
+			query = query.Where("kind = ?", kind)
+		}
+		if status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if prefix := parameters.Get("usernamePrefix"); prefix != "" {
+			query = query.Where("username LIKE ?", likePrefix(prefix))
+		}
+		query = applyCreatedRange(query, createdAfter, createdBefore)
+		if err := page.apply(query).Select(); err != nil {
 			response := fmt.Sprintf("Error getting users")
 			http.Error(writer, response, http.StatusInternalServerError)
 
 			return
 		}
 
+		if len(users) == page.limit {
+			last := users[len(users)-1]
+			setNextPageLink(writer, request, page.cursorAfter(userSortValue(last, page.sort.field), last.Id.String()))
+		}
+
 		if err := json.NewEncoder(writer).Encode(users); err != nil {
 			fmt.Printf("Unable to write user list to socket: %s", err.Error())
 		}
 	}
 }
 
+var tokenSortColumns = map[string]string{"createdAt": "created_at", "start": "start", "end": "end"}
+
+func tokenSortValue(token Token, field string) interface{} {
+	switch field {
+	case "start":
+		return token.Start
+	case "end":
+		return token.End
+	default:
+		return token.CreatedAt
+	}
+}
+
+// Lists tokens a page at a time, with a `Link` header pointing to the next page. `state` is either `active`, for
+// tokens that are currently valid, or `expired`.
 func handleGetTokens(database *pg.DB, adminScope string) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		adminToken := getAdminTokenId(request)
-		hasAdminScope := tokenHasScope(database, adminToken, adminScope)
+		hasAdminScope := requestHasScope(database, request, adminScope)
 		if !hasAdminScope {
 			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
 			http.Error(writer, response, http.StatusUnauthorized)
@@ -318,24 +782,99 @@ func handleGetTokens(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
+		parameters := request.URL.Query()
+		createdAfter, createdBefore, err := parseCreatedRange(parameters)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		page, err := parsePageRequest(parameters, tokenSortColumns, "createdAt")
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
 		tokens := make([]Token, 0)
-		if err := database.Model(&tokens).Select(); err != nil {
+		query := database.Model(&tokens)
+		if getParameters(request).ByName("Id") != "" {
+			// Listing the tokens of the user in the path
+			userId, err := getIdParameter(request)
+			if err != nil {
+				response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+			setAuditTarget(request, auditUserTarget(userId))
+
+			exists, err := database.Model((*User)(nil)).Where("id = ?", userId).Exists()
+			if err != nil {
+				response := fmt.Sprintf("Error getting user: %s", err.Error())
+				http.Error(writer, response, http.StatusInternalServerError)
+
+				return
+			}
+			if !exists {
+				response := fmt.Sprintf("User with id '%s' not found", userId)
+				http.Error(writer, response, http.StatusNotFound)
+
+				return
+			}
+			query = query.Where("user_id = ?", userId)
+		} else if userIdString := parameters.Get("userId"); userIdString != "" {
+			userId, err := uuid.Parse(userIdString)
+			if err != nil {
+				http.Error(writer, "'userId' has to be a user id", http.StatusBadRequest)
+
+				return
+			}
+			query = query.Where("user_id = ?", userId)
+		}
+		if scope := parameters.Get("scope"); scope != "" {
+			query = query.Where("? = ANY(string_to_array(scope, ' '))", scope)
+		}
+		now := time.Now()
+		switch parameters.Get("state") {
+		case "":
+		case "active":
+			query = query.Where(`start <= ? AND "end" > ?`, now, now)
+		case "expired":
+			query = query.Where(`"end" <= ?`, now)
+		default:
+			http.Error(writer, "'state' has to be 'active' or 'expired'", http.StatusBadRequest)
+
+			return
+		}
+		query = applyCreatedRange(query, createdAfter, createdBefore)
+		if err := page.apply(query).Select(); err != nil {
 			response := fmt.Sprintf("Error getting tokens")
 			http.Error(writer, response, http.StatusInternalServerError)
 
 			return
 		}
 
+		if len(tokens) == page.limit {
+			last := tokens[len(tokens)-1]
+			setNextPageLink(writer, request, page.cursorAfter(tokenSortValue(last, page.sort.field), last.Id.String()))
+		}
+
 		if err := json.NewEncoder(writer).Encode(tokens); err != nil {
 			fmt.Printf("Unable to write user list to socket: %s", err.Error())
 		}
 	}
 }
 
-func handleDeleteToken(database *pg.DB, adminScope string) http.HandlerFunc {
+func handleGetToken(database *pg.DB, adminScope string) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
+		// The token's id is in the path, so it has to be replaced in the audit log before anything else happens
+		id, idErr := getIdParameter(request)
+		setAuditTarget(request, auditTokenTarget(id))
+
 		adminToken := getAdminTokenId(request)
-		hasAdminScope := tokenHasScope(database, adminToken, adminScope)
+		hasAdminScope := requestHasScope(database, request, adminScope)
 		if !hasAdminScope {
 			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
 			http.Error(writer, response, http.StatusUnauthorized)
@@ -343,24 +882,69 @@ func handleDeleteToken(database *pg.DB, adminScope string) http.HandlerFunc {
 			return
 		}
 
-		bodyBytes, err := ioutil.ReadAll(request.Body)
-		if err != nil {
-			response := fmt.Sprintf("Unable to read body: %s", err.Error())
+		if idErr != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", idErr.Error())
 			http.Error(writer, response, http.StatusBadRequest)
 
 			return
 		}
 
-		id, err := uuid.ParseBytes(bodyBytes)
+		token, err := getTokenById(database, id)
+		if err == pg.ErrNoRows {
+			http.Error(writer, "Token not found", http.StatusNotFound)
+
+			return
+		}
 		if err != nil {
-			response := fmt.Sprintf("Unable to decode parameter as Id: %s", err.Error())
+			response := fmt.Sprintf("Error getting token: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(token)
+	}
+}
+
+func handleDeleteToken(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		// The token's id can be in the path, so it has to be replaced in the audit log before anything else happens
+		id, idErr := getIdParameterOrBody(request)
+		setAuditTarget(request, auditTokenTarget(id))
+
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		if idErr != nil {
+			response := fmt.Sprintf("Unable to get Id of token: %s", idErr.Error())
 			http.Error(writer, response, http.StatusBadRequest)
 
 			return
 		}
 
-		token := Token{Id: id}
-		if _, err := database.Model(&token).WherePK().Delete(); err != nil {
+		if err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+			token := Token{Id: id}
+			result, err := transaction.Model(&token).WherePK().Returning("*").Delete()
+			if err != nil || result.RowsAffected() == 0 {
+				return err
+			}
+
+			archivedToken := archiveToken(token, RevokedToken)
+			if _, err := transaction.Model(&archivedToken).Insert(); err != nil {
+				return err
+			}
+			if err := revokeTokenCertificates(transaction, id); err != nil {
+				return err
+			}
+
+			return recordEvent(transaction, TokenDeletedEvent, tokenEventData{Token: tokenFingerprint(id), UserId: token.UserId})
+		}); err != nil {
 			response := fmt.Sprintf("Unable to delete token: %s", err.Error())
 			http.Error(writer, response, http.StatusInternalServerError)
 
@@ -369,25 +953,107 @@ func handleDeleteToken(database *pg.DB, adminScope string) http.HandlerFunc {
 	}
 }
 
-func tokenHasScope(database *pg.DB, tokenId uuid.UUID, scope string) bool {
-	exists, err := database.Model((*Token)(nil)).Where("id = ? AND scope = ?", tokenId, scope).Exists()
+// Loads the token a request is authorized with, checking that it's currently valid and that the request satisfies any
+// binding the token has.
+func authenticateRequest(database *pg.DB, request *http.Request) (*Token, error) {
+	token, _, err := authenticateRequestWithProof(database, request)
+
+	return token, err
+}
+
+// Authenticates a request, also returning the DPoP proof it was made with for DPoP bound tokens. Proofs are used up
+// when they're verified, so requests have to be authenticated exactly once.
+func authenticateRequestWithProof(database *pg.DB, request *http.Request) (*Token, *dpopProof, error) {
+	tokenId := getAdminTokenId(request)
+	if tokenId == uuid.Nil {
+		return nil, nil, errNoToken
+	}
+
+	token, err := getTokenById(database, tokenId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if now.Before(token.Start) || !now.Before(token.End) {
+		return nil, nil, errTokenNotValid
+	}
+
+	active, err := userIsActive(database, token.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !active {
+		return nil, nil, errUserNotActive
+	}
+
+	if token.CertificateThumbprint != "" &&
+		!hmac.Equal([]byte(token.CertificateThumbprint), []byte(requestCertificateThumbprint(request))) {
+		return nil, nil, errCertificateMismatch
+	}
+
+	if token.JwkThumbprint == "" {
+		return token, nil, nil
+	}
+
+	scheme, credentials := getAuthorization(request)
+	if scheme != "DPoP" {
+		return nil, nil, errMissingDpopProof
+	}
+
+	proof, err := verifyRequestDpopProof(database, request, credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !hmac.Equal([]byte(token.JwkThumbprint), []byte(proof.thumbprint)) {
+		return nil, nil, errDpopKeyMismatch
+	}
+
+	return token, proof, nil
+}
+
+func requestHasScope(database *pg.DB, request *http.Request, scope string) bool {
+	token, err := authenticateRequest(database, request)
 	if err != nil {
 		return false
 	}
 
-	return exists
+	return token.hasScope(scope)
+}
+
+// Whether the request either has the admin scope or is made with one of the given user's own tokens, for resources
+// users manage themselves.
+func requestIsAdminOrUser(database *pg.DB, request *http.Request, adminScope string, userId uuid.UUID) bool {
+	token, err := authenticateRequest(database, request)
+	if err != nil {
+		return false
+	}
+
+	return token.hasScope(adminScope) || token.UserId == userId
 }
 
 func getAdminTokenId(request *http.Request) uuid.UUID {
-	authorizationHeader := request.Header.Get("Authorization")
-	if authorizationHeader == "" || !strings.HasPrefix(authorizationHeader, "Bearer ") {
+	scheme, credentials := getAuthorization(request)
+	if scheme != "Bearer" && scheme != "DPoP" {
 		return uuid.Nil
 	} else {
 		id := uuid.UUID{}
-		if err := id.Scan(strings.Split(authorizationHeader, " ")[1]); err != nil {
+		if err := id.Scan(credentials); err != nil {
 			return uuid.Nil
 		}
 
 		return id
 	}
 }
+
+// Splits the `Authorization` header into its scheme and credentials
+func getAuthorization(request *http.Request) (string, string) {
+	authorizationHeader := request.Header.Get("Authorization")
+	parts := strings.SplitN(authorizationHeader, " ", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	return parts[0], parts[1]
+}
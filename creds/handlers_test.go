@@ -2,13 +2,21 @@ package creds
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
@@ -19,7 +27,7 @@ func TestGetUsers(t *testing.T) {
 	url := "/users"
 	setup := initializeTestData(nil)
 	router := new(httprouter.Router)
-	setupRoutes(router, setup.database, setup.adminScope)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
 
 	withRecorder("GET",
 		url,
@@ -48,7 +56,7 @@ func TestGetTokens(t *testing.T) {
 	url := "/tokens"
 	setup := initializeTestData(nil)
 	router := new(httprouter.Router)
-	setupRoutes(router, setup.database, setup.adminScope)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
 
 	withRecorder("GET",
 		url,
@@ -79,7 +87,7 @@ func TestGetUser(t *testing.T) {
 	existingUserUrl := fmt.Sprintf("/user/%s", setup.adminId)
 	badUserUrl := fmt.Sprintf("/user/%s", uuid.New())
 	router := new(httprouter.Router)
-	setupRoutes(router, setup.database, setup.adminScope)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
 
 	headers := []headerEntry{bearerToken(setup.adminToken)}
 	withRecorder("GET",
@@ -118,7 +126,7 @@ func TestAddUser(t *testing.T) {
 
 	url := "/users"
 	router := new(httprouter.Router)
-	setupRoutes(router, setup.database, setup.adminScope)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
 
 	headers := []headerEntry{bearerToken(setup.adminToken)}
 	parameterBytes, err := json.Marshal(addUserParameters{
@@ -154,7 +162,7 @@ func TestAddToken(t *testing.T) {
 
 	url := "/tokens"
 	router := new(httprouter.Router)
-	setupRoutes(router, setup.database, setup.adminScope)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
 
 	headers := []headerEntry{bearerToken(setup.adminToken)}
 	parameterBytes, err := json.Marshal(addTokenParameters{
@@ -205,6 +213,413 @@ func TestAddToken(t *testing.T) {
 	runBadTokenTests(router, url)
 }
 
+func TestDeleteServiceAccountOwner(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	url := "/users"
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	ownerId, err := insertUser(setup.database, "Owner", "Owner")
+	if err != nil {
+		log.Panicf("Unable to add owner: %s", err.Error())
+	}
+	serviceAccountId, err := insertServiceAccount(setup.database, "CI", "ci-bot", &ownerId, "")
+	if err != nil {
+		log.Panicf("Unable to add service account: %s", err.Error())
+	}
+
+	headers := []headerEntry{bearerToken(setup.adminToken)}
+	withRecorder("DELETE",
+		url,
+		strings.NewReader(ownerId.String()),
+		headers,
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusPreconditionRequired {
+				log.Panicf("Bad status code for deleting user without confirmation: %d", recorder.Code)
+			}
+		})
+
+	confirmedUrl := fmt.Sprintf("%s?confirm=%s", url, ownerId)
+	withRecorder("DELETE",
+		confirmedUrl,
+		strings.NewReader(ownerId.String()),
+		headers,
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusConflict {
+				log.Panicf("Bad status code for deleting owner of service account: %d", recorder.Code)
+			}
+		})
+
+	withRecorder("PUT",
+		fmt.Sprintf("/user/%s/disabled", serviceAccountId),
+		strings.NewReader(`{"disabled": true}`),
+		headers,
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusOK {
+				log.Panicf("Bad status code for disabling service account: %d", recorder.Code)
+			}
+		})
+
+	withRecorder("DELETE",
+		confirmedUrl,
+		strings.NewReader(ownerId.String()),
+		headers,
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusOK {
+				log.Panicf("Bad status code for deleting owner of disabled service account: %d", recorder.Code)
+			}
+		})
+}
+
+func TestSuspendUser(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "On Leave", "on-leave")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	tokenId, err := insertToken(setup.database, userId, setup.adminScope, time.Now(), time.Now().Add(time.Hour), tokenBinding{})
+	if err != nil {
+		log.Panicf("Unable to add token: %s", err.Error())
+	}
+
+	url := fmt.Sprintf("/user/%s", userId)
+	statusUrl := fmt.Sprintf("/user/%s/status", userId)
+	adminHeaders := []headerEntry{bearerToken(setup.adminToken)}
+	userHeaders := []headerEntry{bearerToken(tokenId)}
+
+	expectStatus("GET", url, "", userHeaders, router, http.StatusOK)
+
+	expectStatus("PUT", statusUrl, `{"status": "suspended", "reason": "Under investigation"}`, adminHeaders, router, http.StatusOK)
+	expectStatus("GET", url, "", userHeaders, router, http.StatusUnauthorized)
+
+	user, err := getUserById(setup.database, userId)
+	if err != nil {
+		log.Panicf("Unable to get user: %s", err.Error())
+	}
+	if user.Status != SuspendedUser || user.StatusReason != "Under investigation" || user.StatusChangedAt == nil {
+		log.Panicf("User status not stored: %+v", user)
+	}
+	if _, err := getTokenById(setup.database, tokenId); err != nil {
+		log.Panicf("Suspending a user removed their token: %s", err.Error())
+	}
+
+	expectStatus("PUT", statusUrl, `{"status": "active"}`, adminHeaders, router, http.StatusOK)
+	expectStatus("GET", url, "", userHeaders, router, http.StatusOK)
+
+	expectStatus("PUT", statusUrl, `{"status": "retired"}`, adminHeaders, router, http.StatusBadRequest)
+}
+
+func TestResourceRoutes(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Resource", "resource")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+
+	headers := []headerEntry{bearerToken(setup.adminToken)}
+	userUrl := fmt.Sprintf("/users/%s", userId)
+	tokenId := uuid.UUID{}
+	recorder := expectStatus("POST", userUrl+"/tokens", `{"scope": "reader"}`, headers, router, http.StatusOK)
+	if err := json.NewDecoder(recorder.Body).Decode(&tokenId); err != nil {
+		log.Panicf("Unable to read body into UUID: %s", err.Error())
+	}
+
+	recorder = expectStatus("GET", userUrl+"/tokens", "", headers, router, http.StatusOK)
+	tokens := make([]Token, 0)
+	if err := json.NewDecoder(recorder.Body).Decode(&tokens); err != nil {
+		log.Panicf("Unable to decode response into `[]Token`: %s", err.Error())
+	}
+	if len(tokens) != 1 || tokens[0].Id != tokenId {
+		log.Panicf("Unexpected tokens for user: %+v", tokens)
+	}
+
+	tokenUrl := fmt.Sprintf("/tokens/%s", tokenId)
+	expectStatus("GET", tokenUrl, "", headers, router, http.StatusOK)
+	expectStatus("DELETE", tokenUrl, "", headers, router, http.StatusOK)
+	expectStatus("GET", tokenUrl, "", headers, router, http.StatusNotFound)
+
+	recorder = expectStatus("GET", userUrl, "", headers, router, http.StatusOK)
+	if recorder.Header().Get("Deprecation") != "" {
+		log.Panicln("Resource path marked as deprecated")
+	}
+	recorder = expectStatus("GET", fmt.Sprintf("/user/%s", userId), "", headers, router, http.StatusOK)
+	if recorder.Header().Get("Deprecation") == "" ||
+		recorder.Header().Get("Link") != fmt.Sprintf(`<%s>; rel="successor-version"`, userUrl) {
+		log.Panicf("Legacy path not marked as deprecated: %v", recorder.Header())
+	}
+
+	expectStatus("DELETE", fmt.Sprintf("%s?confirm=%s", userUrl, userId), "", headers, router, http.StatusOK)
+	expectStatus("GET", userUrl, "", headers, router, http.StatusNotFound)
+	expectStatus("GET", userUrl+"/tokens", "", headers, router, http.StatusNotFound)
+}
+
+func TestLogin(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	url := "/login"
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Login User", "login-user", "reader")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	passwordHash, err := hashPassword("a long enough password", setup.settings.PasswordParameters)
+	if err != nil {
+		log.Panicf("Unable to hash password: %s", err.Error())
+	}
+	if _, err := setUserPasswordHash(setup.database, userId, passwordHash); err != nil {
+		log.Panicf("Unable to set password: %s", err.Error())
+	}
+
+	withRecorder("POST",
+		url,
+		strings.NewReader(`{"username": "login-user", "password": "a long enough password"}`),
+		[]headerEntry{},
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusOK {
+				log.Panicf("Bad status code for login: %d", recorder.Code)
+			}
+
+			response := loginResponse{}
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				log.Panicf("Unable to decode response into `loginResponse`: %s", err.Error())
+			}
+
+			token, err := getTokenById(setup.database, response.Token)
+			if err != nil {
+				log.Panicf("Unable to get session token: %s", err.Error())
+			}
+
+			if !token.hasScope("reader") {
+				log.Panicf("Session token doesn't have the user's default scope: %+v", response)
+			}
+		})
+
+	for _, body := range []string{
+		`{"username": "login-user", "password": "the wrong password"}`,
+		`{"username": "no-such-user", "password": "a long enough password"}`,
+	} {
+		withRecorder("POST",
+			url,
+			strings.NewReader(body),
+			[]headerEntry{},
+			router,
+			func(recorder *httptest.ResponseRecorder, request *http.Request) {
+				if recorder.Code != http.StatusUnauthorized {
+					log.Panicf("Bad status code for failed login: %d", recorder.Code)
+				}
+			})
+	}
+}
+
+func TestCertificateBoundToken(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	url := "/users"
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	certificate := &x509.Certificate{Raw: []byte("not actually a certificate")}
+	boundToken, err := insertToken(setup.database,
+		setup.adminId,
+		setup.adminScope,
+		time.Time{},
+		time.Time{},
+		tokenBinding{certificateThumbprint: certificateThumbprint(certificate)},
+	)
+	if err != nil {
+		log.Panicf("Unable to insert bound token: %s", err.Error())
+	}
+
+	withRecorder("GET",
+		url,
+		nil,
+		[]headerEntry{bearerToken(boundToken)},
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusUnauthorized {
+				log.Panicf("Bound token without client certificate does not return unauthorized: %d", recorder.Code)
+			}
+		})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", url, nil)
+	request.Header.Set("Authorization", bearerToken(boundToken).value)
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		log.Panicf("Bound token with matching client certificate is not accepted: %d", recorder.Code)
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Panicf("Unable to generate key: %s", err.Error())
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		log.Panicf("Unable to create CSR: %s", err.Error())
+	}
+	parameterBytes, err := json.Marshal(issueCertificateParameters{
+		Csr: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		log.Panicf("Unable to serialize `issueCertificateParameters`: %s", err.Error())
+	}
+
+	var certificate *x509.Certificate
+	withRecorder("POST",
+		"/certificates",
+		bytes.NewReader(parameterBytes),
+		[]headerEntry{bearerToken(setup.adminToken)},
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusOK {
+				log.Panicf("Bad status code for issuing certificate: %d\n\tBody: %s", recorder.Code, recorder.Body)
+			}
+
+			block, _ := pem.Decode(recorder.Body.Bytes())
+			if block == nil {
+				log.Panicf("No PEM certificate in response: %s", recorder.Body)
+			}
+			certificate, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				log.Panicf("Unable to parse issued certificate: %s", err.Error())
+			}
+
+			if certificate.Subject.CommonName != "Admin" || certificate.URIs[0].String() != userUri(setup.adminId).String() {
+				log.Panicf("Issued certificate has wrong identity: %s %v", certificate.Subject, certificate.URIs)
+			}
+		})
+
+	statusUrl := fmt.Sprintf("/certificates/%s/status", certificate.SerialNumber.Text(16))
+	withRecorder("DELETE",
+		fmt.Sprintf("/certificates/%s", certificate.SerialNumber.Text(16)),
+		nil,
+		[]headerEntry{bearerToken(setup.adminToken)},
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusOK {
+				log.Panicf("Bad status code for revoking certificate: %d", recorder.Code)
+			}
+		})
+
+	withRecorder("GET",
+		statusUrl,
+		nil,
+		[]headerEntry{},
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			status := certificateStatusResponse{}
+			if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+				log.Panicf("Unable to decode response into `certificateStatusResponse`: %s", err.Error())
+			}
+
+			if status.Status != "revoked" {
+				log.Panicf("Revoked certificate has status '%s'", status.Status)
+			}
+		})
+}
+
+func TestRevokedTokenRevokesCertificates(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Panicf("Unable to generate key: %s", err.Error())
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		log.Panicf("Unable to create CSR: %s", err.Error())
+	}
+	parameterBytes, err := json.Marshal(issueCertificateParameters{
+		Csr: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		log.Panicf("Unable to serialize `issueCertificateParameters`: %s", err.Error())
+	}
+
+	userId, err := insertUser(setup.database, "Certified", "certified")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	adminHeaders := []headerEntry{bearerToken(setup.adminToken)}
+
+	// Tokens are revoked one at a time and in batches
+	revocations := map[string]func(tokenId uuid.UUID){
+		"single": func(tokenId uuid.UUID) {
+			expectStatus("DELETE", fmt.Sprintf("/tokens/%s", tokenId), "", adminHeaders, router, http.StatusOK)
+		},
+		"batch": func(tokenId uuid.UUID) {
+			selector := `{"selector": {"scope": "batch"}}`
+			expectStatus("POST", "/tokens:batchRevoke", selector, adminHeaders, router, http.StatusOK)
+		},
+	}
+	for scope, revoke := range revocations {
+		tokenId, err := insertToken(setup.database, userId, scope, time.Now(), time.Now().Add(time.Hour), tokenBinding{})
+		if err != nil {
+			log.Panicf("Unable to add token: %s", err.Error())
+		}
+
+		tokenHeaders := []headerEntry{bearerToken(tokenId)}
+		recorder := expectStatus("POST", "/certificates", string(parameterBytes), tokenHeaders, router, http.StatusOK)
+		block, _ := pem.Decode(recorder.Body.Bytes())
+		if block == nil {
+			log.Panicf("No PEM certificate in response: %s", recorder.Body)
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Panicf("Unable to parse issued certificate: %s", err.Error())
+		}
+
+		revoke(tokenId)
+
+		statusUrl := fmt.Sprintf("/certificates/%s/status", certificate.SerialNumber.Text(16))
+		recorder = expectStatus("GET", statusUrl, "", []headerEntry{}, router, http.StatusOK)
+		status := certificateStatusResponse{}
+		if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil || status.Status != "revoked" {
+			log.Panicf("Certificate of a revoked token has status '%s': %v", status.Status, err)
+		}
+
+		recorder = expectStatus("GET", "/ca/crl", "", []headerEntry{}, router, http.StatusOK)
+		crl, err := x509.ParseCRL(recorder.Body.Bytes())
+		if err != nil {
+			log.Panicf("Unable to parse CRL: %s", err.Error())
+		}
+		listed := false
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			listed = listed || revoked.SerialNumber.Cmp(certificate.SerialNumber) == 0
+		}
+		if !listed {
+			log.Panicf("Certificate of a revoked token isn't on the CRL")
+		}
+	}
+}
+
 type headerEntry struct {
 	key   string
 	value string
@@ -234,6 +649,30 @@ func withRecorder(method string,
 	f(recorder, request)
 }
 
+// Makes a request that has to get the `expected` status, returning the response for checking its body or headers
+func expectStatus(method string,
+	url string,
+	body string,
+	headers []headerEntry,
+	router *httprouter.Router,
+	expected int,
+) *httptest.ResponseRecorder {
+	var response *httptest.ResponseRecorder
+	withRecorder(method,
+		url,
+		strings.NewReader(body),
+		headers,
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != expected {
+				log.Panicf("Bad status code for %s %s: %d, expected %d", method, url, recorder.Code, expected)
+			}
+			response = recorder
+		})
+
+	return response
+}
+
 func runBadTokenTests(router *httprouter.Router, url string) {
 	// Bad token test
 	withRecorder("GET",
@@ -263,3 +702,23 @@ func runBadTokenTests(router *httprouter.Router, url string) {
 func bearerToken(token fmt.Stringer) headerEntry {
 	return headerEntry{"Authorization", fmt.Sprintf("Bearer %s", token)}
 }
+
+func TestGetDebugVars(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	withRecorder("GET",
+		"/debug/vars",
+		nil,
+		[]headerEntry{bearerToken(setup.adminToken)},
+		router,
+		func(recorder *httptest.ResponseRecorder, request *http.Request) {
+			if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "reaper_runs") {
+				log.Panicf("Unexpected debug vars: %d %s", recorder.Code, recorder.Body.String())
+			}
+		})
+
+	runBadTokenTests(router, "/debug/vars")
+}
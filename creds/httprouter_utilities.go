@@ -1,8 +1,11 @@
 package creds
 
 import (
+	"errors"
+	"io/ioutil"
 	"net/http"
 
+	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -16,3 +19,32 @@ func getParameters(request *http.Request) httprouter.Params {
 		return nil
 	}
 }
+
+// Gets the `Id` path parameter from a request as a UUID
+func getIdParameter(request *http.Request) (uuid.UUID, error) {
+	id := uuid.UUID{}
+	parameters := getParameters(request)
+	if parameters == nil {
+		return uuid.Nil, errors.New("no `Id` given as path parameter")
+	}
+
+	if err := id.Scan(parameters.ByName("Id")); err != nil {
+		return uuid.Nil, err
+	}
+
+	return id, nil
+}
+
+// Gets the `Id` path parameter, or for the older routes that take the id as the request body, the body
+func getIdParameterOrBody(request *http.Request) (uuid.UUID, error) {
+	if getParameters(request).ByName("Id") != "" {
+		return getIdParameter(request)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return uuid.ParseBytes(bodyBytes)
+}
@@ -0,0 +1,86 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+// Confirmation claim (RFC 7800) describing what the token is bound to, so resource servers can enforce the binding
+type confirmation struct {
+	Jkt             string `json:"jkt,omitempty"`
+	CertificateHash string `json:"x5t#S256,omitempty"`
+}
+
+// Response in the format of RFC 7662; everything except `active` is left out for inactive tokens
+type introspectionResponse struct {
+	Active    bool          `json:"active"`
+	Scope     string        `json:"scope,omitempty"`
+	Subject   string        `json:"sub,omitempty"`
+	Username  string        `json:"username,omitempty"`
+	TokenType string        `json:"token_type,omitempty"`
+	Expires   int64         `json:"exp,omitempty"`
+	NotBefore int64         `json:"nbf,omitempty"`
+	Cnf       *confirmation `json:"cnf,omitempty"`
+}
+
+func handleIntrospect(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		verifier, err := authenticateRequest(database, request)
+		if err != nil || !(verifier.hasScope(settings.IntrospectionScope) || verifier.hasScope(adminScope)) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		if err := request.ParseForm(); err != nil {
+			response := fmt.Sprintf("Unable to parse form: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+
+		id, err := uuid.Parse(request.PostForm.Get("token"))
+		if err != nil {
+			_ = json.NewEncoder(writer).Encode(introspectionResponse{Active: false})
+
+			return
+		}
+
+		token := Token{Id: id}
+		if err := database.Model(&token).WherePK().Relation("User").Select(); err != nil {
+			_ = json.NewEncoder(writer).Encode(introspectionResponse{Active: false})
+
+			return
+		}
+
+		now := time.Now()
+		if now.Before(token.Start) || !now.Before(token.End) || token.User.Status != ActiveUser {
+			_ = json.NewEncoder(writer).Encode(introspectionResponse{Active: false})
+
+			return
+		}
+
+		response := introspectionResponse{
+			Active:    true,
+			Scope:     token.Scope,
+			Subject:   token.UserId.String(),
+			Username:  token.User.Username,
+			TokenType: token.binding().tokenType(),
+			Expires:   token.End.Unix(),
+			NotBefore: token.Start.Unix(),
+		}
+		if token.CertificateThumbprint != "" || token.JwkThumbprint != "" {
+			response.Cnf = &confirmation{Jkt: token.JwkThumbprint, CertificateHash: token.CertificateThumbprint}
+		}
+
+		_ = json.NewEncoder(writer).Encode(response)
+	}
+}
@@ -0,0 +1,16 @@
+package creds
+
+import (
+	"time"
+)
+
+// Runs `job` every `interval` until the process exits. Jobs are expected to handle and report their own errors.
+func runPeriodically(interval time.Duration, job func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		job()
+		<-ticker.C
+	}
+}
@@ -0,0 +1,174 @@
+package creds
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// Private keys creds signs with, encrypted with the master key. Keys that belong to a certificate (like the CA's)
+// have the certificate stored alongside them.
+type StoredKey struct {
+	Name         string    `pg:",pk"`
+	EncryptedKey []byte    `pg:",notnull"`
+	Certificate  []byte    `pg:""`
+	CreatedAt    time.Time `pg:",notnull"`
+}
+
+const certificateAuthorityKeyName = "certificate-authority"
+
+var errNotASigner = errors.New("stored key can't be used for signing")
+
+type keyStore struct {
+	database *pg.DB
+	keyring  *keyring
+}
+
+func newKeyStore(database *pg.DB, keyring *keyring) *keyStore {
+	return &keyStore{database: database, keyring: keyring}
+}
+
+func storedKeyAssociatedData(name string) []byte {
+	return []byte(fmt.Sprintf("stored-key:%s", name))
+}
+
+func (keyStore *keyStore) get(name string) (crypto.Signer, []byte, error) {
+	storedKey := StoredKey{Name: name}
+	if err := keyStore.database.Model(&storedKey).WherePK().Select(); err != nil {
+		return nil, nil, err
+	}
+
+	keyBytes, err := keyStore.keyring.decrypt(storedKey.EncryptedKey, storedKeyAssociatedData(name))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errNotASigner
+	}
+
+	return signer, storedKey.Certificate, nil
+}
+
+// Stores a key under a name, replacing any key already stored under it when `replace` is set. Returns whether the
+// key was stored; without `replace` an existing key is kept.
+func (keyStore *keyStore) put(name string, key crypto.Signer, certificate []byte, replace bool) (bool, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	encryptedKey, err := keyStore.keyring.encrypt(keyBytes, storedKeyAssociatedData(name))
+	if err != nil {
+		return false, err
+	}
+
+	storedKey := StoredKey{Name: name, EncryptedKey: encryptedKey, Certificate: certificate, CreatedAt: time.Now()}
+	query := keyStore.database.Model(&storedKey)
+	if replace {
+		query = query.OnConflict("(name) DO UPDATE").
+			Set("encrypted_key = EXCLUDED.encrypted_key").
+			Set("certificate = EXCLUDED.certificate").
+			Set("created_at = EXCLUDED.created_at")
+	} else {
+		query = query.OnConflict("DO NOTHING")
+	}
+
+	result, err := query.Insert()
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() != 0, nil
+}
+
+// Gets a key from the store, generating and storing one with `generate` the first time it's asked for. Instances
+// racing to generate the same key all end up using whichever was stored first.
+func (keyStore *keyStore) getOrCreate(
+	name string,
+	generate func() (crypto.Signer, []byte, error),
+) (crypto.Signer, []byte, error) {
+	signer, certificate, err := keyStore.get(name)
+	if err == nil {
+		return signer, certificate, nil
+	}
+	if err != pg.ErrNoRows {
+		return nil, nil, err
+	}
+
+	signer, certificate, err = generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := keyStore.put(name, signer, certificate, false); err != nil {
+		return nil, nil, err
+	}
+
+	return keyStore.get(name)
+}
+
+// The CA client certificates are issued by. Unless an intermediate has been imported, this is a self-signed root
+// that's generated the first time it's needed.
+func (keyStore *keyStore) certificateAuthority() (*x509.Certificate, crypto.Signer, error) {
+	signer, certificateBytes, err := keyStore.getOrCreate(certificateAuthorityKeyName, generateRootCertificateAuthority)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(certificateBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certificate, signer, nil
+}
+
+func generateRootCertificateAuthority() (crypto.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "creds root CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, certificate, nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+}
@@ -0,0 +1,517 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+// Credentials issued by a secret engine, which are revoked through the engine when they expire or are revoked. The
+// lease is kept afterwards to record who was given what.
+type Lease struct {
+	Id        uuid.UUID         `json:"id" pg:"type:uuid,pk"`
+	Mount     string            `json:"mount" pg:",notnull"`
+	Role      string            `json:"role" pg:",notnull"`
+	UserId    uuid.UUID         `json:"userId" pg:"type:uuid,notnull"`
+	Data      map[string]string `json:"data"`
+	CreatedAt time.Time         `json:"createdAt" pg:",notnull"`
+	ExpiresAt time.Time         `json:"expiresAt" pg:",notnull"`
+	RevokedAt time.Time         `json:"revokedAt,omitempty"`
+}
+
+type NoSuchLeaseError struct {
+	Id uuid.UUID
+}
+
+func (noSuchLeaseError NoSuchLeaseError) Error() string {
+	return fmt.Sprintf("Active lease with id '%s' does not exist", noSuchLeaseError.Id)
+}
+
+type leaseManager struct {
+	database *pg.DB
+	registry *engineRegistry
+}
+
+func newLeaseManager(database *pg.DB, registry *engineRegistry) *leaseManager {
+	return &leaseManager{database: database, registry: registry}
+}
+
+func leaseTtl(requestedSeconds int, defaultSeconds int, maxSeconds int) time.Duration {
+	seconds := requestedSeconds
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	if maxSeconds > 0 && seconds > maxSeconds {
+		seconds = maxSeconds
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func (manager *leaseManager) getRole(mount string, name string) (SecretEngine, EngineRole, error) {
+	engine, err := manager.registry.get(mount)
+	if err != nil {
+		return nil, EngineRole{}, err
+	}
+
+	role := EngineRole{Mount: mount, Name: name}
+	if err := manager.database.Model(&role).WherePK().Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, EngineRole{}, NoSuchEngineRoleError{Mount: mount, Name: name}
+		}
+
+		return nil, EngineRole{}, err
+	}
+
+	return engine, role, nil
+}
+
+func (manager *leaseManager) issue(
+	mount string,
+	roleName string,
+	userId uuid.UUID,
+	requestedTtlSeconds int,
+) (*Lease, map[string]interface{}, error) {
+	engine, role, err := manager.getRole(mount, roleName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	lease := Lease{
+		Id:        uuid.New(),
+		Mount:     mount,
+		Role:      role.Name,
+		UserId:    userId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(leaseTtl(requestedTtlSeconds, role.DefaultTtlSeconds, role.MaxTtlSeconds)),
+	}
+
+	credentials, err := engine.Issue(role, &lease)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := manager.database.Model(&lease).Insert(); err != nil {
+		// Untracked credentials would never expire, so they're taken back right away
+		if revokeErr := engine.Revoke(role, &lease); revokeErr != nil {
+			fmt.Printf("Unable to revoke untracked credentials for lease '%s': %s\n", lease.Id, revokeErr.Error())
+		}
+
+		return nil, nil, err
+	}
+
+	return &lease, credentials, nil
+}
+
+// Extends a lease by `incrementSeconds` from now, or by the role's default TTL, capped by the role's max TTL counted
+// from when the lease was created.
+func (manager *leaseManager) renew(leaseId uuid.UUID, incrementSeconds int) (*Lease, error) {
+	lease := Lease{}
+	err := manager.database.RunInTransaction(manager.database.Context(), func(transaction *pg.Tx) error {
+		if err := transaction.Model(&lease).
+			Where("id = ? AND revoked_at IS NULL AND expires_at > ?", leaseId, time.Now()).
+			For("UPDATE").
+			Select(); err != nil {
+			if err == pg.ErrNoRows {
+				return NoSuchLeaseError{Id: leaseId}
+			}
+
+			return err
+		}
+
+		engine, role, err := manager.getRole(lease.Mount, lease.Role)
+		if err != nil {
+			return err
+		}
+
+		expiresAt := time.Now().Add(leaseTtl(incrementSeconds, role.DefaultTtlSeconds, 0))
+		if role.MaxTtlSeconds > 0 {
+			maxExpiresAt := lease.CreatedAt.Add(time.Duration(role.MaxTtlSeconds) * time.Second)
+			if expiresAt.After(maxExpiresAt) {
+				expiresAt = maxExpiresAt
+			}
+		}
+		lease.ExpiresAt = expiresAt
+
+		if err := engine.Renew(role, &lease); err != nil {
+			return err
+		}
+
+		_, err = transaction.Model(&lease).Column("expires_at").WherePK().Update()
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+// Revokes a lease through its engine. The lease row is locked while that happens so that instances expiring leases
+// concurrently don't both revoke the same credentials.
+func (manager *leaseManager) revoke(leaseId uuid.UUID) error {
+	return manager.database.RunInTransaction(manager.database.Context(), func(transaction *pg.Tx) error {
+		lease := Lease{}
+		if err := transaction.Model(&lease).
+			Where("id = ? AND revoked_at IS NULL", leaseId).
+			For("UPDATE SKIP LOCKED").
+			Select(); err != nil {
+			if err == pg.ErrNoRows {
+				return NoSuchLeaseError{Id: leaseId}
+			}
+
+			return err
+		}
+
+		engine, role, err := manager.getRole(lease.Mount, lease.Role)
+		if err != nil {
+			return err
+		}
+
+		if err := engine.Revoke(role, &lease); err != nil {
+			return err
+		}
+
+		_, err = transaction.Model(&lease).Set("revoked_at = ?", time.Now()).WherePK().Update()
+
+		return err
+	})
+}
+
+func (manager *leaseManager) expire() {
+	leases := make([]Lease, 0)
+	if err := manager.database.Model(&leases).
+		Where("revoked_at IS NULL AND expires_at <= ?", time.Now()).
+		Select(); err != nil {
+		fmt.Printf("Unable to get expired leases: %s\n", err.Error())
+
+		return
+	}
+
+	for _, lease := range leases {
+		if err := manager.revoke(lease.Id); err != nil {
+			if _, ok := err.(NoSuchLeaseError); ok {
+				continue
+			}
+			fmt.Printf("Unable to revoke expired lease '%s': %s\n", lease.Id, err.Error())
+		}
+	}
+}
+
+type engineResponse struct {
+	Mount  string              `json:"mount"`
+	Schema []EngineConfigField `json:"schema"`
+}
+
+func handleGetEngines(database *pg.DB, adminScope string, registry *engineRegistry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		engines := make([]engineResponse, 0)
+		for _, path := range registry.paths() {
+			engine, _ := registry.get(path)
+			engines = append(engines, engineResponse{Mount: path, Schema: engine.ConfigSchema()})
+		}
+
+		_ = json.NewEncoder(writer).Encode(engines)
+	}
+}
+
+func handleAddEngineRole(database *pg.DB, adminScope string, registry *engineRegistry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		mount := getParameters(request).ByName("Mount")
+		engine, err := registry.get(mount)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		var role EngineRole
+		if err := json.NewDecoder(request.Body).Decode(&role); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for adding role: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if !engineNamePattern.MatchString(role.Name) || role.DefaultTtlSeconds <= 0 {
+			http.Error(writer, "'name' has to be a lowercase identifier and 'defaultTtlSeconds' is required", http.StatusBadRequest)
+
+			return
+		}
+		if role.Config == nil {
+			role.Config = map[string]interface{}{}
+		}
+		if err := validateEngineConfig(engine.ConfigSchema(), role.Config); err != nil {
+			response := fmt.Sprintf("Invalid configuration: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		role.Mount = mount
+		role.CreatedAt = time.Now()
+
+		if _, err := database.Model(&role).
+			OnConflict("(mount, name) DO UPDATE").
+			Set("config = EXCLUDED.config").
+			Set("default_ttl_seconds = EXCLUDED.default_ttl_seconds").
+			Set("max_ttl_seconds = EXCLUDED.max_ttl_seconds").
+			Insert(); err != nil {
+			response := fmt.Sprintf("Unable to store role: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+	}
+}
+
+func handleGetEngineRoles(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		roles := make([]EngineRole, 0)
+		if err := database.Model(&roles).
+			Where("mount = ?", getParameters(request).ByName("Mount")).
+			Order("name").
+			Select(); err != nil {
+			response := fmt.Sprintf("Error getting roles")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if err := json.NewEncoder(writer).Encode(roles); err != nil {
+			fmt.Printf("Unable to write role list to socket: %s", err.Error())
+		}
+	}
+}
+
+type issueCredentialsParameters struct {
+	TtlSeconds int
+}
+
+type issueCredentialsResponse struct {
+	LeaseId     uuid.UUID              `json:"leaseId"`
+	ExpiresAt   time.Time              `json:"expiresAt"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// Issues credentials from a role. Callers need the admin scope or `<mount>:<role>`, like `database:readonly`.
+func handleIssueCredentials(database *pg.DB, adminScope string, leaseManager *leaseManager, mount string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		parameters := getParameters(request)
+		if parameters == nil {
+			http.Error(writer, "No `Role` given as path parameter", http.StatusBadRequest)
+
+			return
+		}
+		// The mount given to the handler is shared by every request, so the one from the path is kept per request
+		requestMount := mount
+		if requestMount == "" {
+			requestMount = parameters.ByName("Mount")
+		}
+		roleName := parameters.ByName("Role")
+
+		token, err := authenticateRequest(database, request)
+		if err != nil || !(token.hasScope(adminScope) || token.hasScope(fmt.Sprintf("%s:%s", requestMount, roleName))) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var issueParameters issueCredentialsParameters
+		if request.ContentLength != 0 {
+			if err := json.NewDecoder(request.Body).Decode(&issueParameters); err != nil {
+				response := fmt.Sprintf("Error decoding parameters for issuing credentials: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		lease, credentials, err := leaseManager.issue(requestMount, roleName, token.UserId, issueParameters.TtlSeconds)
+		if err != nil {
+			switch err.(type) {
+			case NoSuchMountError, NoSuchEngineRoleError:
+				http.Error(writer, err.Error(), http.StatusNotFound)
+			default:
+				response := fmt.Sprintf("Unable to issue credentials: %s", err.Error())
+				http.Error(writer, response, http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(issueCredentialsResponse{
+			LeaseId:     lease.Id,
+			ExpiresAt:   lease.ExpiresAt,
+			Credentials: credentials,
+		})
+	}
+}
+
+func handleGetLeases(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		leases := make([]Lease, 0)
+		if err := database.Model(&leases).Order("created_at DESC").Select(); err != nil {
+			response := fmt.Sprintf("Error getting leases")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if err := json.NewEncoder(writer).Encode(leases); err != nil {
+			fmt.Printf("Unable to write lease list to socket: %s", err.Error())
+		}
+	}
+}
+
+// Gets the lease a request is about, writing an error response and returning `nil` unless the request is made by
+// an admin or the user the lease was issued to. Only admins learn that a lease doesn't exist; everyone else gets
+// the same 401 for leases that don't exist and leases that aren't theirs.
+func authorizeLeaseRequest(writer http.ResponseWriter, request *http.Request, database *pg.DB, adminScope string) *Lease {
+	unauthorized := func() {
+		response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+		http.Error(writer, response, http.StatusUnauthorized)
+	}
+
+	token, err := authenticateRequest(database, request)
+	if err != nil {
+		unauthorized()
+
+		return nil
+	}
+
+	id, err := getIdParameter(request)
+	if err != nil {
+		response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+		http.Error(writer, response, http.StatusBadRequest)
+
+		return nil
+	}
+
+	isAdmin := token.hasScope(adminScope)
+	lease := Lease{Id: id}
+	if err := database.Model(&lease).WherePK().Select(); err != nil {
+		if err == pg.ErrNoRows && !isAdmin {
+			unauthorized()
+
+			return nil
+		} else if err == pg.ErrNoRows {
+			response := fmt.Sprintf("Lease with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return nil
+		}
+		response := fmt.Sprintf("Error getting lease: %s", err.Error())
+		http.Error(writer, response, http.StatusInternalServerError)
+
+		return nil
+	}
+
+	if !isAdmin && token.UserId != lease.UserId {
+		unauthorized()
+
+		return nil
+	}
+
+	return &lease
+}
+
+type renewLeaseParameters struct {
+	IncrementSeconds int
+}
+
+func handleRenewLease(database *pg.DB, adminScope string, leaseManager *leaseManager) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		lease := authorizeLeaseRequest(writer, request, database, adminScope)
+		if lease == nil {
+			return
+		}
+
+		var parameters renewLeaseParameters
+		if request.ContentLength != 0 {
+			if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+				response := fmt.Sprintf("Error decoding parameters for renewing lease: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		renewedLease, err := leaseManager.renew(lease.Id, parameters.IncrementSeconds)
+		if err != nil {
+			if _, ok := err.(NoSuchLeaseError); ok {
+				http.Error(writer, err.Error(), http.StatusConflict)
+
+				return
+			}
+			response := fmt.Sprintf("Unable to renew lease: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(renewedLease)
+	}
+}
+
+func handleRevokeLease(database *pg.DB, adminScope string, leaseManager *leaseManager) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		lease := authorizeLeaseRequest(writer, request, database, adminScope)
+		if lease == nil {
+			return
+		}
+
+		if err := leaseManager.revoke(lease.Id); err != nil {
+			if _, ok := err.(NoSuchLeaseError); ok {
+				http.Error(writer, err.Error(), http.StatusConflict)
+
+				return
+			}
+			response := fmt.Sprintf("Unable to revoke lease: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+)
+
+type loginParameters struct {
+	Username null.String
+	Password null.String
+	// A TOTP code or recovery code, required for users enrolled in TOTP
+	Code null.String
+}
+
+type loginParametersError struct {
+	Username bool
+	Password bool
+}
+
+func (parametersError loginParametersError) Error() string {
+	errors := make([]string, 0)
+
+	if parametersError.Username {
+		errors = append(errors, "'username' missing")
+	}
+
+	if parametersError.Password {
+		errors = append(errors, "'password' missing")
+	}
+
+	return strings.Join(errors, ", ")
+}
+
+func (parameters *loginParameters) UnmarshalJSON(bytes []byte) error {
+	var toUnmarshal struct {
+		Username null.String
+		Password null.String
+		Code     null.String
+	}
+	if err := json.Unmarshal(bytes, &toUnmarshal); err != nil {
+		return err
+	}
+
+	parameters.Username = toUnmarshal.Username
+	parameters.Password = toUnmarshal.Password
+	parameters.Code = toUnmarshal.Code
+
+	if !parameters.Username.Valid || !parameters.Password.Valid {
+		return loginParametersError{
+			Username: !parameters.Username.Valid,
+			Password: !parameters.Password.Valid,
+		}
+	}
+
+	return nil
+}
+
+type loginResponse struct {
+	Token     uuid.UUID `json:"token"`
+	TokenType string    `json:"tokenType"`
+	Scope     string    `json:"scope"`
+	End       time.Time `json:"end"`
+}
+
+func handleLogin(database *pg.DB, keyring *keyring, settings Settings) http.HandlerFunc {
+	// Unknown users and users without a password are checked against this hash so that a failed login takes the same
+	// amount of time no matter why it failed.
+	dummyPassword, err := generatePassword()
+	if err != nil {
+		log.Panicf("Unable to generate dummy password: %s", err.Error())
+	}
+	dummyPasswordHash, err := hashPassword(dummyPassword, settings.PasswordParameters)
+	if err != nil {
+		log.Panicf("Unable to hash dummy password: %s", err.Error())
+	}
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var parameters loginParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for login: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		passwordHash := dummyPasswordHash
+		user, err := getUserByUsername(database, parameters.Username.String)
+		canLogin := err == nil && user.PasswordHash != "" && user.Kind.policy().interactiveLogin && user.Status == ActiveUser
+		if canLogin {
+			passwordHash = user.PasswordHash
+		}
+		if err == nil {
+			setAuditTarget(request, auditUserTarget(user.Id))
+		}
+
+		if !verifyPassword(parameters.Password.String, passwordHash) || !canLogin {
+			http.Error(writer, "Invalid username or password", http.StatusUnauthorized)
+
+			return
+		}
+
+		// Sessions carry the user's default scopes, so those are what MFA requirements are checked against
+		scope := joinScopes(user.DefaultScopes)
+		enrollment, err := getTotpEnrollment(database, user.Id)
+		if err != nil {
+			response := fmt.Sprintf("Error getting TOTP enrollment: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if enrollment != nil && enrollment.Confirmed {
+			// TOTP secrets are encrypted, so users with a second factor can't log in until creds is unsealed
+			if keyring.isSealed() {
+				http.Error(writer, sealedResponse, http.StatusServiceUnavailable)
+
+				return
+			}
+
+			verified, err := verifySecondFactor(database, keyring, enrollment, parameters.Code.String)
+			if err != nil {
+				response := fmt.Sprintf("Unable to verify second factor: %s", err.Error())
+				http.Error(writer, response, http.StatusInternalServerError)
+
+				return
+			}
+
+			if !verified {
+				http.Error(writer, "Invalid or missing second factor", http.StatusUnauthorized)
+
+				return
+			}
+		} else if requiresMfa(scope, settings.MfaRequiredScopes) {
+			http.Error(writer, "MFA enrollment is required for this user before logging in", http.StatusForbidden)
+
+			return
+		}
+
+		if passwordHashNeedsUpgrade(user.PasswordHash, settings.PasswordParameters) {
+			if upgradedHash, err := hashPassword(parameters.Password.String, settings.PasswordParameters); err == nil {
+				if _, err := setUserPasswordHash(database, user.Id, upgradedHash); err != nil {
+					fmt.Printf("Unable to upgrade password hash for user '%s': %s\n", user.Id, err.Error())
+				}
+			}
+		}
+
+		start := time.Now()
+		end := start.Add(settings.SessionLifetime)
+		binding := tokenBinding{}
+		if settings.BindSessionsToCertificates {
+			binding.certificateThumbprint = requestCertificateThumbprint(request)
+		}
+		if len(request.Header.Values("DPoP")) != 0 {
+			proof, err := verifyRequestDpopProof(database, request, "")
+			if err != nil {
+				response := fmt.Sprintf("Unable to bind session token to DPoP key: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+			binding.jwkThumbprint = proof.thumbprint
+		}
+		tokenId, err := createToken(database, user.Id, scope, start, end, binding)
+		if err != nil {
+			response := fmt.Sprintf("Unable to create session token: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if err := json.NewEncoder(writer).Encode(loginResponse{
+			Token:     tokenId,
+			TokenType: binding.tokenType(),
+			Scope:     scope,
+			End:       end,
+		}); err != nil {
+			fmt.Printf("Couldn't write session token '%s' for request", tokenId)
+		}
+	}
+}
+
+type setPasswordParameters struct {
+	Password null.String
+}
+
+func handleSetPassword(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		var parameters setPasswordParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for setting password: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if len(parameters.Password.String) < minimumPasswordLength {
+			http.Error(writer, PasswordTooShortError{}.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		setPassword(writer, database, id, parameters.Password.String, settings)
+	}
+}
+
+type resetPasswordResponse struct {
+	Password string `json:"password"`
+}
+
+func handleResetPassword(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		password, err := generatePassword()
+		if err != nil {
+			response := fmt.Sprintf("Unable to generate password: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if !setPassword(writer, database, id, password, settings) {
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(resetPasswordResponse{Password: password})
+	}
+}
+
+func handleClearPassword(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		found, err := setUserPasswordHash(database, id, "")
+		if err != nil {
+			response := fmt.Sprintf("Unable to clear password: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if !found {
+			response := fmt.Sprintf("User with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
+
+// Hashes and stores a password for a user, writing an error response and returning `false` if that isn't possible.
+func setPassword(writer http.ResponseWriter, database *pg.DB, id uuid.UUID, password string, settings Settings) bool {
+	user, err := getUserById(database, id)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			response := fmt.Sprintf("User with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return false
+		}
+		response := fmt.Sprintf("Error getting user: %s", err.Error())
+		http.Error(writer, response, http.StatusInternalServerError)
+
+		return false
+	}
+
+	if !user.Kind.policy().interactiveLogin {
+		response := fmt.Sprintf("Users of kind '%s' can't have passwords", user.Kind)
+		http.Error(writer, response, http.StatusBadRequest)
+
+		return false
+	}
+
+	passwordHash, err := hashPassword(password, settings.PasswordParameters)
+	if err != nil {
+		response := fmt.Sprintf("Unable to hash password: %s", err.Error())
+		http.Error(writer, response, http.StatusInternalServerError)
+
+		return false
+	}
+
+	if _, err := setUserPasswordHash(database, id, passwordHash); err != nil {
+		response := fmt.Sprintf("Unable to set password: %s", err.Error())
+		http.Error(writer, response, http.StatusInternalServerError)
+
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,70 @@
+package creds
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/go-pg/pg/v10"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+// Whether a request body is a JSON Merge Patch (RFC 7396). Plain JSON is accepted as well, as is a missing type.
+func isMergePatch(request *http.Request) bool {
+	contentType := request.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && (mediaType == mergePatchType || mediaType == "application/json")
+}
+
+// The first field of a patch that isn't one of `patchable`, if there is one
+func unknownPatchField(patch map[string]json.RawMessage, patchable []string) string {
+	for field := range patch {
+		known := false
+		for _, patchableField := range patchable {
+			known = known || field == patchableField
+		}
+		if !known {
+			return field
+		}
+	}
+
+	return ""
+}
+
+func isNullPatchValue(value json.RawMessage) bool {
+	return string(value) == "null"
+}
+
+// Describes the fields a patch changed as they were and as they are now, for the audit log
+func changeDetail(fields []string, before map[string]interface{}, after map[string]interface{}) (string, error) {
+	change := struct {
+		Before map[string]interface{} `json:"before"`
+		After  map[string]interface{} `json:"after"`
+	}{Before: make(map[string]interface{}), After: make(map[string]interface{})}
+	for _, field := range fields {
+		if !reflect.DeepEqual(before[field], after[field]) {
+			change.Before[field] = before[field]
+			change.After[field] = after[field]
+		}
+	}
+
+	bytes, err := json.Marshal(change)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+func isUniqueViolation(err error) bool {
+	pgErr, ok := err.(pg.Error)
+
+	return ok && pgErr.Field('C') == "23505"
+}
@@ -0,0 +1,69 @@
+package creds
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+type ClientCertificateMode string
+
+const (
+	NoClientCertificates      ClientCertificateMode = "none"
+	AcceptClientCertificates  ClientCertificateMode = "accept"
+	RequireClientCertificates ClientCertificateMode = "require"
+)
+
+// The `x5t#S256` confirmation value from RFC 8705: the base64url encoded SHA-256 hash of the DER certificate
+func certificateThumbprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Thumbprint of the verified client certificate the request was made with, or an empty string if there was none
+func requestCertificateThumbprint(request *http.Request) string {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return certificateThumbprint(request.TLS.PeerCertificates[0])
+}
+
+func (mode ClientCertificateMode) isValid() bool {
+	return mode == NoClientCertificates || mode == AcceptClientCertificates || mode == RequireClientCertificates
+}
+
+func createTlsConfig(settings Settings) (*tls.Config, error) {
+	if !settings.ClientCertificateMode.isValid() {
+		return nil, fmt.Errorf("unknown client certificate mode '%s'", settings.ClientCertificateMode)
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ClientAuth: tls.NoClientCert}
+	if settings.ClientCertificateMode == NoClientCertificates {
+		return config, nil
+	}
+
+	caBytes, err := ioutil.ReadFile(settings.ClientCaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in '%s'", settings.ClientCaFile)
+	}
+	config.ClientCAs = pool
+
+	if settings.ClientCertificateMode == RequireClientCertificates {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
@@ -0,0 +1,396 @@
+package creds
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+)
+
+type EventType string
+
+const (
+	UserCreatedEvent       EventType = "user.created"
+	UserUpdatedEvent       EventType = "user.updated"
+	UserDeletedEvent       EventType = "user.deleted"
+	UserStatusChangedEvent EventType = "user.status-changed"
+	TokenCreatedEvent      EventType = "token.created"
+	TokenUpdatedEvent      EventType = "token.updated"
+	TokenDeletedEvent      EventType = "token.deleted"
+	TokenExpiringEvent     EventType = "token.expiring"
+)
+
+var eventTypes = []EventType{
+	UserCreatedEvent,
+	UserUpdatedEvent,
+	UserDeletedEvent,
+	UserStatusChangedEvent,
+	TokenCreatedEvent,
+	TokenUpdatedEvent,
+	TokenDeletedEvent,
+	TokenExpiringEvent,
+}
+
+// A domain event, written in the same transaction as the change it describes so that it exists exactly when the
+// change has committed. The relay publishes events in order per aggregate, at least once; consumers deduplicate on
+// `id`.
+type OutboxEvent struct {
+	tableName struct{} `pg:"outbox"`
+
+	Sequence      int64           `json:"-" pg:",pk"`
+	Id            uuid.UUID       `json:"id" pg:"type:uuid,notnull,unique"`
+	Type          EventType       `json:"type" pg:",notnull"`
+	AggregateType string          `json:"aggregateType" pg:",notnull"`
+	AggregateId   string          `json:"aggregateId" pg:",notnull"`
+	Data          json.RawMessage `json:"data" pg:"type:jsonb,notnull"`
+	OccurredAt    time.Time       `json:"occurredAt" pg:",notnull"`
+	PublishedAt   time.Time       `json:"-"`
+	ClaimedUntil  time.Time       `json:"-"`
+	Attempts      int             `json:"-" pg:",use_zero,notnull"`
+	LastError     string          `json:"-"`
+}
+
+// Event data knows which aggregate the event belongs to, which is what ordering is kept within
+type eventData interface {
+	aggregate() (string, string)
+}
+
+// What token events carry; tokens are bearer credentials, so only their fingerprint is sent
+type tokenEventData struct {
+	Token  string    `json:"token"`
+	UserId uuid.UUID `json:"userId,omitempty"`
+	Scope  string    `json:"scope,omitempty"`
+	Start  time.Time `json:"start,omitempty"`
+	End    time.Time `json:"end,omitempty"`
+}
+
+func (data tokenEventData) aggregate() (string, string) {
+	return "token", data.Token
+}
+
+type userEventData struct {
+	UserId uuid.UUID  `json:"userId"`
+	Name   string     `json:"name,omitempty"`
+	Kind   UserKind   `json:"kind,omitempty"`
+	Status UserStatus `json:"status,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+func (data userEventData) aggregate() (string, string) {
+	return "user", data.UserId.String()
+}
+
+// Adds an event to the outbox; `database` should be the transaction making the change the event is about
+func recordEvent(database orm.DB, eventType EventType, data eventData) error {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	aggregateType, aggregateId := data.aggregate()
+	event := OutboxEvent{
+		Id:            uuid.New(),
+		Type:          eventType,
+		AggregateType: aggregateType,
+		AggregateId:   aggregateId,
+		Data:          encodedData,
+		OccurredAt:    time.Now(),
+	}
+	_, err = database.Model(&event).Insert()
+
+	return err
+}
+
+// Somewhere events are published to. Sinks are handed events one at a time and in order.
+type outboxSink interface {
+	publish(event OutboxEvent, payload []byte) error
+}
+
+type stdoutSink struct{}
+
+func (sink stdoutSink) publish(event OutboxEvent, payload []byte) error {
+	_, err := fmt.Fprintf(os.Stdout, "%s\n", payload)
+
+	return err
+}
+
+// Appends events to a file as newline delimited JSON
+type fileSink struct {
+	path string
+}
+
+func (sink fileSink) publish(event OutboxEvent, payload []byte) error {
+	file, err := os.OpenFile(sink.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(file, "%s\n", payload); err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+type httpSink struct {
+	url string
+}
+
+func (sink httpSink) publish(event OutboxEvent, payload []byte) error {
+	request, err := http.NewRequest("POST", sink.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Creds-Event-Id", event.Id.String())
+	request.Header.Set("Creds-Event-Type", string(event.Type))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", sink.url, response.StatusCode)
+	}
+
+	return nil
+}
+
+// Publishes to a NATS subject over the plain text core protocol. Each publish is followed by a PING so that it isn't
+// considered published until the server has processed it.
+type natsSink struct {
+	address    string
+	subject    string
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+const natsTimeout = 10 * time.Second
+
+func (sink *natsSink) connect() error {
+	connection, err := net.DialTimeout("tcp", sink.address, natsTimeout)
+	if err != nil {
+		return err
+	}
+	_ = connection.SetDeadline(time.Now().Add(natsTimeout))
+
+	reader := bufio.NewReader(connection)
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		_ = connection.Close()
+
+		return fmt.Errorf("%s isn't a NATS server", sink.address)
+	}
+
+	if _, err := fmt.Fprintf(connection, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"creds\"}\r\n"); err != nil {
+		_ = connection.Close()
+
+		return err
+	}
+
+	sink.connection = connection
+	sink.reader = reader
+
+	return nil
+}
+
+func (sink *natsSink) disconnect() {
+	if sink.connection != nil {
+		_ = sink.connection.Close()
+	}
+	sink.connection = nil
+	sink.reader = nil
+}
+
+func (sink *natsSink) publish(event OutboxEvent, payload []byte) error {
+	if sink.connection == nil {
+		if err := sink.connect(); err != nil {
+			return err
+		}
+	}
+	_ = sink.connection.SetDeadline(time.Now().Add(natsTimeout))
+
+	if _, err := fmt.Fprintf(sink.connection, "PUB %s %d\r\n%s\r\nPING\r\n", sink.subject, len(payload), payload); err != nil {
+		sink.disconnect()
+
+		return err
+	}
+
+	for {
+		line, err := sink.reader.ReadString('\n')
+		if err != nil {
+			sink.disconnect()
+
+			return err
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := fmt.Fprintf(sink.connection, "PONG\r\n"); err != nil {
+				sink.disconnect()
+
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			sink.disconnect()
+
+			return fmt.Errorf("NATS server responded with %s", line)
+		}
+	}
+}
+
+// Sinks are given as `stdout`, `file:<path>`, `http(s)://<url>` or `nats://<host>:<port>/<subject>`
+func parseOutboxSinks(specifications []string) ([]outboxSink, error) {
+	sinks := make([]outboxSink, 0, len(specifications))
+	for _, specification := range specifications {
+		switch {
+		case specification == "stdout":
+			sinks = append(sinks, stdoutSink{})
+		case strings.HasPrefix(specification, "file:"):
+			sinks = append(sinks, fileSink{path: strings.TrimPrefix(specification, "file:")})
+		case strings.HasPrefix(specification, "http://") || strings.HasPrefix(specification, "https://"):
+			sinks = append(sinks, httpSink{url: specification})
+		case strings.HasPrefix(specification, "nats://"):
+			address, subject := "", ""
+			if natsUrl, err := url.Parse(specification); err == nil {
+				address, subject = natsUrl.Host, strings.TrimPrefix(natsUrl.Path, "/")
+			}
+			if address == "" || subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+				return nil, fmt.Errorf("NATS sinks look like 'nats://<host>:<port>/<subject>', got '%s'", specification)
+			}
+			sinks = append(sinks, &natsSink{address: address, subject: subject})
+		default:
+			return nil, fmt.Errorf("unknown outbox sink '%s'", specification)
+		}
+	}
+
+	return sinks, nil
+}
+
+// Arbitrary key for the advisory lock that makes instances take turns claiming events
+const outboxLockKey = 7411390426
+
+// Most events published per run
+const outboxBatchSize = 100
+
+// How long a claimed event is left to its instance. Sinks give up after about 10 seconds each, so this leaves
+// plenty of room for an event to go through all of them; a claim running out lets another instance publish it.
+const outboxClaimDuration = 5 * time.Minute
+
+// How long an aggregate waits after one of its events couldn't be published
+const outboxRetryDelay = 10 * time.Second
+
+// How long published events are kept around for
+const outboxRetention = 7 * 24 * time.Hour
+
+type outboxRelay struct {
+	database *pg.DB
+	sinks    []outboxSink
+}
+
+func newOutboxRelay(database *pg.DB, sinks []outboxSink) *outboxRelay {
+	return &outboxRelay{database: database, sinks: sinks}
+}
+
+func (relay *outboxRelay) publish(event OutboxEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, sink := range relay.sinks {
+		if err := sink.publish(event, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Claims the earliest event that is next in line for its aggregate, skipping aggregates whose next event is
+// claimed or waiting to be retried. Returns `nil` when there's nothing to publish.
+func (relay *outboxRelay) claim() (*OutboxEvent, error) {
+	events := make([]OutboxEvent, 0, 1)
+	err := relay.database.RunInTransaction(relay.database.Context(), func(transaction *pg.Tx) error {
+		if _, err := transaction.Exec("SELECT pg_advisory_xact_lock(?)", outboxLockKey); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		_, err := transaction.Query(&events, `
+			UPDATE outbox SET claimed_until = ?
+			WHERE sequence IN (
+				SELECT sequence FROM outbox head
+				WHERE published_at IS NULL AND (claimed_until IS NULL OR claimed_until <= ?)
+				AND NOT EXISTS (
+					SELECT 1 FROM outbox earlier
+					WHERE earlier.aggregate_type = head.aggregate_type AND earlier.aggregate_id = head.aggregate_id
+					AND earlier.published_at IS NULL AND earlier.sequence < head.sequence
+				)
+				ORDER BY sequence
+				LIMIT 1
+			)
+			RETURNING *`,
+			now.Add(outboxClaimDuration), now,
+		)
+
+		return err
+	})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+
+	return &events[0], nil
+}
+
+// Publishes unpublished events in the order they were recorded, one claimed event at a time so that no
+// transaction is held open while sinks are called. When an event can't be published, later events of the same
+// aggregate wait for it while other aggregates carry on.
+func (relay *outboxRelay) relay() {
+	for published := 0; published < outboxBatchSize; published++ {
+		event, err := relay.claim()
+		if err != nil {
+			fmt.Printf("Unable to claim outbox event: %s\n", err.Error())
+
+			return
+		}
+		if event == nil {
+			break
+		}
+
+		query := relay.database.Model(event).WherePK()
+		if err := relay.publish(*event); err != nil {
+			query = query.
+				Set("attempts = attempts + 1").
+				Set("last_error = ?", err.Error()).
+				Set("claimed_until = ?", time.Now().Add(outboxRetryDelay))
+		} else {
+			query = query.Set("published_at = ?", time.Now()).Set("claimed_until = NULL")
+		}
+		if _, err := query.Update(); err != nil {
+			fmt.Printf("Unable to update outbox event '%s': %s\n", event.Id, err.Error())
+		}
+	}
+
+	if _, err := relay.database.Model((*OutboxEvent)(nil)).
+		Where("published_at < ?", time.Now().Add(-outboxRetention)).
+		Delete(); err != nil {
+		fmt.Printf("Unable to clean up outbox events: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,214 @@
+package creds
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+func TestParseOutboxSinks(t *testing.T) {
+	sinks, err := parseOutboxSinks([]string{"stdout", "file:/tmp/events", "https://example.com/events", "nats://localhost:4222/creds.events"})
+	if err != nil || len(sinks) != 4 {
+		log.Panicf("Unable to parse sinks: %v", err)
+	}
+
+	nats, ok := sinks[3].(*natsSink)
+	if !ok || nats.address != "localhost:4222" || nats.subject != "creds.events" {
+		log.Panicf("Unexpected NATS sink: %+v", sinks[3])
+	}
+
+	for _, invalid := range []string{"kafka://localhost", "nats://localhost:4222", "nats:///subject"} {
+		if _, err := parseOutboxSinks([]string{invalid}); err == nil {
+			log.Panicf("Invalid sink '%s' was accepted", invalid)
+		}
+	}
+}
+
+func TestEventAggregates(t *testing.T) {
+	tokenId := uuid.New()
+	if aggregateType, aggregateId := (tokenEventData{Token: tokenFingerprint(tokenId)}).aggregate(); aggregateType != "token" ||
+		aggregateId != tokenFingerprint(tokenId) {
+		log.Panicf("Token events aren't grouped by token fingerprint: %s %s", aggregateType, aggregateId)
+	}
+
+	userId := uuid.New()
+	if aggregateType, aggregateId := (userEventData{UserId: userId}).aggregate(); aggregateType != "user" ||
+		aggregateId != userId.String() {
+		log.Panicf("User events aren't grouped by user: %s %s", aggregateType, aggregateId)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	directory, err := ioutil.TempDir("", "creds-outbox")
+	if err != nil {
+		log.Panicf("Unable to create directory: %s", err.Error())
+	}
+	defer os.RemoveAll(directory)
+
+	sink := fileSink{path: filepath.Join(directory, "events.ndjson")}
+	for _, payload := range []string{`{"n":1}`, `{"n":2}`} {
+		if err := sink.publish(OutboxEvent{}, []byte(payload)); err != nil {
+			log.Panicf("Unable to publish to file: %s", err.Error())
+		}
+	}
+
+	contents, _ := ioutil.ReadFile(sink.path)
+	if string(contents) != "{\"n\":1}\n{\"n\":2}\n" {
+		log.Panicf("Unexpected file contents: %s", contents)
+	}
+}
+
+func TestNatsSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panicf("Unable to listen: %s", err.Error())
+	}
+	defer listener.Close()
+
+	published := make(chan string, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+
+		_, _ = connection.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		reader := bufio.NewReader(connection)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := reader.ReadString('\n')
+				published <- strings.TrimSpace(line) + " " + strings.TrimSpace(payload)
+			case strings.HasPrefix(line, "PING"):
+				_, _ = connection.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+
+	sink := &natsSink{address: listener.Addr().String(), subject: "creds.events"}
+	if err := sink.publish(OutboxEvent{}, []byte(`{"n":1}`)); err != nil {
+		log.Panicf("Unable to publish to NATS: %s", err.Error())
+	}
+	defer sink.disconnect()
+
+	if message := <-published; message != `PUB creds.events 7 {"n":1}` {
+		log.Panicf("Unexpected message: %s", message)
+	}
+}
+
+// Remembers what it published and fails for the aggregates in `failing`
+type recordingSink struct {
+	failing   map[string]bool
+	published []OutboxEvent
+}
+
+func (sink *recordingSink) publish(event OutboxEvent, payload []byte) error {
+	if sink.failing[event.AggregateId] {
+		return errors.New("sink is down")
+	}
+	sink.published = append(sink.published, event)
+
+	return nil
+}
+
+func TestRecordEventRollback(t *testing.T) {
+	d := initializeTestData(nil)
+
+	rolledBack := uuid.New()
+	err := d.database.RunInTransaction(d.database.Context(), func(transaction *pg.Tx) error {
+		if err := recordEvent(transaction, UserCreatedEvent, userEventData{UserId: rolledBack}); err != nil {
+			return err
+		}
+
+		return errors.New("rolled back")
+	})
+	if err == nil || err.Error() != "rolled back" {
+		log.Panicf("Transaction wasn't rolled back: %v", err)
+	}
+
+	committed := uuid.New()
+	err = d.database.RunInTransaction(d.database.Context(), func(transaction *pg.Tx) error {
+		return recordEvent(transaction, UserCreatedEvent, userEventData{UserId: committed})
+	})
+	if err != nil {
+		log.Panicf("Unable to record event: %s", err.Error())
+	}
+
+	for aggregateId, expected := range map[uuid.UUID]int{rolledBack: 0, committed: 1} {
+		count, err := d.database.Model((*OutboxEvent)(nil)).Where("aggregate_id = ?", aggregateId.String()).Count()
+		if err != nil || count != expected {
+			log.Panicf("Expected %d events for %s, found %d: %v", expected, aggregateId, count, err)
+		}
+	}
+}
+
+func TestOutboxRelayBlocksFailingAggregate(t *testing.T) {
+	d := initializeTestData(nil)
+	if _, err := d.database.Model((*OutboxEvent)(nil)).Where("true").Delete(); err != nil {
+		log.Panicf("Unable to clear outbox: %s", err.Error())
+	}
+
+	// More events for the failing aggregate than are published in a run, recorded before the healthy one's
+	failing, healthy := uuid.New(), uuid.New()
+	for index := 0; index < outboxBatchSize+1; index++ {
+		if err := recordEvent(d.database, UserUpdatedEvent, userEventData{UserId: failing}); err != nil {
+			log.Panicf("Unable to record event: %s", err.Error())
+		}
+	}
+	for _, eventType := range []EventType{UserCreatedEvent, UserUpdatedEvent} {
+		if err := recordEvent(d.database, eventType, userEventData{UserId: healthy}); err != nil {
+			log.Panicf("Unable to record event: %s", err.Error())
+		}
+	}
+
+	sink := &recordingSink{failing: map[string]bool{failing.String(): true}}
+	relay := newOutboxRelay(d.database, []outboxSink{sink})
+	relay.relay()
+
+	if len(sink.published) != 2 || sink.published[0].Type != UserCreatedEvent || sink.published[1].Type != UserUpdatedEvent ||
+		sink.published[0].AggregateId != healthy.String() {
+		log.Panicf("Healthy aggregate wasn't published in order: %+v", sink.published)
+	}
+
+	blocked := make([]OutboxEvent, 0)
+	if err := d.database.Model(&blocked).Where("aggregate_id = ?", failing.String()).Order("sequence").Select(); err != nil {
+		log.Panicf("Unable to get events: %s", err.Error())
+	}
+	if !blocked[0].PublishedAt.IsZero() || blocked[0].Attempts != 1 || blocked[0].LastError == "" ||
+		!blocked[0].ClaimedUntil.After(time.Now()) {
+		log.Panicf("Failed event wasn't held back for a retry: %+v", blocked[0])
+	}
+	for _, event := range blocked[1:] {
+		if !event.PublishedAt.IsZero() || event.Attempts != 0 {
+			log.Panicf("Later event of the failing aggregate was attempted: %+v", event)
+		}
+	}
+
+	// Once the retry is due and the sink is back, the aggregate is published in order
+	if _, err := d.database.Model((*OutboxEvent)(nil)).Set("claimed_until = NULL").Where("true").Update(); err != nil {
+		log.Panicf("Unable to make retry due: %s", err.Error())
+	}
+	sink.failing = nil
+	sink.published = nil
+	relay.relay()
+
+	if len(sink.published) != outboxBatchSize || sink.published[0].Id != blocked[0].Id ||
+		sink.published[outboxBatchSize-1].Id != blocked[outboxBatchSize-1].Id {
+		log.Panicf("Blocked aggregate wasn't published in order once the sink recovered: %d events", len(sink.published))
+	}
+}
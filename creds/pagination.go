@@ -0,0 +1,161 @@
+package creds
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+const defaultPageSize = 100
+const maximumPageSize = 1000
+
+// A field lists can be sorted by, ascending or with a `-` prefix descending. Rows with the same value are ordered by
+// id, so the order is stable and every row ends up on exactly one page.
+type sortOrder struct {
+	field      string
+	column     string
+	descending bool
+}
+
+func (order sortOrder) String() string {
+	if order.descending {
+		return "-" + order.field
+	}
+
+	return order.field
+}
+
+// Where the previous page ended. Cursors are opaque to clients; they're only valid with the sort they were made for.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Id    string `json:"i"`
+}
+
+type pageRequest struct {
+	limit int
+	sort  sortOrder
+	after *pageCursor
+}
+
+// Reads `limit`, `sort` and `cursor` from a query. `sortColumns` maps the fields that can be sorted by to columns.
+func parsePageRequest(query url.Values, sortColumns map[string]string, defaultSort string) (pageRequest, error) {
+	page := pageRequest{limit: defaultPageSize}
+
+	if limitString := query.Get("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > maximumPageSize {
+			return page, fmt.Errorf("'limit' has to be between 1 and %d", maximumPageSize)
+		}
+		page.limit = limit
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = defaultSort
+	}
+	page.sort.field = strings.TrimPrefix(sort, "-")
+	page.sort.descending = strings.HasPrefix(sort, "-")
+	column, ok := sortColumns[page.sort.field]
+	if !ok {
+		return page, fmt.Errorf("Can't sort by '%s'", page.sort.field)
+	}
+	page.sort.column = column
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		bytes, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return page, errInvalidCursor
+		}
+
+		after := pageCursor{}
+		if err := json.Unmarshal(bytes, &after); err != nil || after.Sort != page.sort.String() {
+			return page, errInvalidCursor
+		}
+		page.after = &after
+	}
+
+	return page, nil
+}
+
+func (page pageRequest) apply(query *orm.Query) *orm.Query {
+	direction := "ASC"
+	comparison := ">"
+	if page.sort.descending {
+		direction = "DESC"
+		comparison = "<"
+	}
+
+	column := pg.Ident(page.sort.column)
+	if page.after != nil {
+		query = query.Where(fmt.Sprintf("(?, id) %s (?, ?)", comparison), column, page.after.Value, page.after.Id)
+	}
+
+	return query.
+		OrderExpr(fmt.Sprintf("? %s", direction), column).
+		OrderExpr(fmt.Sprintf("id %s", direction)).
+		Limit(page.limit)
+}
+
+// Sort values are kept as text in cursors; timestamps keep their full precision so no row is skipped or repeated
+func sortValue(value interface{}) string {
+	if timestamp, ok := value.(time.Time); ok {
+		return timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	return fmt.Sprint(value)
+}
+
+func (page pageRequest) cursorAfter(value interface{}, id string) string {
+	bytes, _ := json.Marshal(pageCursor{Sort: page.sort.String(), Value: sortValue(value), Id: id})
+
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// Points to the next page with a `Link` header (RFC 8288), keeping everything else about the request as it was
+func setNextPageLink(writer http.ResponseWriter, request *http.Request, cursor string) {
+	query := request.URL.Query()
+	query.Set("cursor", cursor)
+	next := url.URL{Path: request.URL.Path, RawQuery: query.Encode()}
+
+	writer.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+}
+
+func parseCreatedRange(query url.Values) (time.Time, time.Time, error) {
+	createdAfter, err := parseTimeFilter(query, "createdAfter")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	createdBefore, err := parseTimeFilter(query, "createdBefore")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return createdAfter, createdBefore, nil
+}
+
+func applyCreatedRange(query *orm.Query, createdAfter time.Time, createdBefore time.Time) *orm.Query {
+	if !createdAfter.IsZero() {
+		query = query.Where("created_at >= ?", createdAfter)
+	}
+	if !createdBefore.IsZero() {
+		query = query.Where("created_at < ?", createdBefore)
+	}
+
+	return query
+}
+
+// Escapes what `LIKE` would otherwise treat as wildcards
+func likePrefix(prefix string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+	return replacer.Replace(prefix) + "%"
+}
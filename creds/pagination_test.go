@@ -0,0 +1,118 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestParsePageRequest(t *testing.T) {
+	page, err := parsePageRequest(url.Values{}, userSortColumns, "username")
+	if err != nil {
+		log.Panicf("Unable to parse empty page request: %s", err.Error())
+	}
+	if page.limit != defaultPageSize || page.sort.column != "username" || page.sort.descending || page.after != nil {
+		log.Panicf("Unexpected defaults: %+v", page)
+	}
+
+	page, err = parsePageRequest(url.Values{"sort": {"-createdAt"}, "limit": {"10"}}, userSortColumns, "username")
+	if err != nil {
+		log.Panicf("Unable to parse page request: %s", err.Error())
+	}
+	if page.limit != 10 || page.sort.column != "created_at" || !page.sort.descending {
+		log.Panicf("Unexpected page request: %+v", page)
+	}
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)
+	cursor := page.cursorAfter(createdAt, "cb5ec3a4-3f4b-4f1e-8c63-23ec0c3c0c8e")
+	next, err := parsePageRequest(url.Values{"sort": {"-createdAt"}, "cursor": {cursor}}, userSortColumns, "username")
+	if err != nil {
+		log.Panicf("Unable to parse cursor: %s", err.Error())
+	}
+	if next.after.Value != "2024-05-01T12:00:00.123456Z" || next.after.Id != "cb5ec3a4-3f4b-4f1e-8c63-23ec0c3c0c8e" {
+		log.Panicf("Cursor didn't round trip: %+v", next.after)
+	}
+
+	invalidQueries := []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"100000"}},
+		{"sort": {"password"}},
+		{"cursor": {"not a cursor"}},
+		// Cursors only make sense with the sort they were made for
+		{"sort": {"createdAt"}, "cursor": {cursor}},
+	}
+	for _, query := range invalidQueries {
+		if _, err := parsePageRequest(query, userSortColumns, "username"); err == nil {
+			log.Panicf("Invalid page request parsed: %v", query)
+		}
+	}
+}
+
+func TestSetNextPageLink(t *testing.T) {
+	request := httptest.NewRequest("GET", "/users?kind=human&cursor=old", nil)
+	recorder := httptest.NewRecorder()
+
+	setNextPageLink(recorder, request, "new")
+
+	if link := recorder.Header().Get("Link"); link != `</users?cursor=new&kind=human>; rel="next"` {
+		log.Panicf("Unexpected link: %s", link)
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	if prefix := likePrefix(`50%_off\`); prefix != `50\%\_off\\%` {
+		log.Panicf("Wildcards not escaped: %s", prefix)
+	}
+}
+
+func TestPagingUsers(t *testing.T) {
+	setup := initializeTestData(nil)
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	for _, username := range []string{"page-c", "page-a", "page-b", "other"} {
+		if _, err := insertUser(setup.database, username, username); err != nil {
+			log.Panicf("Unable to add user: %s", err.Error())
+		}
+	}
+
+	usernames := make([]string, 0)
+	next := "/users?usernamePrefix=page-&limit=2&includeTokens=false"
+	for next != "" {
+		withRecorder("GET",
+			next,
+			nil,
+			[]headerEntry{bearerToken(setup.adminToken)},
+			router,
+			func(recorder *httptest.ResponseRecorder, request *http.Request) {
+				if recorder.Code != http.StatusOK {
+					log.Panicf("Bad status code for listing users: %d", recorder.Code)
+				}
+
+				users := make([]User, 0)
+				if err := json.NewDecoder(recorder.Body).Decode(&users); err != nil {
+					log.Panicf("Unable to decode response into `[]User`: %s", err.Error())
+				}
+				for _, user := range users {
+					usernames = append(usernames, user.Username)
+				}
+
+				next = ""
+				if link := recorder.Header().Get("Link"); link != "" {
+					next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+				}
+			})
+	}
+
+	if fmt.Sprint(usernames) != "[page-a page-b page-c]" {
+		log.Panicf("Unexpected users across pages: %v", usernames)
+	}
+}
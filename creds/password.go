@@ -0,0 +1,119 @@
+package creds
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters; `Memory` is in KiB. Hashes are stored in the PHC string format so that the parameters used
+// for each hash are known when verifying it and old hashes can be upgraded on login.
+type PasswordParameters struct {
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+var defaultPasswordParameters = PasswordParameters{
+	Time:       3,
+	Memory:     64 * 1024,
+	Threads:    2,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+const minimumPasswordLength = 12
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+type PasswordTooShortError struct{}
+
+func (passwordTooShortError PasswordTooShortError) Error() string {
+	return fmt.Sprintf("Password has to be at least %d characters long", minimumPasswordLength)
+}
+
+func hashPassword(password string, parameters PasswordParameters) (string, error) {
+	salt := make([]byte, parameters.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, parameters.Time, parameters.Memory, parameters.Threads, parameters.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		parameters.Memory,
+		parameters.Time,
+		parameters.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func decodePasswordHash(hash string) (PasswordParameters, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return PasswordParameters{}, nil, nil, errInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return PasswordParameters{}, nil, nil, errInvalidPasswordHash
+	}
+
+	parameters := PasswordParameters{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parameters.Memory, &parameters.Time, &parameters.Threads); err != nil {
+		return PasswordParameters{}, nil, nil, errInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return PasswordParameters{}, nil, nil, errInvalidPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return PasswordParameters{}, nil, nil, errInvalidPasswordHash
+	}
+
+	parameters.SaltLength = uint32(len(salt))
+	parameters.KeyLength = uint32(len(key))
+
+	return parameters, salt, key, nil
+}
+
+func verifyPassword(password string, hash string) bool {
+	parameters, salt, key, err := decodePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, parameters.Time, parameters.Memory, parameters.Threads, parameters.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, candidate) == 1
+}
+
+func passwordHashNeedsUpgrade(hash string, parameters PasswordParameters) bool {
+	hashParameters, _, _, err := decodePasswordHash(hash)
+	if err != nil {
+		return true
+	}
+
+	return hashParameters != parameters
+}
+
+func generatePassword() (string, error) {
+	bytes := make([]byte, 18)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
@@ -0,0 +1,33 @@
+package creds
+
+import (
+	"log"
+	"testing"
+)
+
+func TestHashAndVerifyPassword(t *testing.T) {
+	parameters := PasswordParameters{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}
+
+	hash, err := hashPassword("correct horse battery staple", parameters)
+	if err != nil {
+		log.Panicf("Unable to hash password: %s", err.Error())
+	}
+
+	if !verifyPassword("correct horse battery staple", hash) {
+		log.Panicf("Correct password does not verify against hash '%s'", hash)
+	}
+
+	if verifyPassword("incorrect horse battery staple", hash) {
+		log.Panicf("Incorrect password verifies against hash '%s'", hash)
+	}
+
+	if passwordHashNeedsUpgrade(hash, parameters) {
+		log.Panicf("Hash '%s' needs upgrade with the parameters it was created with", hash)
+	}
+
+	upgradedParameters := parameters
+	upgradedParameters.Time = 2
+	if !passwordHashNeedsUpgrade(hash, upgradedParameters) {
+		log.Panicf("Hash '%s' doesn't need upgrade with changed parameters", hash)
+	}
+}
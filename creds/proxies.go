@@ -0,0 +1,86 @@
+package creds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reverse proxies whose `X-Forwarded-Proto` and `X-Forwarded-Host` headers are trusted. Anyone else could put any URL
+// in them, so they're ignored for requests that don't come from one of these.
+type trustedProxies []*net.IPNet
+
+type forwardedContextKey struct{}
+
+// Where a trusted proxy says a request was made to
+type forwardedTarget struct {
+	scheme string
+	host   string
+}
+
+// Parses proxies given as CIDRs or single addresses
+func parseTrustedProxies(specifications []string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0, len(specifications))
+	for _, specification := range specifications {
+		if !strings.Contains(specification, "/") {
+			ip := net.ParseIP(specification)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", specification)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(specification)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %s", specification, err.Error())
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func (proxies trustedProxies) trusts(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keeps what the forwarding headers of a trusted proxy say about a request for `requestHtu`
+func (proxies trustedProxies) withForwardedTarget(request *http.Request) *http.Request {
+	if !proxies.trusts(request) {
+		return request
+	}
+
+	target := forwardedTarget{
+		scheme: request.Header.Get("X-Forwarded-Proto"),
+		host:   request.Header.Get("X-Forwarded-Host"),
+	}
+	if target.scheme == "" && target.host == "" {
+		return request
+	}
+
+	return request.WithContext(context.WithValue(request.Context(), forwardedContextKey{}, target))
+}
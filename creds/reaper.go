@@ -0,0 +1,176 @@
+package creds
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+type ArchiveReason string
+
+const (
+	ExpiredToken ArchiveReason = "expired"
+	RevokedToken ArchiveReason = "revoked"
+)
+
+// A token that is no longer usable, kept so it's still known who held what. Tokens end up here when they're
+// revoked, or from the reaper once they've been expired for longer than the retention period.
+type ArchivedToken struct {
+	Id                    uuid.UUID         `json:"id" pg:"type:uuid,pk"`
+	Scope                 string            `json:"scope" pg:",notnull"`
+	UserId                uuid.UUID         `json:"userId" pg:"type:uuid,notnull"`
+	Start                 time.Time         `json:"start" pg:",notnull"`
+	End                   time.Time         `json:"end" pg:",notnull"`
+	CertificateThumbprint string            `json:"x5t#S256,omitempty"`
+	JwkThumbprint         string            `json:"jkt,omitempty"`
+	Metadata              map[string]string `json:"metadata,omitempty" pg:"type:jsonb"`
+	ArchivedAt            time.Time         `json:"archivedAt" pg:",notnull"`
+	Reason                ArchiveReason     `json:"reason" pg:",notnull"`
+}
+
+func archiveToken(token Token, reason ArchiveReason) ArchivedToken {
+	return ArchivedToken{
+		Id:                    token.Id,
+		Scope:                 token.Scope,
+		UserId:                token.UserId,
+		Start:                 token.Start,
+		End:                   token.End,
+		CertificateThumbprint: token.CertificateThumbprint,
+		JwkThumbprint:         token.JwkThumbprint,
+		Metadata:              token.Metadata,
+		ArchivedAt:            time.Now(),
+		Reason:                reason,
+	}
+}
+
+// Archives a user's tokens as revoked, ahead of the user being deleted
+func archiveUserTokens(transaction *pg.Tx, userId uuid.UUID) error {
+	_, err := transaction.Exec(`
+		INSERT INTO archived_tokens
+			(id, scope, user_id, start, "end", certificate_thumbprint, jwk_thumbprint, metadata, archived_at, reason)
+		SELECT id, scope, user_id, start, "end", certificate_thumbprint, jwk_thumbprint, metadata, ?, ?
+		FROM tokens WHERE user_id = ?`,
+		time.Now(), RevokedToken, userId,
+	)
+
+	return err
+}
+
+// Published at `/debug/vars`, see `handleGetDebugVars`
+var (
+	reaperRuns              = expvar.NewInt("reaper_runs")
+	reaperArchivedTokens    = expvar.NewInt("reaper_archived_tokens")
+	reaperDryRunCandidates  = expvar.NewInt("reaper_dry_run_candidates")
+	reaperLastRunArchived   = expvar.NewInt("reaper_last_run_archived")
+	reaperLastRunTimestamp  = expvar.NewInt("reaper_last_run_timestamp")
+	reaperSkippedWhenLocked = expvar.NewInt("reaper_skipped_when_locked")
+)
+
+// Arbitrary key for the advisory lock that keeps instances from reaping at the same time
+const reaperLockKey = 7411390427
+
+const reaperBatchSize = 1000
+
+// Moves a batch of tokens that ended before `cutoff` into the archive, returning how many were moved and whether
+// the lock was held by another instance. In a dry run nothing is moved and the number of candidates is returned.
+func reapTokenBatch(database *pg.DB, cutoff time.Time, dryRun bool) (int, bool, error) {
+	reaped := 0
+	lockedElsewhere := false
+	err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		locked := false
+		if _, err := transaction.QueryOne(pg.Scan(&locked), "SELECT pg_try_advisory_xact_lock(?)", reaperLockKey); err != nil {
+			return err
+		}
+		if !locked {
+			lockedElsewhere = true
+
+			return nil
+		}
+
+		if dryRun {
+			count, err := transaction.Model((*Token)(nil)).Where(`"end" < ?`, cutoff).Count()
+			reaped = count
+
+			return err
+		}
+
+		result, err := transaction.Exec(`
+			WITH moved AS (
+				DELETE FROM tokens WHERE id IN (
+					SELECT id FROM tokens WHERE "end" < ? ORDER BY "end" LIMIT ? FOR UPDATE SKIP LOCKED
+				)
+				RETURNING *
+			)
+			INSERT INTO archived_tokens
+				(id, scope, user_id, start, "end", certificate_thumbprint, jwk_thumbprint, metadata, archived_at, reason)
+			SELECT id, scope, user_id, start, "end", certificate_thumbprint, jwk_thumbprint, metadata, ?, ?
+			FROM moved`,
+			cutoff, reaperBatchSize, time.Now(), ExpiredToken,
+		)
+		if err != nil {
+			return err
+		}
+		reaped = result.RowsAffected()
+
+		return nil
+	})
+
+	return reaped, lockedElsewhere, err
+}
+
+// Archives every token that has been expired for longer than `retention`
+func reapTokens(database *pg.DB, retention time.Duration, dryRun bool) (int, error) {
+	cutoff := time.Now().Add(-retention)
+	total := 0
+	for {
+		reaped, lockedElsewhere, err := reapTokenBatch(database, cutoff, dryRun)
+		total += reaped
+		if err != nil || lockedElsewhere || dryRun || reaped < reaperBatchSize {
+			if lockedElsewhere {
+				reaperSkippedWhenLocked.Add(1)
+			}
+
+			return total, err
+		}
+	}
+}
+
+func runTokenReaper(database *pg.DB, settings Settings) {
+	reaped, err := reapTokens(database, settings.TokenRetention, settings.TokenReaperDryRun)
+
+	reaperRuns.Add(1)
+	reaperLastRunTimestamp.Set(time.Now().Unix())
+	if settings.TokenReaperDryRun {
+		reaperDryRunCandidates.Set(int64(reaped))
+		fmt.Printf("Token reaper dry run: %d tokens would be archived\n", reaped)
+	} else {
+		reaperArchivedTokens.Add(int64(reaped))
+		reaperLastRunArchived.Set(int64(reaped))
+	}
+
+	if err != nil {
+		fmt.Printf("Unable to reap expired tokens: %s\n", err.Error())
+	}
+}
+
+// The process' command line and memory statistics are published next to the counters, so they're only for admins
+func handleGetDebugVars(database *pg.DB, adminScope string) http.HandlerFunc {
+	debugVars := expvar.Handler()
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		debugVars.ServeHTTP(writer, request)
+	}
+}
@@ -1,24 +1,129 @@
 package creds
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/julienschmidt/httprouter"
 )
 
-func setupRoutes(router *httprouter.Router, database *pg.DB, adminScope string) {
+// Sets up every route, returning the keyring and lease manager they share so background jobs can use the same seal
+// state and engine mounts
+func setupRoutes(router *httprouter.Router, database *pg.DB, adminScope string, settings Settings) (*keyring, *leaseManager) {
+	keyring := newKeyring(settings.MasterKey)
+	if err := keyring.loadSeal(database); err != nil {
+		log.Panicf("Unable to load seal configuration: %s", err.Error())
+	}
+	keyStore := newKeyStore(database, keyring)
+	engineRegistry := newDefaultEngineRegistry(database, settings)
+	leaseManager := newLeaseManager(database, engineRegistry)
+
 	routes := []routeSpecification{
-		post{"/tokens", handleAddToken(database, adminScope)},
+		post{"/tokens", handleAddToken(database, adminScope, settings)},
 		get{"/tokens", handleGetTokens(database, adminScope)},
+		get{"/tokens/:Id", handleGetToken(database, adminScope)},
+		patch{"/tokens/:Id", handlePatchToken(database, adminScope, settings)},
+		del{"/tokens/:Id", handleDeleteToken(database, adminScope)},
 		post{"/users", handleAddUser(database, adminScope)},
-		del{"/users", handleDeleteUser(database, adminScope)},
 		get{"/users", handleGetUsers(database, adminScope)},
-		get{"/user/:Id", handleGetUser(database, adminScope)},
-		del{"/tokens", handleDeleteToken(database, adminScope)},
+		get{"/users/:Id", handleGetUser(database, adminScope)},
+		patch{"/users/:Id", handlePatchUser(database, adminScope)},
+		del{"/users/:Id", handleDeleteUser(database, adminScope)},
+		get{"/users/:Id/tokens", handleGetTokens(database, adminScope)},
+		post{"/users/:Id/tokens", handleAddUserToken(database, adminScope, settings)},
+		del{"/users", deprecated("/users/:Id", handleDeleteUser(database, adminScope))},
+		get{"/user/:Id", deprecated("/users/:Id", handleGetUser(database, adminScope))},
+		patch{"/user/:Id", deprecated("/users/:Id", handlePatchUser(database, adminScope))},
+		put{"/user/:Id/owner", handleSetServiceAccountOwner(database, adminScope)},
+		put{"/user/:Id/status", handleSetUserStatus(database, adminScope)},
+		put{"/user/:Id/disabled", handleSetUserDisabled(database, adminScope)},
+		put{"/user/:Id/password", handleSetPassword(database, adminScope, settings)},
+		post{"/user/:Id/password/reset", handleResetPassword(database, adminScope, settings)},
+		del{"/user/:Id/password", handleClearPassword(database, adminScope)},
+		post{"/user/:Id/totp", requireUnsealed(keyring, handleEnrollTotp(database, adminScope, keyring, settings))},
+		post{"/user/:Id/totp/confirm", requireUnsealed(keyring, handleConfirmTotp(database, adminScope, keyring))},
+		del{"/user/:Id/totp", requireUnsealed(keyring, handleDeleteTotp(database, adminScope, keyring))},
+		post{"/login", handleLogin(database, keyring, settings)},
+		post{"/signing-keys", requireUnsealed(keyring, handleAddSigningKey(database, adminScope, keyring))},
+		get{"/signing-keys", handleGetSigningKeys(database, adminScope)},
+		del{"/signing-keys/:Id", handleDeleteSigningKey(database, adminScope)},
+		post{"/verify-signature", requireUnsealed(keyring, handleVerifySignature(database, adminScope, keyring, settings))},
+		post{"/introspect", handleIntrospect(database, adminScope, settings)},
+		post{"/certificates", requireUnsealed(keyring, handleIssueCertificate(database, keyStore, settings))},
+		get{"/certificates/:Serial/status", handleGetCertificateStatus(database)},
+		del{"/certificates/:Serial", handleRevokeCertificate(database, adminScope)},
+		get{"/ca/certificate", requireUnsealed(keyring, handleGetCertificateAuthority(keyStore))},
+		put{"/ca/certificate", requireUnsealed(keyring, handleImportCertificateAuthority(database, adminScope, keyStore))},
+		get{"/ca/crl", requireUnsealed(keyring, handleGetCertificateRevocationList(database, keyStore))},
+		post{"/ssh/sign", requireUnsealed(keyring, handleSignSshKey(database, keyStore, settings))},
+		get{"/ssh/ca.pub", requireUnsealed(keyring, handleGetSshCertificateAuthority(keyStore))},
+		get{"/ssh/certificates", handleGetSshCertificates(database, adminScope)},
+		get{"/secrets/*path", requireUnsealed(keyring, handleGetSecret(database, adminScope, keyring))},
+		put{"/secrets/*path", requireUnsealed(keyring, handlePutSecret(database, adminScope, keyring))},
+		del{"/secrets/*path", handleDeleteSecret(database, adminScope)},
+		get{"/secret-versions/*path", handleGetSecretVersions(database, adminScope)},
+		post{"/secret-undelete/*path", handleUndeleteSecret(database, adminScope)},
+		get{"/engines", handleGetEngines(database, adminScope, engineRegistry)},
+		post{"/engines/:Mount/roles", handleAddEngineRole(database, adminScope, engineRegistry)},
+		get{"/engines/:Mount/roles", handleGetEngineRoles(database, adminScope)},
+		post{"/engines/:Mount/creds/:Role", handleIssueCredentials(database, adminScope, leaseManager, "")},
+		post{"/database-creds/:Role", handleIssueCredentials(database, adminScope, leaseManager, "database")},
+		get{"/leases", handleGetLeases(database, adminScope)},
+		post{"/leases/:Id/renew", handleRenewLease(database, adminScope, leaseManager)},
+		del{"/leases/:Id", handleRevokeLease(database, adminScope, leaseManager)},
+		post{"/transit/keys", requireUnsealed(keyring, handleAddTransitKey(database, adminScope, keyring))},
+		get{"/transit/keys", handleGetTransitKeys(database, adminScope)},
+		post{"/transit/keys/:Name/rotate", requireUnsealed(keyring, handleRotateTransitKey(database, adminScope, keyring))},
+		post{"/transit/encrypt/:Name", requireUnsealed(keyring, handleTransitOperation(database, adminScope, keyring, transitEncrypt))},
+		post{"/transit/decrypt/:Name", requireUnsealed(keyring, handleTransitOperation(database, adminScope, keyring, transitDecrypt))},
+		post{"/transit/rewrap/:Name", requireUnsealed(keyring, handleTransitOperation(database, adminScope, keyring, transitRewrap))},
+		post{"/transit/sign/:Name", requireUnsealed(keyring, handleTransitOperation(database, adminScope, keyring, transitSign))},
+		post{"/transit/verify/:Name", requireUnsealed(keyring, handleTransitOperation(database, adminScope, keyring, transitVerify))},
+		post{"/webhooks", requireUnsealed(keyring, handleAddWebhook(database, adminScope, keyring))},
+		get{"/webhooks", handleGetWebhooks(database, adminScope)},
+		del{"/webhooks/:Id", handleDeleteWebhook(database, adminScope)},
+		get{"/webhooks/:Id/deliveries", handleGetWebhookDeliveries(database, adminScope)},
+		get{"/webhook-deliveries", handleGetAllWebhookDeliveries(database, adminScope)},
+		post{"/webhook-deliveries/:Id/replay", handleReplayWebhookDelivery(database, adminScope)},
+		get{"/debug/vars", handleGetDebugVars(database, adminScope)},
+		get{"/audit", handleGetAuditEvents(database, adminScope, settings)},
+		post{"/sys/init", handleInitializeSeal(database, adminScope, keyring)},
+		post{"/sys/unseal", handleUnseal(keyring)},
+		post{"/sys/seal", handleSeal(database, adminScope, keyring)},
+		get{"/sys/seal-status", handleGetSealStatus(keyring)},
+		del{"/tokens", deprecated("/tokens/:Id", handleDeleteToken(database, adminScope))},
+		get{"/token-expirations", handleGetTokenExpirations(database, adminScope, settings)},
 	}
 
-	addRoutes(router, routes)
+	addRoutes(router, database, routes)
+	addCustomMethodRoutes(router, database, []routeSpecification{
+		post{"/tokens:batchRevoke", handleBatchRevokeTokens(database, adminScope)},
+		post{"/tokens:batchCreate", handleBatchCreateTokens(database, adminScope, settings)},
+	})
+
+	return keyring, leaseManager
+}
+
+// When the routes that predate the resource paths were deprecated
+var legacyRoutesDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// Marks a route as deprecated (RFC 9745) in favour of `successor`, which is linked to when the request has everything
+// needed to fill in its `:Id`.
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyRoutesDeprecatedAt.Unix()))
+		if id := getParameters(request).ByName("Id"); id != "" {
+			link := strings.Replace(successor, ":Id", url.PathEscape(id), 1)
+			writer.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
+		}
+
+		handler(writer, request)
+	}
 }
 
 type post struct {
@@ -47,6 +152,32 @@ func (get get) toRouteData() routeData {
 	}
 }
 
+type put struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+func (put put) toRouteData() routeData {
+	return routeData{
+		method:  "PUT",
+		path:    put.path,
+		handler: put.handler,
+	}
+}
+
+type patch struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+func (patch patch) toRouteData() routeData {
+	return routeData{
+		method:  "PATCH",
+		path:    patch.path,
+		handler: patch.handler,
+	}
+}
+
 type del struct {
 	path    string
 	handler http.HandlerFunc
@@ -70,13 +201,38 @@ type routeSpecification interface {
 	toRouteData() routeData
 }
 
-func addRoutes(router *httprouter.Router, routes []routeSpecification) {
+func addRoutes(router *httprouter.Router, database *pg.DB, routes []routeSpecification) {
 	for _, r := range routes {
 		rd := r.toRouteData()
-		addRouteData(router, rd)
+		addRouteData(router, database, rd)
 	}
 }
 
-func addRouteData(router *httprouter.Router, rd routeData) {
-	router.HandlerFunc(rd.method, rd.path, rd.handler)
+func addRouteData(router *httprouter.Router, database *pg.DB, rd routeData) {
+	router.HandlerFunc(rd.method, rd.path, auditRoute(database, rd.method, rd.path, rd.handler))
+}
+
+// Custom methods like `/tokens:batchRevoke` can't be added to the router, which takes the `:` for the start of a path
+// parameter, so they're dispatched from its not found handler instead.
+func addCustomMethodRoutes(router *httprouter.Router, database *pg.DB, routes []routeSpecification) {
+	handlers := make(map[string]http.HandlerFunc)
+	for _, r := range routes {
+		rd := r.toRouteData()
+		handlers[rd.method+" "+rd.path] = auditRoute(database, rd.method, rd.path, rd.handler)
+	}
+
+	notFound := router.NotFound
+	router.NotFound = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if handler, ok := handlers[request.Method+" "+request.URL.Path]; ok {
+			handler(writer, request)
+
+			return
+		}
+
+		if notFound != nil {
+			notFound.ServeHTTP(writer, request)
+		} else {
+			http.NotFound(writer, request)
+		}
+	})
 }
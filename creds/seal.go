@@ -0,0 +1,305 @@
+package creds
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// How the master key was split when sealing was initialized. Only a check value encrypted with the master key is
+// stored, which tells whether combined shares gave back the right key.
+type SealConfiguration struct {
+	Id        int       `json:"-" pg:",pk"`
+	Shares    int       `json:"shares" pg:",notnull"`
+	Threshold int       `json:"threshold" pg:",notnull"`
+	KeyCheck  []byte    `json:"-" pg:",notnull"`
+	CreatedAt time.Time `json:"createdAt" pg:",notnull"`
+}
+
+const sealConfigurationId = 1
+
+var sealCheckPlaintext = []byte("creds seal check")
+var sealCheckAssociatedData = []byte("seal")
+
+var errAlreadyInitialized = errors.New("sealing is already initialized")
+var errNotInitialized = errors.New("sealing is not initialized")
+var errWrongShares = errors.New("the submitted shares don't combine to the master key, unsealing has been reset")
+
+func keyMatchesSeal(seal *SealConfiguration, masterKey []byte) bool {
+	plaintext, err := decryptWithKey(masterKey, seal.KeyCheck, sealCheckAssociatedData)
+
+	return err == nil && bytes.Equal(plaintext, sealCheckPlaintext)
+}
+
+// Loads the seal configuration, if sealing has been initialized. Once it is, the master key only comes from unseal
+// shares; one from the environment is dropped, even if it's the right key, and the keyring starts out sealed.
+func (keyring *keyring) loadSeal(database *pg.DB) error {
+	seal := &SealConfiguration{Id: sealConfigurationId}
+	if err := database.Model(seal).WherePK().Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil
+		}
+
+		return err
+	}
+
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+
+	keyring.seal = seal
+	if len(keyring.masterKey) != 0 {
+		fmt.Printf("Sealing is initialized, ignoring 'MASTER_KEY' and starting sealed; remove it from the environment\n")
+		keyring.masterKey = nil
+	}
+
+	return nil
+}
+
+// Splits the master key into shares, generating a master key first if none is configured. The shares are only
+// ever returned from here.
+func (keyring *keyring) initializeSeal(database *pg.DB, shares int, threshold int) ([][]byte, error) {
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+
+	if keyring.seal != nil {
+		return nil, errAlreadyInitialized
+	}
+
+	masterKey := keyring.masterKey
+	if len(masterKey) == 0 {
+		masterKey = make([]byte, 32)
+		if _, err := rand.Read(masterKey); err != nil {
+			return nil, err
+		}
+	}
+
+	keyShares, err := splitSecret(masterKey, shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	keyCheck, err := encryptWithKey(masterKey, sealCheckPlaintext, sealCheckAssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	seal := &SealConfiguration{
+		Id:        sealConfigurationId,
+		Shares:    shares,
+		Threshold: threshold,
+		KeyCheck:  keyCheck,
+		CreatedAt: time.Now(),
+	}
+	result, err := database.Model(seal).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return nil, err
+	}
+	// Another instance initialized sealing first
+	if result.RowsAffected() == 0 {
+		return nil, errAlreadyInitialized
+	}
+
+	keyring.seal = seal
+	keyring.masterKey = masterKey
+
+	return keyShares, nil
+}
+
+// Adds a share towards unsealing, combining the shares once there are enough of them
+func (keyring *keyring) submitUnsealShare(share []byte) error {
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+
+	if keyring.seal == nil {
+		return errNotInitialized
+	}
+	if len(keyring.masterKey) != 0 {
+		return nil
+	}
+
+	for _, submitted := range keyring.unsealShares {
+		if bytes.Equal(submitted, share) {
+			return nil
+		}
+	}
+	keyring.unsealShares = append(keyring.unsealShares, share)
+	if len(keyring.unsealShares) < keyring.seal.Threshold {
+		return nil
+	}
+
+	masterKey, err := combineShares(keyring.unsealShares)
+	keyring.unsealShares = nil
+	if err != nil {
+		return err
+	}
+	if !keyMatchesSeal(keyring.seal, masterKey) {
+		return errWrongShares
+	}
+	keyring.masterKey = masterKey
+
+	return nil
+}
+
+func (keyring *keyring) sealKeyring() error {
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+
+	// Without a seal there would be no way to get the master key back
+	if keyring.seal == nil {
+		return errNotInitialized
+	}
+	keyring.masterKey = nil
+	keyring.unsealShares = nil
+
+	return nil
+}
+
+func (keyring *keyring) isSealed() bool {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	return keyring.seal != nil && len(keyring.masterKey) == 0
+}
+
+type sealStatusResponse struct {
+	Initialized bool `json:"initialized"`
+	Sealed      bool `json:"sealed"`
+	Shares      int  `json:"shares,omitempty"`
+	Threshold   int  `json:"threshold,omitempty"`
+	Progress    int  `json:"progress"`
+}
+
+func (keyring *keyring) status() sealStatusResponse {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	if keyring.seal == nil {
+		return sealStatusResponse{}
+	}
+
+	return sealStatusResponse{
+		Initialized: true,
+		Sealed:      len(keyring.masterKey) == 0,
+		Shares:      keyring.seal.Shares,
+		Threshold:   keyring.seal.Threshold,
+		Progress:    len(keyring.unsealShares),
+	}
+}
+
+// Wraps handlers that need the master key so they're refused while sealed
+const sealedResponse = "creds is sealed, unseal it through `POST /sys/unseal`"
+
+func requireUnsealed(keyring *keyring, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if keyring.isSealed() {
+			http.Error(writer, sealedResponse, http.StatusServiceUnavailable)
+
+			return
+		}
+
+		handler(writer, request)
+	}
+}
+
+type initializeSealParameters struct {
+	Shares    int
+	Threshold int
+}
+
+type initializeSealResponse struct {
+	Shares [][]byte `json:"shares"`
+}
+
+func handleInitializeSeal(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters initializeSealParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for initializing seal: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		shares, err := keyring.initializeSeal(database, parameters.Shares, parameters.Threshold)
+		if err != nil {
+			if err == errAlreadyInitialized {
+				http.Error(writer, err.Error(), http.StatusConflict)
+
+				return
+			}
+			response := fmt.Sprintf("Unable to initialize seal: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(initializeSealResponse{Shares: shares})
+	}
+}
+
+type unsealParameters struct {
+	Share []byte
+}
+
+// Doesn't need a token, the shares themselves are what authorizes unsealing
+func handleUnseal(keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var parameters unsealParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil || len(parameters.Share) == 0 {
+			http.Error(writer, "'share' has to be a base64 encoded share", http.StatusBadRequest)
+
+			return
+		}
+
+		if err := keyring.submitUnsealShare(parameters.Share); err != nil {
+			response := fmt.Sprintf("Unable to unseal: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(keyring.status())
+	}
+}
+
+func handleSeal(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		if err := keyring.sealKeyring(); err != nil {
+			http.Error(writer, err.Error(), http.StatusConflict)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(keyring.status())
+	}
+}
+
+func handleGetSealStatus(keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		_ = json.NewEncoder(writer).Encode(keyring.status())
+	}
+}
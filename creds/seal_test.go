@@ -0,0 +1,63 @@
+package creds
+
+import (
+	"crypto/rand"
+	"log"
+	"testing"
+)
+
+func TestKeyringUnsealing(t *testing.T) {
+	masterKey := make([]byte, 32)
+	_, _ = rand.Read(masterKey)
+	keyCheck, _ := encryptWithKey(masterKey, sealCheckPlaintext, sealCheckAssociatedData)
+	shares, _ := splitSecret(masterKey, 3, 2)
+
+	keyring := newKeyring(nil)
+	keyring.seal = &SealConfiguration{Shares: 3, Threshold: 2, KeyCheck: keyCheck}
+
+	if _, err := keyring.encrypt([]byte("secret"), nil); err != errSealed {
+		log.Panicf("Sealed keyring encrypted")
+	}
+
+	_ = keyring.submitUnsealShare(shares[2])
+	if !keyring.isSealed() || keyring.status().Progress != 1 {
+		log.Panicf("Unexpected status after one share: %+v", keyring.status())
+	}
+	if err := keyring.submitUnsealShare(shares[0]); err != nil || keyring.isSealed() {
+		log.Panicf("Keyring not unsealed by enough shares: %v", err)
+	}
+	if _, err := keyring.encrypt([]byte("secret"), nil); err != nil {
+		log.Panicf("Unsealed keyring can't encrypt: %s", err.Error())
+	}
+
+	_ = keyring.sealKeyring()
+	otherShares, _ := splitSecret(make([]byte, 32), 3, 2)
+	_ = keyring.submitUnsealShare(shares[1])
+	if err := keyring.submitUnsealShare(otherShares[0]); err != errWrongShares || !keyring.isSealed() {
+		log.Panicf("Keyring unsealed by a foreign share")
+	}
+	if keyring.status().Progress != 0 {
+		log.Panicf("Unsealing progress wasn't reset after a failed attempt")
+	}
+}
+
+func TestLoadSealIgnoresMasterKey(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	keyring := newKeyring(setup.settings.MasterKey)
+	if err := keyring.loadSeal(setup.database); err != nil || keyring.isSealed() {
+		log.Panicf("Keyring without a seal isn't unsealed: %v", err)
+	}
+	if _, err := keyring.initializeSeal(setup.database, 3, 2); err != nil {
+		log.Panicf("Unable to initialize sealing: %s", err.Error())
+	}
+
+	// The environment's key is the one the seal was made with, and still isn't used
+	restarted := newKeyring(setup.settings.MasterKey)
+	if err := restarted.loadSeal(setup.database); err != nil {
+		log.Panicf("Unable to load seal: %s", err.Error())
+	}
+	if !restarted.isSealed() {
+		log.Panicln("Master key from the environment used despite sealing")
+	}
+}
@@ -0,0 +1,398 @@
+package creds
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+// One version of a secret in the key/value store. Values are encrypted with a data key of their own, which is in turn
+// encrypted with the master key, so the master key only ever encrypts small, random data keys.
+type Secret struct {
+	Path             string          `json:"path" pg:",pk"`
+	Version          int             `json:"version" pg:",pk"`
+	EncryptedValue   []byte          `json:"-" pg:",notnull"`
+	EncryptedDataKey []byte          `json:"-" pg:",notnull"`
+	Value            json.RawMessage `json:"value,omitempty" pg:"-"`
+	CreatedBy        uuid.UUID       `json:"createdBy" pg:"type:uuid,notnull"`
+	CreatedAt        time.Time       `json:"createdAt" pg:",notnull"`
+	DeletedAt        time.Time       `json:"deletedAt,omitempty"`
+}
+
+type secretAccess string
+
+const (
+	readSecrets  secretAccess = "read"
+	writeSecrets secretAccess = "write"
+)
+
+var errInvalidSecretPath = errors.New("secret paths have to be absolute, without spaces or relative segments")
+
+func secretAssociatedData(path string, version int) []byte {
+	return []byte(fmt.Sprintf("secret:%s:%d", path, version))
+}
+
+func getSecretPath(request *http.Request) (string, error) {
+	parameters := getParameters(request)
+	if parameters == nil {
+		return "", errInvalidSecretPath
+	}
+
+	secretPath := parameters.ByName("path")
+	if secretPath == "" || secretPath == "/" || strings.ContainsAny(secretPath, " \t\n") || path.Clean(secretPath) != secretPath {
+		return "", errInvalidSecretPath
+	}
+
+	return secretPath, nil
+}
+
+// Access to secrets is given by scopes like `secrets:read:/team/billing`, which covers that path and everything
+// below it. Write access doesn't imply read access.
+func tokenCanAccessSecret(token *Token, adminScope string, access secretAccess, secretPath string) bool {
+	if token.hasScope(adminScope) {
+		return true
+	}
+
+	scopePrefix := fmt.Sprintf("secrets:%s:", access)
+	for _, scope := range parseScopes(token.Scope) {
+		if !strings.HasPrefix(scope, scopePrefix) {
+			continue
+		}
+
+		prefix := strings.TrimPrefix(scope, scopePrefix)
+		if prefix == "/" || secretPath == prefix || strings.HasPrefix(secretPath, strings.TrimRight(prefix, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func encryptSecret(keyring *keyring, secret *Secret, value []byte) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+
+	associatedData := secretAssociatedData(secret.Path, secret.Version)
+	encryptedValue, err := encryptWithKey(dataKey, value, associatedData)
+	if err != nil {
+		return err
+	}
+
+	encryptedDataKey, err := keyring.encrypt(dataKey, associatedData)
+	if err != nil {
+		return err
+	}
+
+	secret.EncryptedValue = encryptedValue
+	secret.EncryptedDataKey = encryptedDataKey
+
+	return nil
+}
+
+func decryptSecret(keyring *keyring, secret *Secret) error {
+	associatedData := secretAssociatedData(secret.Path, secret.Version)
+	dataKey, err := keyring.decrypt(secret.EncryptedDataKey, associatedData)
+	if err != nil {
+		return err
+	}
+
+	value, err := decryptWithKey(dataKey, secret.EncryptedValue, associatedData)
+	if err != nil {
+		return err
+	}
+
+	secret.Value = value
+
+	return nil
+}
+
+// Writes a new version of a secret, returning the version number
+func putSecret(database *pg.DB, keyring *keyring, secretPath string, value []byte, createdBy uuid.UUID) (int, error) {
+	version := 0
+	err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		// Serializes writers of the same path so they don't race for the same version number
+		if _, err := transaction.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", secretPath); err != nil {
+			return err
+		}
+
+		latestVersion := 0
+		if _, err := transaction.QueryOne(pg.Scan(&latestVersion),
+			"SELECT coalesce(max(version), 0) FROM secrets WHERE path = ?", secretPath,
+		); err != nil {
+			return err
+		}
+
+		secret := Secret{
+			Path:      secretPath,
+			Version:   latestVersion + 1,
+			CreatedBy: createdBy,
+			CreatedAt: time.Now(),
+		}
+		if err := encryptSecret(keyring, &secret, value); err != nil {
+			return err
+		}
+
+		if _, err := transaction.Model(&secret).Insert(); err != nil {
+			return err
+		}
+		version = secret.Version
+
+		return nil
+	})
+
+	return version, err
+}
+
+// Gets a version of a secret, or the latest version that isn't deleted when `version` is 0
+func getSecret(database *pg.DB, secretPath string, version int) (*Secret, error) {
+	secret := &Secret{}
+	query := database.Model(secret).Where("path = ?", secretPath)
+	if version == 0 {
+		query = query.Where("deleted_at IS NULL").Order("version DESC").Limit(1)
+	} else {
+		query = query.Where("version = ?", version)
+	}
+
+	if err := query.Select(); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func getVersionParameter(request *http.Request) (int, error) {
+	versionString := request.URL.Query().Get("version")
+	if versionString == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(versionString)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid version '%s'", versionString)
+	}
+
+	return version, nil
+}
+
+// Authenticates a request for a secret, writing an error response and returning `nil` if it isn't allowed
+func authorizeSecretRequest(
+	writer http.ResponseWriter,
+	request *http.Request,
+	database *pg.DB,
+	adminScope string,
+	access secretAccess,
+) (*Token, string) {
+	secretPath, err := getSecretPath(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return nil, ""
+	}
+
+	token, err := authenticateRequest(database, request)
+	if err != nil || !tokenCanAccessSecret(token, adminScope, access, secretPath) {
+		response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+		http.Error(writer, response, http.StatusUnauthorized)
+
+		return nil, ""
+	}
+
+	return token, secretPath
+}
+
+func handleGetSecret(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, secretPath := authorizeSecretRequest(writer, request, database, adminScope, readSecrets)
+		if token == nil {
+			return
+		}
+
+		version, err := getVersionParameter(request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		secret, err := getSecret(database, secretPath, version)
+		if err != nil {
+			if err == pg.ErrNoRows {
+				response := fmt.Sprintf("Secret '%s' not found", secretPath)
+				http.Error(writer, response, http.StatusNotFound)
+
+				return
+			}
+			response := fmt.Sprintf("Error getting secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if !secret.DeletedAt.IsZero() {
+			response := fmt.Sprintf("Version %d of secret '%s' is deleted", secret.Version, secretPath)
+			http.Error(writer, response, http.StatusGone)
+
+			return
+		}
+
+		if err := decryptSecret(keyring, secret); err != nil {
+			response := fmt.Sprintf("Unable to decrypt secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(secret)
+	}
+}
+
+type putSecretParameters struct {
+	Value json.RawMessage
+}
+
+type putSecretResponse struct {
+	Path    string `json:"path"`
+	Version int    `json:"version"`
+}
+
+func handlePutSecret(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, secretPath := authorizeSecretRequest(writer, request, database, adminScope, writeSecrets)
+		if token == nil {
+			return
+		}
+
+		var parameters putSecretParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for storing secret: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if len(parameters.Value) == 0 {
+			http.Error(writer, "'value' missing", http.StatusBadRequest)
+
+			return
+		}
+
+		version, err := putSecret(database, keyring, secretPath, parameters.Value, token.UserId)
+		if err != nil {
+			response := fmt.Sprintf("Unable to store secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(putSecretResponse{Path: secretPath, Version: version})
+	}
+}
+
+// Soft deletes a version of a secret, the latest one unless `version` is given. Deleted versions can be undeleted.
+func handleDeleteSecret(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, secretPath := authorizeSecretRequest(writer, request, database, adminScope, writeSecrets)
+		if token == nil {
+			return
+		}
+
+		version, err := getVersionParameter(request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		secret, err := getSecret(database, secretPath, version)
+		if err != nil {
+			if err == pg.ErrNoRows {
+				response := fmt.Sprintf("Secret '%s' not found", secretPath)
+				http.Error(writer, response, http.StatusNotFound)
+
+				return
+			}
+			response := fmt.Sprintf("Error getting secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if _, err := database.Model(secret).Set("deleted_at = ?", time.Now()).WherePK().Update(); err != nil {
+			response := fmt.Sprintf("Unable to delete secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+	}
+}
+
+func handleUndeleteSecret(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, secretPath := authorizeSecretRequest(writer, request, database, adminScope, writeSecrets)
+		if token == nil {
+			return
+		}
+
+		version, err := getVersionParameter(request)
+		if err != nil || version == 0 {
+			http.Error(writer, "'version' query parameter required", http.StatusBadRequest)
+
+			return
+		}
+
+		result, err := database.Model((*Secret)(nil)).
+			Set("deleted_at = NULL").
+			Where("path = ? AND version = ? AND deleted_at IS NOT NULL", secretPath, version).
+			Update()
+		if err != nil {
+			response := fmt.Sprintf("Unable to undelete secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if result.RowsAffected() == 0 {
+			response := fmt.Sprintf("Deleted version %d of secret '%s' not found", version, secretPath)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
+
+// Version history of a secret, without any values
+func handleGetSecretVersions(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, secretPath := authorizeSecretRequest(writer, request, database, adminScope, readSecrets)
+		if token == nil {
+			return
+		}
+
+		secrets := make([]Secret, 0)
+		if err := database.Model(&secrets).Where("path = ?", secretPath).Order("version").Select(); err != nil {
+			response := fmt.Sprintf("Error getting secret versions: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if len(secrets) == 0 {
+			response := fmt.Sprintf("Secret '%s' not found", secretPath)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(secrets)
+	}
+}
@@ -0,0 +1,115 @@
+package creds
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestTokenCanAccessSecret(t *testing.T) {
+	token := &Token{Scope: "secrets:read:/team/billing secrets:write:/team/billing/stripe"}
+
+	cases := []struct {
+		access   secretAccess
+		path     string
+		expected bool
+	}{
+		{readSecrets, "/team/billing", true},
+		{readSecrets, "/team/billing/stripe", true},
+		{readSecrets, "/team/billingx", false},
+		{readSecrets, "/team", false},
+		{writeSecrets, "/team/billing/stripe/key", true},
+		{writeSecrets, "/team/billing/other", false},
+	}
+
+	for _, c := range cases {
+		if tokenCanAccessSecret(token, "admin", c.access, c.path) != c.expected {
+			log.Panicf("Unexpected access for %s on '%s', expected %t", c.access, c.path, c.expected)
+		}
+	}
+
+	if !tokenCanAccessSecret(&Token{Scope: "admin"}, "admin", writeSecrets, "/anything") {
+		log.Panicf("Admin token can't access secrets")
+	}
+}
+
+func TestSecretLifecycle(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Billing", "billing")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	scope := "secrets:read:/team/billing secrets:write:/team/billing"
+	tokenId, err := insertToken(setup.database, userId, scope, time.Now(), time.Now().Add(time.Hour), tokenBinding{})
+	if err != nil {
+		log.Panicf("Unable to add token: %s", err.Error())
+	}
+	headers := []headerEntry{bearerToken(tokenId)}
+
+	url := "/secrets/team/billing/stripe"
+	readSecret := func(query string, expected int) Secret {
+		recorder := expectStatus("GET", url+query, "", headers, router, expected)
+		secret := Secret{}
+		if expected == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&secret); err != nil {
+				log.Panicf("Unable to decode secret: %s", err.Error())
+			}
+		}
+
+		return secret
+	}
+
+	for version, value := range []string{`{"key":"v1"}`, `{"key":"v2"}`} {
+		recorder := expectStatus("PUT", url, `{"value": `+value+`}`, headers, router, http.StatusOK)
+		response := putSecretResponse{}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response.Version != version+1 {
+			log.Panicf("Unexpected version written: %+v, %v", response, err)
+		}
+	}
+
+	if secret := readSecret("", http.StatusOK); secret.Version != 2 || string(secret.Value) != `{"key":"v2"}` {
+		log.Panicf("Latest version not read: %+v", secret)
+	}
+	if secret := readSecret("?version=1", http.StatusOK); secret.Version != 1 || string(secret.Value) != `{"key":"v1"}` {
+		log.Panicf("Old version not read: %+v", secret)
+	}
+
+	// Deleting the latest version falls back to the one before it, until it's undeleted
+	expectStatus("DELETE", url, "", headers, router, http.StatusOK)
+	if secret := readSecret("", http.StatusOK); secret.Version != 1 {
+		log.Panicf("Deleted version still read as the latest: %+v", secret)
+	}
+	readSecret("?version=2", http.StatusGone)
+	expectStatus("POST", "/secret-undelete/team/billing/stripe?version=2", "", headers, router, http.StatusOK)
+	expectStatus("POST", "/secret-undelete/team/billing/stripe?version=2", "", headers, router, http.StatusNotFound)
+	if secret := readSecret("", http.StatusOK); secret.Version != 2 || string(secret.Value) != `{"key":"v2"}` {
+		log.Panicf("Undeleted version not read: %+v", secret)
+	}
+
+	// Once every version is deleted the secret is gone, though its history is kept
+	expectStatus("DELETE", url+"?version=1", "", headers, router, http.StatusOK)
+	expectStatus("DELETE", url, "", headers, router, http.StatusOK)
+	readSecret("", http.StatusNotFound)
+
+	recorder := expectStatus("GET", "/secret-versions/team/billing/stripe", "", headers, router, http.StatusOK)
+	versions := make([]Secret, 0)
+	if err := json.NewDecoder(recorder.Body).Decode(&versions); err != nil {
+		log.Panicf("Unable to decode versions: %s", err.Error())
+	}
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].DeletedAt.IsZero() || versions[1].Value != nil {
+		log.Panicf("Unexpected versions: %+v", versions)
+	}
+
+	expectStatus("GET", "/secrets/team/billing/unknown", "", headers, router, http.StatusNotFound)
+	expectStatus("GET", "/secret-versions/team/billing/unknown", "", headers, router, http.StatusNotFound)
+	expectStatus("PUT", "/secrets/team/payroll/key", `{"value": "x"}`, headers, router, http.StatusUnauthorized)
+	expectStatus("GET", url, "", []headerEntry{}, router, http.StatusUnauthorized)
+}
@@ -10,11 +10,12 @@ import (
 )
 
 type Server struct {
-	router *httprouter.Router
+	router         *httprouter.Router
+	trustedProxies trustedProxies
 }
 
 func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	server.router.ServeHTTP(writer, request)
+	server.router.ServeHTTP(writer, server.trustedProxies.withForwardedTarget(request))
 }
 
 type DatabaseOptions struct {
@@ -25,15 +26,56 @@ type DatabaseOptions struct {
 	Password string
 }
 
-func (server *Server) Serve(port int, database *pg.DB, adminScope string) {
+func (server *Server) Serve(port int, database *pg.DB, adminScope string, settings Settings) {
 	if server.router == nil {
 		server.router = httprouter.New()
 	}
 
-	setupRoutes(server.router, database, adminScope)
+	trustedProxies, err := parseTrustedProxies(settings.TrustedProxies)
+	if err != nil {
+		log.Panicf("Unable to set up trusted proxies: %s", err.Error())
+	}
+	server.trustedProxies = trustedProxies
+
+	keyring, leaseManager := setupRoutes(server.router, database, adminScope, settings)
+	go runPeriodically(settings.LeaseExpiryInterval, leaseManager.expire)
+	go runPeriodically(settings.WebhookDeliveryInterval, func() { deliverWebhooks(database, keyring) })
+
+	sinks, err := parseOutboxSinks(settings.OutboxSinks)
+	if err != nil {
+		log.Panicf("Unable to set up outbox sinks: %s", err.Error())
+	}
+	relay := newOutboxRelay(database, append([]outboxSink{webhookSink{database: database}}, sinks...))
+	go runPeriodically(settings.OutboxRelayInterval, relay.relay)
+
+	notifiers, err := parseExpiryNotifiers(settings.TokenExpiryNotifiers)
+	if err != nil {
+		log.Panicf("Unable to set up token expiry notifiers: %s", err.Error())
+	}
+	scheduler := newExpiryScheduler(database, settings.TokenExpiryWindows, notifiers)
+	go runPeriodically(settings.TokenExpiryCheckInterval, scheduler.notifyExpiringTokens)
+	go runPeriodically(settings.TokenReaperInterval, func() { runTokenReaper(database, settings) })
 	fmt.Printf("Running server on port %d\n", port)
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), server); err != nil {
+	if settings.TlsCertificateFile == "" {
+		if settings.ClientCertificateMode != NoClientCertificates {
+			log.Panicf("Client certificates require TLS, set 'TLS_CERTIFICATE_FILE' and 'TLS_KEY_FILE'")
+		}
+
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", port), server); err != nil {
+			log.Panicf("Error trying to start server: %server", err.Error())
+		}
+
+		return
+	}
+
+	tlsConfig, err := createTlsConfig(settings)
+	if err != nil {
+		log.Panicf("Unable to set up TLS: %s", err.Error())
+	}
+
+	httpServer := http.Server{Addr: fmt.Sprintf(":%d", port), Handler: server, TLSConfig: tlsConfig}
+	if err := httpServer.ListenAndServeTLS(settings.TlsCertificateFile, settings.TlsKeyFile); err != nil {
 		log.Panicf("Error trying to start server: %server", err.Error())
 	}
 }
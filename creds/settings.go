@@ -0,0 +1,178 @@
+package creds
+
+import (
+	"encoding/base64"
+	"log"
+	"strings"
+	"time"
+)
+
+// Optional configuration; everything in here has a sensible default so that only the connection details and admin
+// scope have to be given to run the server.
+type Settings struct {
+	PasswordParameters PasswordParameters
+	SessionLifetime    time.Duration
+	// Base64 encoded 256 bit key that secrets stored in the database (TOTP secrets and the like) are encrypted with.
+	// Ignored once sealing is initialized through `POST /sys/init`; the key is then unsealed from shares instead.
+	MasterKey []byte
+	// Login sessions with any of these scopes need a second factor; tokens admins issue directly aren't affected
+	MfaRequiredScopes []string
+	TotpIssuer        string
+	// Scope for resource servers that verify credentials on behalf of their clients
+	IntrospectionScope string
+	SignatureMaxSkew   time.Duration
+	// Serving over TLS is enabled by giving a certificate and key; client certificates additionally need a CA to
+	// verify them against.
+	TlsCertificateFile    string
+	TlsKeyFile            string
+	ClientCaFile          string
+	ClientCertificateMode ClientCertificateMode
+	// Whether session tokens issued on login are bound to the client certificate the login was made with
+	BindSessionsToCertificates bool
+	// How long client certificates issued by the built-in CA are valid for, at most
+	ClientCertificateLifetime time.Duration
+	SshCertificateLifetime    time.Duration
+	// How often expired leases are looked for and revoked
+	LeaseExpiryInterval time.Duration
+	// Mounts the PostgreSQL secret engine at `database` when a host is given. The engine runs role templates over this
+	// connection, which has to use a role of its own with `CREATEROLE` and never the one creds itself uses.
+	PostgresEngineDatabase DatabaseOptions
+	// Mounts the file secret engine at `file` when set
+	FileEngineDirectory string
+	// Scope for reading the audit log, which doesn't allow changing anything
+	AuditReadScope string
+	// How often queued webhook deliveries are looked for and sent
+	WebhookDeliveryInterval time.Duration
+	// Where outbox events are published besides webhooks, see `parseOutboxSinks`
+	OutboxSinks         []string
+	OutboxRelayInterval time.Duration
+	// How long before a token's end it's announced, once per window, and how; see `parseExpiryNotifiers`
+	TokenExpiryWindows       []time.Duration
+	TokenExpiryNotifiers     []string
+	TokenExpiryCheckInterval time.Duration
+	// Tokens that ended longer than `TokenRetention` ago are moved to the archive. A dry run only reports how many.
+	TokenRetention      time.Duration
+	TokenReaperInterval time.Duration
+	TokenReaperDryRun   bool
+	// Longest a token can be valid for, from its start to its end; no limit when zero
+	MaxTokenLifetime time.Duration
+	// Addresses or CIDRs of reverse proxies whose `X-Forwarded-Proto` and `X-Forwarded-Host` headers are trusted
+	TrustedProxies []string
+}
+
+func DefaultSettings() Settings {
+	return Settings{
+		PasswordParameters: defaultPasswordParameters,
+		SessionLifetime:    8 * time.Hour,
+		MasterKey:          nil,
+		MfaRequiredScopes:  []string{},
+		TotpIssuer:         "creds",
+		IntrospectionScope: "introspect",
+		SignatureMaxSkew:   5 * time.Minute,
+
+		TlsCertificateFile:         "",
+		TlsKeyFile:                 "",
+		ClientCaFile:               "",
+		ClientCertificateMode:      NoClientCertificates,
+		BindSessionsToCertificates: false,
+		ClientCertificateLifetime:  24 * time.Hour,
+		SshCertificateLifetime:     16 * time.Hour,
+		LeaseExpiryInterval:        time.Minute,
+		PostgresEngineDatabase:     DatabaseOptions{},
+		FileEngineDirectory:        "",
+		AuditReadScope:             "audit:read",
+		WebhookDeliveryInterval:    5 * time.Second,
+		OutboxSinks:                nil,
+		OutboxRelayInterval:        time.Second,
+		TokenExpiryWindows:         []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour},
+		TokenExpiryNotifiers:       []string{"event"},
+		TokenExpiryCheckInterval:   time.Hour,
+		TokenRetention:             30 * 24 * time.Hour,
+		TokenReaperInterval:        time.Hour,
+		TokenReaperDryRun:          false,
+		MaxTokenLifetime:           0,
+		TrustedProxies:             nil,
+	}
+}
+
+func GetSettingsFromEnvironment() Settings {
+	defaults := DefaultSettings()
+
+	return Settings{
+		PasswordParameters: PasswordParameters{
+			Time:       uint32(GetOptionalIntegerEnvironmentVariable("PASSWORD_TIME", int(defaults.PasswordParameters.Time))),
+			Memory:     uint32(GetOptionalIntegerEnvironmentVariable("PASSWORD_MEMORY", int(defaults.PasswordParameters.Memory))),
+			Threads:    uint8(GetOptionalIntegerEnvironmentVariable("PASSWORD_THREADS", int(defaults.PasswordParameters.Threads))),
+			SaltLength: defaults.PasswordParameters.SaltLength,
+			KeyLength:  defaults.PasswordParameters.KeyLength,
+		},
+		SessionLifetime:    GetOptionalDurationEnvironmentVariable("SESSION_LIFETIME", defaults.SessionLifetime),
+		MasterKey:          getMasterKeyFromEnvironment(),
+		MfaRequiredScopes:  strings.Fields(GetOptionalEnvironmentVariable("MFA_REQUIRED_SCOPES", "")),
+		TotpIssuer:         GetOptionalEnvironmentVariable("TOTP_ISSUER", defaults.TotpIssuer),
+		IntrospectionScope: GetOptionalEnvironmentVariable("INTROSPECTION_SCOPE", defaults.IntrospectionScope),
+		SignatureMaxSkew:   GetOptionalDurationEnvironmentVariable("SIGNATURE_MAX_SKEW", defaults.SignatureMaxSkew),
+
+		TlsCertificateFile: GetOptionalEnvironmentVariable("TLS_CERTIFICATE_FILE", defaults.TlsCertificateFile),
+		TlsKeyFile:         GetOptionalEnvironmentVariable("TLS_KEY_FILE", defaults.TlsKeyFile),
+		ClientCaFile:       GetOptionalEnvironmentVariable("CLIENT_CA_FILE", defaults.ClientCaFile),
+		ClientCertificateMode: ClientCertificateMode(
+			GetOptionalEnvironmentVariable("CLIENT_CERTIFICATE_MODE", string(defaults.ClientCertificateMode)),
+		),
+		BindSessionsToCertificates: GetOptionalEnvironmentVariable("BIND_SESSIONS_TO_CERTIFICATES", "false") == "true",
+		ClientCertificateLifetime: GetOptionalDurationEnvironmentVariable(
+			"CLIENT_CERTIFICATE_LIFETIME",
+			defaults.ClientCertificateLifetime,
+		),
+		SshCertificateLifetime: GetOptionalDurationEnvironmentVariable(
+			"SSH_CERTIFICATE_LIFETIME",
+			defaults.SshCertificateLifetime,
+		),
+		LeaseExpiryInterval: GetOptionalDurationEnvironmentVariable("LEASE_EXPIRY_INTERVAL", defaults.LeaseExpiryInterval),
+		PostgresEngineDatabase: DatabaseOptions{
+			Host:     GetOptionalEnvironmentVariable("POSTGRES_ENGINE_HOST", ""),
+			Port:     GetOptionalIntegerEnvironmentVariable("POSTGRES_ENGINE_PORT", 5432),
+			Database: GetOptionalEnvironmentVariable("POSTGRES_ENGINE_DATABASE", ""),
+			User:     GetOptionalEnvironmentVariable("POSTGRES_ENGINE_USER", ""),
+			Password: GetOptionalEnvironmentVariable("POSTGRES_ENGINE_PASSWORD", ""),
+		},
+		FileEngineDirectory: GetOptionalEnvironmentVariable("FILE_ENGINE_DIRECTORY", defaults.FileEngineDirectory),
+		AuditReadScope:      GetOptionalEnvironmentVariable("AUDIT_READ_SCOPE", defaults.AuditReadScope),
+		WebhookDeliveryInterval: GetOptionalDurationEnvironmentVariable(
+			"WEBHOOK_DELIVERY_INTERVAL",
+			defaults.WebhookDeliveryInterval,
+		),
+		OutboxSinks:         strings.Fields(GetOptionalEnvironmentVariable("OUTBOX_SINKS", "")),
+		OutboxRelayInterval: GetOptionalDurationEnvironmentVariable("OUTBOX_RELAY_INTERVAL", defaults.OutboxRelayInterval),
+		TokenExpiryWindows: GetOptionalDurationListEnvironmentVariable(
+			"TOKEN_EXPIRY_WINDOWS",
+			defaults.TokenExpiryWindows,
+		),
+		TokenExpiryNotifiers: strings.Fields(
+			GetOptionalEnvironmentVariable("TOKEN_EXPIRY_NOTIFIERS", strings.Join(defaults.TokenExpiryNotifiers, " ")),
+		),
+		TokenExpiryCheckInterval: GetOptionalDurationEnvironmentVariable(
+			"TOKEN_EXPIRY_CHECK_INTERVAL",
+			defaults.TokenExpiryCheckInterval,
+		),
+		TokenRetention:      GetOptionalDurationEnvironmentVariable("TOKEN_RETENTION", defaults.TokenRetention),
+		TokenReaperInterval: GetOptionalDurationEnvironmentVariable("TOKEN_REAPER_INTERVAL", defaults.TokenReaperInterval),
+		TokenReaperDryRun:   GetOptionalEnvironmentVariable("TOKEN_REAPER_DRY_RUN", "false") == "true",
+		MaxTokenLifetime:    GetOptionalDurationEnvironmentVariable("MAX_TOKEN_LIFETIME", defaults.MaxTokenLifetime),
+		TrustedProxies:      strings.Fields(GetOptionalEnvironmentVariable("TRUSTED_PROXIES", "")),
+	}
+}
+
+func getMasterKeyFromEnvironment() []byte {
+	encodedKey := GetOptionalEnvironmentVariable("MASTER_KEY", "")
+	if encodedKey == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		log.Panicf("Environment variable 'MASTER_KEY' has to be a base64 encoded 32 byte key")
+	}
+
+	return key
+}
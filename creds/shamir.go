@@ -0,0 +1,106 @@
+package creds
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+var errInvalidShares = errors.New("shares have to be distinct and of the same length")
+
+// Arithmetic in GF(2^8) with the AES polynomial, which every byte of a secret is split in separately
+func galoisMultiply(a byte, b byte) byte {
+	product := byte(0)
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+
+	return product
+}
+
+func galoisInverse(a byte) byte {
+	// a^254 is the inverse of a, since a^255 = 1 for every non-zero a
+	inverse := byte(1)
+	for i := 0; i < 254; i++ {
+		inverse = galoisMultiply(inverse, a)
+	}
+
+	return inverse
+}
+
+// Splits a secret into `shares` shares, any `threshold` of which can recover it. Each share is the secret's length
+// plus one byte holding the share's x coordinate.
+func splitSecret(secret []byte, shares int, threshold int) ([][]byte, error) {
+	if threshold < 2 || shares < threshold || shares > 255 || len(secret) == 0 {
+		return nil, errors.New("threshold has to be at least 2 and at most the number of shares, which is at most 255")
+	}
+
+	result := make([][]byte, shares)
+	for i := range result {
+		result[i] = make([]byte, len(secret)+1)
+		result[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold-1)
+	for byteIndex, secretByte := range secret {
+		if _, err := rand.Read(coefficients); err != nil {
+			return nil, err
+		}
+
+		for _, share := range result {
+			x := share[len(secret)]
+			// Horner's method, with the secret byte as the constant term
+			y := byte(0)
+			for i := len(coefficients) - 1; i >= 0; i-- {
+				y = galoisMultiply(y, x) ^ coefficients[i]
+			}
+			share[byteIndex] = galoisMultiply(y, x) ^ secretByte
+		}
+	}
+
+	return result, nil
+}
+
+// Recovers a secret from shares made by `splitSecret`. Too few shares give a wrong secret rather than an error, so
+// the result has to be checked by the caller.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errInvalidShares
+	}
+
+	length := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != length || length < 2 || share[length-1] == 0 || seen[share[length-1]] {
+			return nil, errInvalidShares
+		}
+		seen[share[length-1]] = true
+	}
+
+	secret := make([]byte, length-1)
+	for i, share := range shares {
+		x := share[length-1]
+		// Lagrange basis polynomial for this share, evaluated at 0; subtraction is addition in GF(2^8)
+		basis := byte(1)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+			otherX := other[length-1]
+			basis = galoisMultiply(basis, galoisMultiply(otherX, galoisInverse(x^otherX)))
+		}
+
+		for byteIndex := range secret {
+			secret[byteIndex] ^= galoisMultiply(share[byteIndex], basis)
+		}
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,43 @@
+package creds
+
+import (
+	"bytes"
+	"crypto/rand"
+	"log"
+	"testing"
+)
+
+func TestShamirSecretSharing(t *testing.T) {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+
+	shares, err := splitSecret(secret, 5, 3)
+	if err != nil {
+		log.Panicf("Unable to split secret: %s", err.Error())
+	}
+
+	subsets := [][][]byte{
+		{shares[0], shares[1], shares[2]},
+		{shares[4], shares[2], shares[0]},
+		{shares[1], shares[3], shares[4], shares[0]},
+	}
+	for _, subset := range subsets {
+		combined, err := combineShares(subset)
+		if err != nil || !bytes.Equal(combined, secret) {
+			log.Panicf("Unable to recover secret from %d shares: %v", len(subset), err)
+		}
+	}
+
+	combined, _ := combineShares(shares[:2])
+	if bytes.Equal(combined, secret) {
+		log.Panicf("Secret recovered from fewer shares than the threshold")
+	}
+
+	if _, err := combineShares([][]byte{shares[0], shares[0], shares[1]}); err == nil {
+		log.Panicf("Duplicate shares were accepted")
+	}
+
+	if _, err := splitSecret(secret, 2, 3); err == nil {
+		log.Panicf("Threshold above the number of shares was accepted")
+	}
+}
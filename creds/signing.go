@@ -0,0 +1,415 @@
+package creds
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+)
+
+// Credentials for clients that sign their requests with HMAC-SHA256 instead of sending a bearer token. The secret is
+// only returned once, when the key is created.
+type SigningKey struct {
+	Id              uuid.UUID `json:"id" pg:"type:uuid,pk"`
+	AccessKeyId     string    `json:"accessKeyId" pg:",notnull,unique"`
+	EncryptedSecret []byte    `json:"-" pg:",notnull"`
+	Scope           string    `json:"scope" pg:",notnull"`
+	UserId          uuid.UUID `json:"userId" pg:"type:uuid,notnull"`
+	User            *User     `json:"user" pg:"rel:has-one"`
+	Start           time.Time `json:"start" pg:",notnull"`
+	End             time.Time `json:"end" pg:",notnull"`
+}
+
+// Nonces that have been seen, kept until the request they were part of would be rejected for its age anyway.
+type UsedNonce struct {
+	Namespace string    `pg:",pk"`
+	Nonce     string    `pg:",pk"`
+	ExpiresAt time.Time `pg:",notnull"`
+}
+
+type ReplayedNonceError struct {
+	Nonce string
+}
+
+func (replayedNonceError ReplayedNonceError) Error() string {
+	return fmt.Sprintf("Nonce '%s' has already been used", replayedNonceError.Nonce)
+}
+
+func signingKeyAssociatedData(accessKeyId string) []byte {
+	return []byte(fmt.Sprintf("signing-key:%s", accessKeyId))
+}
+
+func generateAccessKeyId() (string, error) {
+	bytes := make([]byte, 10)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return "CK" + base32.StdEncoding.EncodeToString(bytes), nil
+}
+
+func insertSigningKey(
+	database *pg.DB,
+	keyring *keyring,
+	userId uuid.UUID,
+	scope string,
+	start time.Time,
+	end time.Time,
+) (*SigningKey, []byte, error) {
+	accessKeyId, err := generateAccessKeyId()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+
+	encryptedSecret, err := keyring.encrypt(secret, signingKeyAssociatedData(accessKeyId))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if start.IsZero() {
+		start = time.Now()
+	}
+	if end.IsZero() {
+		end = time.Now().AddDate(1, 0, 0)
+	}
+	signingKey := SigningKey{
+		Id:              uuid.New(),
+		AccessKeyId:     accessKeyId,
+		EncryptedSecret: encryptedSecret,
+		Scope:           scope,
+		UserId:          userId,
+		User:            nil,
+		Start:           start,
+		End:             end,
+	}
+
+	if _, err := database.Model(&signingKey).Insert(); err != nil {
+		if strings.Contains(err.Error(), "signing_keys_user_id_fkey") {
+			return nil, nil, NoSuchUserError{UserId: userId}
+		}
+
+		return nil, nil, err
+	}
+
+	return &signingKey, secret, nil
+}
+
+// Records a nonce as used, failing with `ReplayedNonceError` if it has been seen before within its lifetime.
+func useNonce(database *pg.DB, namespace string, nonce string, expiresAt time.Time) error {
+	if _, err := database.Model((*UsedNonce)(nil)).Where("expires_at < ?", time.Now()).Delete(); err != nil {
+		return err
+	}
+
+	usedNonce := UsedNonce{Namespace: namespace, Nonce: nonce, ExpiresAt: expiresAt}
+	result, err := database.Model(&usedNonce).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ReplayedNonceError{Nonce: nonce}
+	}
+
+	return nil
+}
+
+// The string a client signs:
+//
+//	METHOD \n PATH \n CANONICAL QUERY \n TIMESTAMP \n NONCE \n HEX(SHA256(BODY))
+//
+// where the canonical query has its parameters sorted by key and then value, and the timestamp is in Unix seconds.
+func canonicalRequestString(method string, path string, query string, timestamp int64, nonce string, bodyHash string) (string, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parameters := make([]string, 0)
+	for _, key := range keys {
+		valuesForKey := values[key]
+		sort.Strings(valuesForKey)
+		for _, value := range valuesForKey {
+			parameters = append(parameters, fmt.Sprintf("%s=%s", url.QueryEscape(key), url.QueryEscape(value)))
+		}
+	}
+
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		strings.Join(parameters, "&"),
+		fmt.Sprintf("%d", timestamp),
+		nonce,
+		strings.ToLower(bodyHash),
+	}, "\n"), nil
+}
+
+func signRequestString(secret []byte, canonicalRequest string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonicalRequest))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type addSigningKeyParameters struct {
+	UserId uuid.UUID
+	Scope  null.String
+	Start  time.Time
+	End    time.Time
+}
+
+type addSigningKeyResponse struct {
+	Id          uuid.UUID `json:"id"`
+	AccessKeyId string    `json:"accessKeyId"`
+	Secret      string    `json:"secret"`
+}
+
+func handleAddSigningKey(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters addSigningKeyParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for adding signing key: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if parameters.UserId.ID() == 0 || !parameters.Scope.Valid {
+			response := addTokenParametersError{UserId: parameters.UserId.ID() == 0, Scope: !parameters.Scope.Valid}
+			http.Error(writer, response.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		signingKey, secret, err := insertSigningKey(database,
+			keyring,
+			parameters.UserId,
+			parameters.Scope.String,
+			parameters.Start,
+			parameters.End,
+		)
+		if err != nil {
+			if _, ok := err.(NoSuchUserError); ok {
+				response := fmt.Sprintf("Unable to create signing key: %s", err.Error())
+				http.Error(writer, response, http.StatusNotFound)
+
+				return
+			}
+			response := fmt.Sprintf("Unable to create signing key: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(addSigningKeyResponse{
+			Id:          signingKey.Id,
+			AccessKeyId: signingKey.AccessKeyId,
+			Secret:      base64.StdEncoding.EncodeToString(secret),
+		})
+	}
+}
+
+func handleGetSigningKeys(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		signingKeys := make([]SigningKey, 0)
+		if err := database.Model(&signingKeys).Select(); err != nil {
+			response := fmt.Sprintf("Error getting signing keys")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if err := json.NewEncoder(writer).Encode(signingKeys); err != nil {
+			fmt.Printf("Unable to write signing key list to socket: %s", err.Error())
+		}
+	}
+}
+
+func handleDeleteSigningKey(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		signingKey := SigningKey{Id: id}
+		result, err := database.Model(&signingKey).WherePK().Delete()
+		if err != nil {
+			response := fmt.Sprintf("Unable to delete signing key: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if result.RowsAffected() == 0 {
+			response := fmt.Sprintf("Signing key with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
+
+type verifySignatureParameters struct {
+	AccessKeyId string
+	Signature   string
+	Method      string
+	Path        string
+	Query       string
+	Timestamp   int64
+	Nonce       string
+	BodyHash    string
+}
+
+type verifySignatureResponse struct {
+	UserId      uuid.UUID `json:"userId"`
+	Username    string    `json:"username"`
+	AccessKeyId string    `json:"accessKeyId"`
+	Scopes      []string  `json:"scopes"`
+}
+
+func handleVerifySignature(database *pg.DB, adminScope string, keyring *keyring, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		verifier, err := authenticateRequest(database, request)
+		if err != nil || !(verifier.hasScope(settings.IntrospectionScope) || verifier.hasScope(adminScope)) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters verifySignatureParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for verifying signature: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if parameters.Nonce == "" {
+			http.Error(writer, "'nonce' missing", http.StatusBadRequest)
+
+			return
+		}
+
+		now := time.Now()
+		timestamp := time.Unix(parameters.Timestamp, 0)
+		if timestamp.Before(now.Add(-settings.SignatureMaxSkew)) || timestamp.After(now.Add(settings.SignatureMaxSkew)) {
+			http.Error(writer, "Request timestamp is outside of the allowed clock skew", http.StatusUnauthorized)
+
+			return
+		}
+
+		signingKey := SigningKey{}
+		if err := database.Model(&signingKey).
+			Relation("User").
+			Where("access_key_id = ?", parameters.AccessKeyId).
+			Where("signing_key.start <= ? AND signing_key.\"end\" > ?", now, now).
+			Select(); err != nil {
+			http.Error(writer, "Invalid signature", http.StatusUnauthorized)
+
+			return
+		}
+		secret, err := keyring.decrypt(signingKey.EncryptedSecret, signingKeyAssociatedData(signingKey.AccessKeyId))
+		if err != nil {
+			response := fmt.Sprintf("Unable to decrypt signing key: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		canonicalRequest, err := canonicalRequestString(parameters.Method,
+			parameters.Path,
+			parameters.Query,
+			parameters.Timestamp,
+			parameters.Nonce,
+			parameters.BodyHash,
+		)
+		if err != nil {
+			response := fmt.Sprintf("Unable to build canonical request: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		// Keys of suspended and deactivated users fail like their tokens do, and like a wrong signature so that
+		// callers without the secret can't tell whose key an access key id is
+		expected := signRequestString(secret, canonicalRequest)
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(parameters.Signature))) || signingKey.User.Status != ActiveUser {
+			http.Error(writer, "Invalid signature", http.StatusUnauthorized)
+
+			return
+		}
+
+		namespace := fmt.Sprintf("signature:%s", signingKey.AccessKeyId)
+		if err := useNonce(database, namespace, parameters.Nonce, timestamp.Add(settings.SignatureMaxSkew)); err != nil {
+			if _, ok := err.(ReplayedNonceError); ok {
+				http.Error(writer, err.Error(), http.StatusUnauthorized)
+
+				return
+			}
+			response := fmt.Sprintf("Unable to record nonce: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(verifySignatureResponse{
+			UserId:      signingKey.UserId,
+			Username:    signingKey.User.Username,
+			AccessKeyId: signingKey.AccessKeyId,
+			Scopes:      parseScopes(signingKey.Scope),
+		})
+	}
+}
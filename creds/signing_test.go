@@ -0,0 +1,82 @@
+package creds
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestCanonicalRequestString(t *testing.T) {
+	canonicalRequest, err := canonicalRequestString("post",
+		"/hooks/incoming",
+		"b=2&a=3&a=1",
+		1600000000,
+		"a-nonce",
+		"E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855",
+	)
+	if err != nil {
+		log.Panicf("Unable to build canonical request: %s", err.Error())
+	}
+
+	expected := "POST\n/hooks/incoming\na=1&a=3&b=2\n1600000000\na-nonce\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if canonicalRequest != expected {
+		log.Panicf("Unexpected canonical request:\n%s\nExpected:\n%s", canonicalRequest, expected)
+	}
+
+	if signRequestString([]byte("secret"), canonicalRequest) == signRequestString([]byte("other"), canonicalRequest) {
+		log.Panicf("Signatures with different secrets are equal")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	keyring, _ := setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Signer", "signer")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	signingKey, secret, err := insertSigningKey(setup.database, keyring, userId, "hooks", time.Time{}, time.Time{})
+	if err != nil {
+		log.Panicf("Unable to add signing key: %s", err.Error())
+	}
+
+	verify := func(nonce string, expected int) *httptest.ResponseRecorder {
+		timestamp := time.Now().Unix()
+		canonicalRequest, err := canonicalRequestString("POST", "/hooks", "", timestamp, nonce, "")
+		if err != nil {
+			log.Panicf("Unable to build canonical request: %s", err.Error())
+		}
+		body := fmt.Sprintf(`{"accessKeyId": "%s", "signature": "%s", "method": "POST", "path": "/hooks",
+			"timestamp": %d, "nonce": "%s"}`, signingKey.AccessKeyId, signRequestString(secret, canonicalRequest),
+			timestamp, nonce)
+
+		return expectStatus("POST", "/verify-signature", body, []headerEntry{bearerToken(setup.adminToken)}, router, expected)
+	}
+
+	verify("first", http.StatusOK)
+	verify("first", http.StatusUnauthorized)
+
+	// Signatures of suspended users fail verification like their tokens do,
+	if _, err := setUserStatus(setup.database, userId, SuspendedUser, "Under investigation"); err != nil {
+		log.Panicf("Unable to suspend user: %s", err.Error())
+	}
+	// and look just like a wrong signature, so the response doesn't tell whose key it is
+	recorder := verify("second", http.StatusUnauthorized)
+	if strings.TrimSpace(recorder.Body.String()) != "Invalid signature" {
+		log.Panicf("Suspended user's key was told apart from a wrong signature: %s", recorder.Body.String())
+	}
+	if _, err := setUserStatus(setup.database, userId, ActiveUser, ""); err != nil {
+		log.Panicf("Unable to reactivate user: %s", err.Error())
+	}
+	verify("third", http.StatusOK)
+}
@@ -0,0 +1,253 @@
+package creds
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+const sshCertificateAuthorityKeyName = "ssh-user-certificate-authority"
+
+// Scopes like `ssh:deploy` make the part after the prefix a principal; no other scope ends up in certificates
+const sshPrincipalScopePrefix = "ssh:"
+
+// Audit record of every SSH certificate issued. These are kept after their user is deleted.
+type SshCertificate struct {
+	Serial      int64     `json:"serial" pg:",pk"`
+	KeyId       string    `json:"keyId" pg:",notnull"`
+	UserId      uuid.UUID `json:"userId" pg:"type:uuid,notnull"`
+	TokenId     uuid.UUID `json:"tokenId" pg:"type:uuid,notnull"`
+	Principals  []string  `json:"principals" pg:",array"`
+	Fingerprint string    `json:"fingerprint" pg:",notnull"`
+	ValidAfter  time.Time `json:"validAfter" pg:",notnull"`
+	ValidBefore time.Time `json:"validBefore" pg:",notnull"`
+}
+
+func (keyStore *keyStore) sshCertificateAuthority() (ssh.Signer, error) {
+	key, _, err := keyStore.getOrCreate(sshCertificateAuthorityKeyName, func() (crypto.Signer, []byte, error) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+
+		return key, nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromSigner(key)
+}
+
+// Serials only have to be unique, and random ones don't need coordinating between instances. They're kept positive
+// so they fit in a `bigint`.
+func randomSshSerial() (uint64, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(bytes) >> 1, nil
+}
+
+// The user's username and the principals given by `ssh:` scopes of the token
+func sshPrincipals(username string, scope string) []string {
+	principals := []string{username}
+	seen := map[string]bool{username: true}
+	for _, scope := range parseScopes(scope) {
+		principal := strings.TrimPrefix(scope, sshPrincipalScopePrefix)
+		if principal == scope || principal == "" || seen[principal] {
+			continue
+		}
+
+		seen[principal] = true
+		principals = append(principals, principal)
+	}
+
+	return principals
+}
+
+// Signs a user certificate for the public key, valid for the user's username and the principals the token it was
+// requested with has `ssh:` scopes for, and never for longer than that token.
+func signSshUserCertificate(
+	database *pg.DB,
+	keyStore *keyStore,
+	token *Token,
+	user *User,
+	publicKey ssh.PublicKey,
+	lifetime time.Duration,
+) (*ssh.Certificate, error) {
+	caSigner, err := keyStore.sshCertificateAuthority()
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSshSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	validBefore := now.Add(lifetime)
+	if token.End.Before(validBefore) {
+		validBefore = token.End
+	}
+
+	principals := sshPrincipals(user.Username, token.Scope)
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("%s:%s", user.Username, user.Id),
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+
+	if err := certificate.SignCert(rand.Reader, caSigner); err != nil {
+		return nil, err
+	}
+
+	record := SshCertificate{
+		Serial:      int64(serial),
+		KeyId:       certificate.KeyId,
+		UserId:      user.Id,
+		TokenId:     token.Id,
+		Principals:  principals,
+		Fingerprint: ssh.FingerprintSHA256(publicKey),
+		ValidAfter:  time.Unix(int64(certificate.ValidAfter), 0),
+		ValidBefore: validBefore,
+	}
+	if _, err := database.Model(&record).Insert(); err != nil {
+		return nil, err
+	}
+
+	return certificate, nil
+}
+
+type signSshKeyParameters struct {
+	// Public key in the `authorized_keys` format
+	PublicKey string
+}
+
+type signSshKeyResponse struct {
+	Serial      uint64 `json:"serial"`
+	Certificate string `json:"certificate"`
+}
+
+func handleSignSshKey(database *pg.DB, keyStore *keyStore, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, err := authenticateRequest(database, request)
+		if err != nil {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters signSshKeyParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for signing SSH key: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(parameters.PublicKey))
+		if err != nil {
+			response := fmt.Sprintf("Unable to parse public key: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if _, ok := publicKey.(*ssh.Certificate); ok {
+			http.Error(writer, "Certificates can't be signed, give a plain public key", http.StatusBadRequest)
+
+			return
+		}
+
+		user, err := getUserById(database, token.UserId)
+		if err != nil {
+			response := fmt.Sprintf("Error getting user: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		certificate, err := signSshUserCertificate(database,
+			keyStore,
+			token,
+			user,
+			publicKey,
+			settings.SshCertificateLifetime,
+		)
+		if err != nil {
+			response := fmt.Sprintf("Unable to sign SSH key: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(signSshKeyResponse{
+			Serial:      certificate.Serial,
+			Certificate: string(ssh.MarshalAuthorizedKey(certificate)),
+		})
+	}
+}
+
+// The CA public key in the `authorized_keys` format, for `TrustedUserCAKeys` in `sshd_config`
+func handleGetSshCertificateAuthority(keyStore *keyStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		caSigner, err := keyStore.sshCertificateAuthority()
+		if err != nil {
+			response := fmt.Sprintf("Unable to get SSH CA key: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "text/plain")
+		_, _ = writer.Write(ssh.MarshalAuthorizedKey(caSigner.PublicKey()))
+	}
+}
+
+func handleGetSshCertificates(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		certificates := make([]SshCertificate, 0)
+		if err := database.Model(&certificates).Order("valid_after DESC").Select(); err != nil {
+			response := fmt.Sprintf("Error getting SSH certificates")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if err := json.NewEncoder(writer).Encode(certificates); err != nil {
+			fmt.Printf("Unable to write SSH certificate list to socket: %s", err.Error())
+		}
+	}
+}
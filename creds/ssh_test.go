@@ -0,0 +1,88 @@
+package creds
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSshPrincipals(t *testing.T) {
+	principals := sshPrincipals("test", "admin ssh:deploy reader ssh: ssh:test ssh:deploy ssh:backup")
+	if fmt.Sprint(principals) != "[test deploy backup]" {
+		log.Panicf("Unexpected principals: %v", principals)
+	}
+}
+
+func TestSignSshUserCertificate(t *testing.T) {
+	setup := initializeTestData(nil)
+	keyStore := newKeyStore(setup.database, newKeyring(setup.settings.MasterKey))
+
+	userId, err := insertUser(setup.database, "SSH User", "ssh-user")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	user, err := getUserById(setup.database, userId)
+	if err != nil {
+		log.Panicf("Unable to get user: %s", err.Error())
+	}
+	end := time.Now().Add(time.Hour).Truncate(time.Second)
+	tokenId, err := insertToken(setup.database, userId, "admin ssh:deploy", time.Now(), end, tokenBinding{})
+	if err != nil {
+		log.Panicf("Unable to add token: %s", err.Error())
+	}
+	token, err := getTokenById(setup.database, tokenId)
+	if err != nil {
+		log.Panicf("Unable to get token: %s", err.Error())
+	}
+
+	key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Panicf("Unable to generate key: %s", err.Error())
+	}
+	publicKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		log.Panicf("Unable to convert key: %s", err.Error())
+	}
+
+	certificate, err := signSshUserCertificate(setup.database, keyStore, token, user, publicKey, 16*time.Hour)
+	if err != nil {
+		log.Panicf("Unable to sign certificate: %s", err.Error())
+	}
+
+	if fmt.Sprint(certificate.ValidPrincipals) != "[ssh-user deploy]" {
+		log.Panicf("Unexpected principals: %v", certificate.ValidPrincipals)
+	}
+	if certificate.KeyId != fmt.Sprintf("ssh-user:%s", userId) || certificate.CertType != ssh.UserCert {
+		log.Panicf("Unexpected key id or type: %s, %d", certificate.KeyId, certificate.CertType)
+	}
+	// The lifetime is capped by the token's end
+	if certificate.ValidBefore != uint64(end.Unix()) || certificate.ValidAfter > uint64(time.Now().Unix()) {
+		log.Panicf("Unexpected validity: %d to %d", certificate.ValidAfter, certificate.ValidBefore)
+	}
+
+	caSigner, err := keyStore.sshCertificateAuthority()
+	if err != nil {
+		log.Panicf("Unable to get CA: %s", err.Error())
+	}
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(authority ssh.PublicKey) bool {
+			return string(authority.Marshal()) == string(caSigner.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckCert("deploy", certificate); err != nil {
+		log.Panicf("Certificate doesn't verify against the CA: %s", err.Error())
+	}
+	if err := checker.CheckCert("admin", certificate); err == nil {
+		log.Panicln("Certificate valid for a scope that isn't an SSH principal")
+	}
+
+	record := SshCertificate{Serial: int64(certificate.Serial)}
+	if err := setup.database.Model(&record).WherePK().Select(); err != nil || record.TokenId != tokenId {
+		log.Panicf("Certificate not recorded: %+v, %v", record, err)
+	}
+}
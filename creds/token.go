@@ -1,11 +1,13 @@
 package creds
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 	"github.com/google/uuid"
 )
 
@@ -16,8 +18,37 @@ type Token struct {
 	User   *User     `json:"user" pg:"rel:has-one"`
 	Start  time.Time `json:"start" pg:",notnull"`
 	End    time.Time `json:"end" pg:",notnull"`
+	// When the token was issued, which is not necessarily when it starts being valid
+	CreatedAt time.Time `json:"createdAt" pg:",notnull,default:now()"`
+	// Thumbprint of the client certificate the token is bound to (RFC 8705), if any
+	CertificateThumbprint string `json:"x5t#S256,omitempty"`
+	// Thumbprint of the public key the token is bound to through DPoP (RFC 9449), if any
+	JwkThumbprint string `json:"jkt,omitempty"`
+	// Free-form labels, for telling tokens apart and selecting them
+	Metadata map[string]string `json:"metadata,omitempty" pg:"type:jsonb"`
 }
 
+// What a token is bound to when it's issued; a bound token is only accepted together with proof of possession of
+// the same key.
+type tokenBinding struct {
+	certificateThumbprint string
+	jwkThumbprint         string
+}
+
+// The authorization scheme the token has to be used with
+func (binding tokenBinding) tokenType() string {
+	if binding.jwkThumbprint != "" {
+		return "DPoP"
+	}
+
+	return "Bearer"
+}
+
+var errNoToken = errors.New("no token given")
+var errTokenNotValid = errors.New("token is expired or not yet valid")
+var errUserNotActive = errors.New("token belongs to a suspended or deactivated user")
+var errCertificateMismatch = errors.New("token is bound to a different client certificate")
+
 type NoSuchUserError struct {
 	UserId uuid.UUID
 }
@@ -26,14 +57,16 @@ func (noSuchUserError NoSuchUserError) Error() string {
 	return fmt.Sprintf("User with Id '%s' does not exist", noSuchUserError.UserId)
 }
 
-func insertToken(database *pg.DB, id uuid.UUID, scope string, start time.Time, end time.Time) (uuid.UUID, error) {
+func insertToken(
+	database orm.DB,
+	id uuid.UUID,
+	scope string,
+	start time.Time,
+	end time.Time,
+	binding tokenBinding,
+) (uuid.UUID, error) {
 	tokenId := uuid.New()
-	if start.IsZero() {
-		start = time.Now()
-	}
-	if end.IsZero() {
-		end = time.Now().AddDate(1, 0, 0)
-	}
+	start, end = defaultTokenValidity(start, end)
 	token := Token{
 		Id:     tokenId,
 		Scope:  scope,
@@ -41,6 +74,10 @@ func insertToken(database *pg.DB, id uuid.UUID, scope string, start time.Time, e
 		User:   nil,
 		Start:  start,
 		End:    end,
+
+		CreatedAt:             time.Now(),
+		CertificateThumbprint: binding.certificateThumbprint,
+		JwkThumbprint:         binding.jwkThumbprint,
 	}
 
 	if _, err := database.Model(&token).Insert(); err != nil {
@@ -54,6 +91,91 @@ func insertToken(database *pg.DB, id uuid.UUID, scope string, start time.Time, e
 	return tokenId, nil
 }
 
+// Tokens are valid from now and for a year unless told otherwise
+func defaultTokenValidity(start time.Time, end time.Time) (time.Time, time.Time) {
+	if start.IsZero() {
+		start = time.Now()
+	}
+	if end.IsZero() {
+		end = time.Now().AddDate(1, 0, 0)
+	}
+
+	return start, end
+}
+
+type TokenLifetimeError struct {
+	Reason string
+}
+
+func (tokenLifetimeError TokenLifetimeError) Error() string {
+	return fmt.Sprintf("Token lifetime not allowed: %s", tokenLifetimeError.Reason)
+}
+
+// Checks a token's validity period against the lifetime policy in the settings
+func checkTokenLifetime(settings Settings, start time.Time, end time.Time) error {
+	if !end.After(start) {
+		return TokenLifetimeError{Reason: "'end' has to be after 'start'"}
+	}
+	if settings.MaxTokenLifetime != 0 && end.Sub(start) > settings.MaxTokenLifetime {
+		return TokenLifetimeError{Reason: fmt.Sprintf("tokens can be valid for at most %s", settings.MaxTokenLifetime)}
+	}
+
+	return nil
+}
+
+// Inserts a token along with the event announcing it, in one transaction
+func createToken(
+	database *pg.DB,
+	userId uuid.UUID,
+	scope string,
+	start time.Time,
+	end time.Time,
+	binding tokenBinding,
+) (uuid.UUID, error) {
+	start, end = defaultTokenValidity(start, end)
+	tokenId := uuid.Nil
+	err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		var err error
+		tokenId, err = insertToken(transaction, userId, scope, start, end, binding)
+		if err != nil {
+			return err
+		}
+
+		return recordEvent(transaction, TokenCreatedEvent, tokenEventData{
+			Token:  tokenFingerprint(tokenId),
+			UserId: userId,
+			Scope:  scope,
+			Start:  start,
+			End:    end,
+		})
+	})
+
+	return tokenId, err
+}
+
+// Scopes are stored space-delimited in `Token.Scope`, the same way OAuth 2.0 represents them.
+func parseScopes(scope string) []string {
+	return strings.Fields(scope)
+}
+
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func (token *Token) binding() tokenBinding {
+	return tokenBinding{certificateThumbprint: token.CertificateThumbprint, jwkThumbprint: token.JwkThumbprint}
+}
+
+func (token *Token) hasScope(scope string) bool {
+	for _, tokenScope := range parseScopes(token.Scope) {
+		if tokenScope == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
 func getTokenById(database *pg.DB, id uuid.UUID) (*Token, error) {
 	token := &Token{Id: id}
 
@@ -0,0 +1,424 @@
+package creds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+)
+
+const maximumTokenBatchSize = 1000
+
+var errEmptySelector = errors.New("at least one of 'scope', 'userId', 'labels' and 'createdBefore' has to be given")
+
+// Which tokens a batch operation applies to; a token has to match everything given. Labels are matched against the
+// token's metadata.
+type tokenSelector struct {
+	Scope         string            `json:"scope,omitempty"`
+	UserId        *uuid.UUID        `json:"userId,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	CreatedBefore time.Time         `json:"createdBefore,omitempty"`
+}
+
+// An empty selector would match every token, which is never what's meant during an incident
+func (selector tokenSelector) validate() error {
+	if selector.Scope == "" && selector.UserId == nil && len(selector.Labels) == 0 && selector.CreatedBefore.IsZero() {
+		return errEmptySelector
+	}
+
+	return nil
+}
+
+func (selector tokenSelector) apply(query *orm.Query) (*orm.Query, error) {
+	if selector.Scope != "" {
+		query = query.Where("? = ANY(string_to_array(scope, ' '))", selector.Scope)
+	}
+	if selector.UserId != nil {
+		query = query.Where("user_id = ?", *selector.UserId)
+	}
+	if len(selector.Labels) != 0 {
+		labels, err := json.Marshal(selector.Labels)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("metadata @> ?::jsonb", string(labels))
+	}
+	if !selector.CreatedBefore.IsZero() {
+		query = query.Where("created_at < ?", selector.CreatedBefore)
+	}
+
+	return query, nil
+}
+
+// Revokes every token the selector matches in one transaction, archiving them the same way single revocations are.
+// In a dry run only the number of matching tokens is returned.
+func revokeTokens(database *pg.DB, selector tokenSelector, dryRun bool) (int, error) {
+	revoked := 0
+	err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		tokens := make([]Token, 0)
+		query, err := selector.apply(transaction.Model(&tokens))
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			revoked, err = query.Count()
+
+			return err
+		}
+
+		if _, err := query.Returning("*").Delete(); err != nil {
+			return err
+		}
+		revoked = len(tokens)
+		if revoked == 0 {
+			return nil
+		}
+
+		archivedTokens := make([]ArchivedToken, 0, len(tokens))
+		tokenIds := make([]uuid.UUID, 0, len(tokens))
+		for _, token := range tokens {
+			archivedTokens = append(archivedTokens, archiveToken(token, RevokedToken))
+			tokenIds = append(tokenIds, token.Id)
+		}
+		if _, err := transaction.Model(&archivedTokens).Insert(); err != nil {
+			return err
+		}
+		if err := revokeTokenCertificates(transaction, tokenIds...); err != nil {
+			return err
+		}
+
+		for _, token := range tokens {
+			if err := recordEvent(transaction, TokenDeletedEvent, tokenEventData{
+				Token:  tokenFingerprint(token.Id),
+				UserId: token.UserId,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return revoked, err
+}
+
+type batchRevokeParameters struct {
+	Selector tokenSelector
+	DryRun   bool
+}
+
+type batchRevokeResponse struct {
+	Count  int  `json:"count"`
+	DryRun bool `json:"dryRun"`
+}
+
+func handleBatchRevokeTokens(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters batchRevokeParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for revoking tokens: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if err := parameters.Selector.validate(); err != nil {
+			response := fmt.Sprintf("Invalid selector: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		count, err := revokeTokens(database, parameters.Selector, parameters.DryRun)
+		if err != nil {
+			response := fmt.Sprintf("Unable to revoke tokens: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		response := batchRevokeResponse{Count: count, DryRun: parameters.DryRun}
+		if detail, err := json.Marshal(struct {
+			Selector tokenSelector `json:"selector"`
+			batchRevokeResponse
+		}{parameters.Selector, response}); err == nil {
+			setAuditDetail(request, string(detail))
+		}
+
+		_ = json.NewEncoder(writer).Encode(response)
+	}
+}
+
+// A service account to provision along with its token, instead of issuing the token for an existing user
+type batchServiceAccountParameters struct {
+	Username      string
+	Name          string
+	OwnerId       *uuid.UUID
+	OwnerGroup    string
+	DefaultScopes []string
+}
+
+// One token of a batch, for either an existing user or a new service account
+type batchTokenParameters struct {
+	UserId         uuid.UUID
+	ServiceAccount *batchServiceAccountParameters
+	Scope          null.String
+	Start          time.Time
+	End            time.Time
+	Metadata       map[string]string
+}
+
+type batchCreateParameters struct {
+	Tokens []batchTokenParameters
+}
+
+// Why a token of a batch couldn't be created. `Cause` is the underlying error, when there is one.
+type BatchTokenError struct {
+	Index  int
+	Reason string
+	Cause  error
+}
+
+func (batchTokenError BatchTokenError) Error() string {
+	return fmt.Sprintf("Token %d %s", batchTokenError.Index, batchTokenError.Reason)
+}
+
+func batchTokenCause(index int, cause error) BatchTokenError {
+	return BatchTokenError{Index: index, Reason: cause.Error(), Cause: cause}
+}
+
+type batchCreatedToken struct {
+	UserId uuid.UUID `json:"userId"`
+	Token  uuid.UUID `json:"token"`
+}
+
+// A checked batch: the service accounts to provision, by the index of the token they're for, and every token
+type preparedTokenBatch struct {
+	serviceAccounts map[int]User
+	tokens          []Token
+}
+
+// Service accounts of a batch are checked like the ones added through `POST /users`
+func prepareBatchServiceAccount(index int, parameters *batchServiceAccountParameters) (User, error) {
+	userParameters := addUserParameters{
+		Username:      null.NewString(parameters.Username, parameters.Username != ""),
+		Name:          null.NewString(parameters.Name, parameters.Name != ""),
+		Kind:          ServiceAccount,
+		OwnerId:       parameters.OwnerId,
+		OwnerGroup:    null.NewString(parameters.OwnerGroup, parameters.OwnerGroup != ""),
+		DefaultScopes: parameters.DefaultScopes,
+	}
+	if err := userParameters.validate(); err != nil {
+		return User{}, BatchTokenError{Index: index, Reason: fmt.Sprintf("has an invalid service account: %s", err.Error())}
+	}
+
+	return newServiceAccount(
+		parameters.Name,
+		parameters.Username,
+		parameters.OwnerId,
+		parameters.OwnerGroup,
+		parameters.DefaultScopes...,
+	), nil
+}
+
+// Checks every token of a batch up front, so that nothing is written unless all of them can be issued
+func prepareTokenBatch(settings Settings, parameters []batchTokenParameters) (*preparedTokenBatch, error) {
+	if len(parameters) == 0 || len(parameters) > maximumTokenBatchSize {
+		return nil, fmt.Errorf("Batches have to have between 1 and %d tokens", maximumTokenBatchSize)
+	}
+
+	now := time.Now()
+	batch := &preparedTokenBatch{serviceAccounts: make(map[int]User), tokens: make([]Token, 0, len(parameters))}
+	usernames := make(map[string]bool)
+	for index, token := range parameters {
+		if (token.UserId == uuid.Nil) == (token.ServiceAccount == nil) {
+			return nil, BatchTokenError{Index: index, Reason: "has to have either 'userId' or 'serviceAccount'"}
+		}
+
+		if !token.Scope.Valid {
+			return nil, BatchTokenError{Index: index, Reason: "has 'scope' missing"}
+		}
+
+		userId := token.UserId
+		if token.ServiceAccount != nil {
+			serviceAccount, err := prepareBatchServiceAccount(index, token.ServiceAccount)
+			if err != nil {
+				return nil, err
+			}
+			if usernames[serviceAccount.Username] {
+				reason := fmt.Sprintf("has a service account with the username of an earlier one: '%s'", serviceAccount.Username)
+				return nil, BatchTokenError{Index: index, Reason: reason}
+			}
+			usernames[serviceAccount.Username] = true
+			batch.serviceAccounts[index] = serviceAccount
+			userId = serviceAccount.Id
+		}
+
+		start, end := defaultTokenValidity(token.Start, token.End)
+		if token.End.IsZero() && settings.MaxTokenLifetime != 0 && end.Sub(start) > settings.MaxTokenLifetime {
+			end = start.Add(settings.MaxTokenLifetime)
+		}
+		if err := checkTokenLifetime(settings, start, end); err != nil {
+			return nil, batchTokenCause(index, err)
+		}
+		if err := validateMetadata(token.Metadata); err != nil {
+			return nil, batchTokenCause(index, err)
+		}
+
+		batch.tokens = append(batch.tokens, Token{
+			Id:        uuid.New(),
+			Scope:     token.Scope.String,
+			UserId:    userId,
+			Start:     start,
+			End:       end,
+			CreatedAt: now,
+			Metadata:  token.Metadata,
+		})
+	}
+
+	return batch, nil
+}
+
+// Provisions the service accounts and issues all tokens of a batch in one transaction, or does none of it
+func createTokenBatch(database *pg.DB, batch *preparedTokenBatch) error {
+	return database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		known := make(map[uuid.UUID]bool)
+		for index, token := range batch.tokens {
+			serviceAccount, ok := batch.serviceAccounts[index]
+			if !ok {
+				continue
+			}
+
+			if serviceAccount.OwnerId != nil {
+				if err := validateOwner(transaction, *serviceAccount.OwnerId); err != nil {
+					return batchTokenCause(index, err)
+				}
+			}
+			if _, err := transaction.Model(&serviceAccount).Insert(); err != nil {
+				if isUniqueViolation(err) {
+					reason := fmt.Sprintf("has a service account with a username that's taken: '%s'", serviceAccount.Username)
+					return BatchTokenError{Index: index, Reason: reason, Cause: err}
+				}
+
+				return err
+			}
+			if err := recordEvent(transaction, UserCreatedEvent, userEventData{
+				UserId: serviceAccount.Id,
+				Name:   serviceAccount.Name,
+				Kind:   serviceAccount.Kind,
+			}); err != nil {
+				return err
+			}
+			known[token.UserId] = true
+		}
+
+		userIds := make([]uuid.UUID, 0, len(batch.tokens))
+		for _, token := range batch.tokens {
+			if !known[token.UserId] {
+				userIds = append(userIds, token.UserId)
+			}
+		}
+		if len(userIds) != 0 {
+			users := make([]User, 0)
+			if err := transaction.Model(&users).Column("id").Where("id IN (?)", pg.In(userIds)).Select(); err != nil {
+				return err
+			}
+			for _, user := range users {
+				known[user.Id] = true
+			}
+		}
+		for index, token := range batch.tokens {
+			if !known[token.UserId] {
+				return batchTokenCause(index, NoSuchUserError{UserId: token.UserId})
+			}
+		}
+
+		if _, err := transaction.Model(&batch.tokens).Insert(); err != nil {
+			return err
+		}
+
+		for _, token := range batch.tokens {
+			if err := recordEvent(transaction, TokenCreatedEvent, tokenEventData{
+				Token:  tokenFingerprint(token.Id),
+				UserId: token.UserId,
+				Scope:  token.Scope,
+				Start:  token.Start,
+				End:    token.End,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func handleBatchCreateTokens(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters batchCreateParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for adding tokens: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		batch, err := prepareTokenBatch(settings, parameters.Tokens)
+		if err != nil {
+			response := fmt.Sprintf("Unable to create tokens: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		if err := createTokenBatch(database, batch); err != nil {
+			response := fmt.Sprintf("Unable to create tokens: %s", err.Error())
+			if batchErr, ok := err.(BatchTokenError); ok {
+				status := http.StatusBadRequest
+				if _, ok := batchErr.Cause.(NoSuchUserError); ok {
+					status = http.StatusNotFound
+				} else if isUniqueViolation(batchErr.Cause) {
+					status = http.StatusConflict
+				}
+				http.Error(writer, response, status)
+
+				return
+			}
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		created := make([]batchCreatedToken, 0, len(batch.tokens))
+		for _, token := range batch.tokens {
+			created = append(created, batchCreatedToken{UserId: token.UserId, Token: token.Id})
+		}
+		setAuditDetail(request, fmt.Sprintf(`{"count":%d,"serviceAccounts":%d}`, len(created), len(batch.serviceAccounts)))
+
+		_ = json.NewEncoder(writer).Encode(created)
+	}
+}
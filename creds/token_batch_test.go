@@ -0,0 +1,170 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/guregu/null.v4"
+)
+
+func TestTokenSelectorValidation(t *testing.T) {
+	if err := (tokenSelector{}).validate(); err == nil {
+		log.Panicln("Empty selector allowed")
+	}
+
+	userId := uuid.New()
+	selectors := []tokenSelector{
+		{Scope: "reader"},
+		{UserId: &userId},
+		{Labels: map[string]string{"team": "ops"}},
+		{CreatedBefore: time.Now()},
+	}
+	for _, selector := range selectors {
+		if err := selector.validate(); err != nil {
+			log.Panicf("Selector not allowed: %+v", selector)
+		}
+	}
+}
+
+func TestPrepareTokenBatch(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MaxTokenLifetime = 24 * time.Hour
+	userId := uuid.New()
+
+	serviceAccount := &batchServiceAccountParameters{Username: "ci", Name: "CI", OwnerGroup: "ops"}
+	batch, err := prepareTokenBatch(settings, []batchTokenParameters{
+		{UserId: userId, Scope: null.StringFrom("reader")},
+		{UserId: userId, Scope: null.StringFrom("writer"), Metadata: map[string]string{"team": "ops"}},
+		{ServiceAccount: serviceAccount, Scope: null.StringFrom("deploy")},
+	})
+	if err != nil {
+		log.Panicf("Unable to prepare batch: %s", err.Error())
+	}
+	tokens := batch.tokens
+	if len(tokens) != 3 || tokens[0].Id == tokens[1].Id {
+		log.Panicf("Unexpected tokens: %+v", tokens)
+	}
+	if lifetime := tokens[0].End.Sub(tokens[0].Start); lifetime != settings.MaxTokenLifetime {
+		log.Panicf("Default end not limited to the maximum lifetime: %s", lifetime)
+	}
+	if account, ok := batch.serviceAccounts[2]; !ok || account.Kind != ServiceAccount || tokens[2].UserId != account.Id {
+		log.Panicf("Token not issued for the new service account: %+v", batch.serviceAccounts)
+	}
+
+	start := time.Now()
+	scope := null.StringFrom("reader")
+	invalidBatches := [][]batchTokenParameters{
+		{},
+		{{Scope: scope}},
+		{{UserId: userId}},
+		{{UserId: userId, Scope: scope, Start: start, End: start.Add(48 * time.Hour)}},
+		{{UserId: userId, Scope: scope, Metadata: map[string]string{"": "empty"}}},
+		{{UserId: userId, Scope: scope, ServiceAccount: serviceAccount}},
+		{{ServiceAccount: &batchServiceAccountParameters{Username: "ci", Name: "CI"}, Scope: scope}},
+		{{ServiceAccount: &batchServiceAccountParameters{Name: "CI", OwnerGroup: "ops"}, Scope: scope}},
+		{{ServiceAccount: serviceAccount, Scope: scope}, {ServiceAccount: serviceAccount, Scope: scope}},
+	}
+	for _, batch := range invalidBatches {
+		if _, err := prepareTokenBatch(settings, batch); err == nil {
+			log.Panicf("Invalid batch prepared: %+v", batch)
+		}
+	}
+}
+
+func TestBatchTokens(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userIds := make([]uuid.UUID, 0)
+	for index := 0; index < 3; index++ {
+		userId, err := insertServiceAccount(setup.database, "CI", fmt.Sprintf("ci-%d", index), &setup.adminId, "")
+		if err != nil {
+			log.Panicf("Unable to add service account: %s", err.Error())
+		}
+		userIds = append(userIds, userId)
+	}
+
+	headers := []headerEntry{bearerToken(setup.adminToken)}
+
+	batch := fmt.Sprintf(`{"tokens": [
+		{"userId": "%s", "scope": "deploy", "metadata": {"incident": "INC-1"}},
+		{"userId": "%s", "scope": "deploy", "metadata": {"incident": "INC-1"}},
+		{"userId": "%s", "scope": "reader"}
+	]}`, userIds[0], userIds[1], userIds[2])
+	recorder := expectStatus("POST", "/tokens:batchCreate", batch, headers, router, http.StatusOK)
+	created := make([]batchCreatedToken, 0)
+	if err := json.NewDecoder(recorder.Body).Decode(&created); err != nil {
+		log.Panicf("Unable to decode created tokens: %s", err.Error())
+	}
+	if len(created) != 3 || created[2].UserId != userIds[2] {
+		log.Panicf("Unexpected created tokens: %+v", created)
+	}
+
+	// Nothing of a batch is created when one of its tokens can't be
+	unknownUser := fmt.Sprintf(`{"tokens": [{"userId": "%s", "scope": "x"}, {"userId": "%s", "scope": "x"}]}`,
+		userIds[0], uuid.New())
+	expectStatus("POST", "/tokens:batchCreate", unknownUser, headers, router, http.StatusNotFound)
+	missingScope := fmt.Sprintf(`{"tokens": [{"userId": "%s", "scope": "x"}, {"userId": "%s"}]}`, userIds[0], userIds[1])
+	expectStatus("POST", "/tokens:batchCreate", missingScope, headers, router, http.StatusBadRequest)
+	if count, err := setup.database.Model((*Token)(nil)).Where("scope = 'x'").Count(); err != nil || count != 0 {
+		log.Panicf("Partial batch created: %d, %v", count, err)
+	}
+
+	// Service accounts are provisioned along with their tokens, and not at all when the batch fails
+	provision := fmt.Sprintf(`{"tokens": [
+		{"serviceAccount": {"username": "deploy-a", "name": "Deploy A", "ownerId": "%s"}, "scope": "ci"},
+		{"serviceAccount": {"username": "deploy-b", "name": "Deploy B", "ownerGroup": "ops"}, "scope": "ci"}
+	]}`, setup.adminId)
+	recorder = expectStatus("POST", "/tokens:batchCreate", provision, headers, router, http.StatusOK)
+	provisioned := make([]batchCreatedToken, 0)
+	if err := json.NewDecoder(recorder.Body).Decode(&provisioned); err != nil {
+		log.Panicf("Unable to decode created tokens: %s", err.Error())
+	}
+	for _, token := range provisioned {
+		user, err := getUserById(setup.database, token.UserId)
+		if err != nil || user.Kind != ServiceAccount {
+			log.Panicf("Service account not provisioned: %+v, %v", user, err)
+		}
+	}
+	taken := `{"tokens": [
+		{"serviceAccount": {"username": "deploy-c", "name": "Deploy C", "ownerGroup": "ops"}, "scope": "ci"},
+		{"serviceAccount": {"username": "deploy-a", "name": "Deploy A", "ownerGroup": "ops"}, "scope": "ci"}
+	]}`
+	expectStatus("POST", "/tokens:batchCreate", taken, headers, router, http.StatusConflict)
+	if _, err := getUserByUsername(setup.database, "deploy-c"); err == nil {
+		log.Panicln("Service account of a failed batch provisioned")
+	}
+
+	expectStatus("POST", "/tokens:batchRevoke", `{"selector": {}}`, headers, router, http.StatusBadRequest)
+
+	dryRun := `{"selector": {"labels": {"incident": "INC-1"}}, "dryRun": true}`
+	recorder = expectStatus("POST", "/tokens:batchRevoke", dryRun, headers, router, http.StatusOK)
+	response := batchRevokeResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response.Count != 2 {
+		log.Panicf("Unexpected dry run: %+v, %v", response, err)
+	}
+	if _, err := getTokenById(setup.database, created[0].Token); err != nil {
+		log.Panicf("Dry run revoked a token: %s", err.Error())
+	}
+
+	recorder = expectStatus("POST", "/tokens:batchRevoke", `{"selector": {"scope": "deploy"}}`, headers, router, http.StatusOK)
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response.Count != 2 {
+		log.Panicf("Unexpected revocation: %+v, %v", response, err)
+	}
+	for _, token := range created {
+		_, err := getTokenById(setup.database, token.Token)
+		if revoked := err != nil; revoked != (token.UserId != userIds[2]) {
+			log.Panicf("Wrong tokens revoked, token of %s revoked: %t", token.UserId, revoked)
+		}
+	}
+
+	expectStatus("POST", "/tokens:batchUpdate", `{}`, headers, router, http.StatusNotFound)
+}
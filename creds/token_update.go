@@ -0,0 +1,283 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+// The fields of a token that can be patched. What a token is bound to can't change, that takes a new token.
+var patchableTokenFields = []string{"scope", "start", "end", "metadata"}
+
+const (
+	maximumMetadataEntries     = 64
+	maximumMetadataKeyLength   = 128
+	maximumMetadataValueLength = 1024
+)
+
+type TokenPatchError struct {
+	Field  string
+	Reason string
+}
+
+func (tokenPatchError TokenPatchError) Error() string {
+	return fmt.Sprintf("'%s' %s", tokenPatchError.Field, tokenPatchError.Reason)
+}
+
+// Scopes a patch adds to a token that its user doesn't have by default
+type TokenScopeError struct {
+	Scopes []string
+}
+
+func (tokenScopeError TokenScopeError) Error() string {
+	return fmt.Sprintf("Token can't be given scopes its user doesn't have: %v", tokenScopeError.Scopes)
+}
+
+func tokenPatchFieldValues(token *Token) map[string]interface{} {
+	return map[string]interface{}{
+		"scope":    token.Scope,
+		"start":    token.Start,
+		"end":      token.End,
+		"metadata": token.Metadata,
+	}
+}
+
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maximumMetadataEntries {
+		return TokenPatchError{Field: "metadata", Reason: fmt.Sprintf("can have at most %d entries", maximumMetadataEntries)}
+	}
+
+	for key, value := range metadata {
+		if key == "" || len(key) > maximumMetadataKeyLength {
+			reason := fmt.Sprintf("keys have to be between 1 and %d characters", maximumMetadataKeyLength)
+			return TokenPatchError{Field: "metadata", Reason: reason}
+		}
+		if len(value) > maximumMetadataValueLength {
+			reason := fmt.Sprintf("values can be at most %d characters", maximumMetadataValueLength)
+			return TokenPatchError{Field: "metadata", Reason: reason}
+		}
+	}
+
+	return nil
+}
+
+// Applies a JSON Merge Patch (RFC 7396) to a token. Metadata is merged key by key, so single entries can be set or
+// removed with `null` without repeating the others.
+func applyTokenPatch(token *Token, patch map[string]json.RawMessage) error {
+	if field := unknownPatchField(patch, patchableTokenFields); field != "" {
+		return TokenPatchError{Field: field, Reason: "can't be changed"}
+	}
+
+	if value, ok := patch["scope"]; ok {
+		if err := json.Unmarshal(value, &token.Scope); err != nil || isNullPatchValue(value) {
+			return TokenPatchError{Field: "scope", Reason: "has to be a string of space-delimited scopes"}
+		}
+	}
+
+	if value, ok := patch["start"]; ok {
+		if err := json.Unmarshal(value, &token.Start); err != nil || isNullPatchValue(value) {
+			return TokenPatchError{Field: "start", Reason: "has to be a timestamp"}
+		}
+	}
+
+	if value, ok := patch["end"]; ok {
+		if err := json.Unmarshal(value, &token.End); err != nil || isNullPatchValue(value) {
+			return TokenPatchError{Field: "end", Reason: "has to be a timestamp"}
+		}
+	}
+
+	if value, ok := patch["metadata"]; ok {
+		var entries map[string]*string
+		if err := json.Unmarshal(value, &entries); err != nil {
+			return TokenPatchError{Field: "metadata", Reason: "has to be an object of strings or null"}
+		}
+
+		metadata := make(map[string]string)
+		if entries != nil {
+			for key, value := range token.Metadata {
+				metadata[key] = value
+			}
+		}
+		for key, value := range entries {
+			if value == nil {
+				delete(metadata, key)
+			} else {
+				metadata[key] = *value
+			}
+		}
+		if len(metadata) == 0 {
+			metadata = nil
+		}
+		token.Metadata = metadata
+
+		if err := validateMetadata(token.Metadata); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The scopes `after` has that `before` doesn't
+func addedScopes(before string, after string) []string {
+	added := make([]string, 0)
+	for _, scope := range parseScopes(after) {
+		token := Token{Scope: before}
+		if !token.hasScope(scope) {
+			added = append(added, scope)
+		}
+	}
+
+	return added
+}
+
+// Scopes can only be added to a token when its user has them by default, so that patching a token never gives it
+// more than the user could get by logging in.
+func checkAddedScopes(transaction *pg.Tx, userId uuid.UUID, added []string) error {
+	if len(added) == 0 {
+		return nil
+	}
+
+	user := User{Id: userId}
+	if err := transaction.Model(&user).WherePK().Select(); err != nil {
+		return err
+	}
+
+	notAllowed := make([]string, 0)
+	for _, scope := range added {
+		allowed := false
+		for _, defaultScope := range user.DefaultScopes {
+			allowed = allowed || scope == defaultScope
+		}
+		if !allowed {
+			notAllowed = append(notAllowed, scope)
+		}
+	}
+	if len(notAllowed) != 0 {
+		return TokenScopeError{Scopes: notAllowed}
+	}
+
+	return nil
+}
+
+func handlePatchToken(database *pg.DB, adminScope string, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		// The token's id is in the path, so it has to be replaced in the audit log before anything else happens
+		id, idErr := getIdParameter(request)
+		setAuditTarget(request, auditTokenTarget(id))
+
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		if idErr != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", idErr.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		if !isMergePatch(request) {
+			response := fmt.Sprintf("Unsupported content type '%s', use '%s'", request.Header.Get("Content-Type"), mergePatchType)
+			http.Error(writer, response, http.StatusUnsupportedMediaType)
+
+			return
+		}
+
+		var patch map[string]json.RawMessage
+		if err := json.NewDecoder(request.Body).Decode(&patch); err != nil {
+			response := fmt.Sprintf("Error decoding patch for token: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		token := &Token{Id: id}
+		var detail string
+		err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+			if err := transaction.Model(token).WherePK().For("UPDATE").Select(); err != nil {
+				return err
+			}
+
+			before := *token
+			if err := applyTokenPatch(token, patch); err != nil {
+				return err
+			}
+			if err := checkAddedScopes(transaction, token.UserId, addedScopes(before.Scope, token.Scope)); err != nil {
+				return err
+			}
+			if !token.Start.Equal(before.Start) || !token.End.Equal(before.End) {
+				if err := checkTokenLifetime(settings, token.Start, token.End); err != nil {
+					return err
+				}
+			}
+			if !token.End.Equal(before.End) {
+				if !token.End.After(time.Now()) {
+					return TokenPatchError{Field: "end", Reason: "has to be in the future, delete the token to revoke it"}
+				}
+
+				// Announcements about the old end no longer apply
+				if _, err := transaction.Model((*TokenExpiryNotice)(nil)).
+					Where("token = ?", tokenFingerprint(id)).
+					Delete(); err != nil {
+					return err
+				}
+			}
+
+			if _, err := transaction.Model(token).Column("scope", "start", "end", "metadata").WherePK().Update(); err != nil {
+				return err
+			}
+
+			var err error
+			detail, err = changeDetail(patchableTokenFields, tokenPatchFieldValues(&before), tokenPatchFieldValues(token))
+			if err != nil {
+				return err
+			}
+
+			return recordEvent(transaction, TokenUpdatedEvent, tokenEventData{
+				Token:  tokenFingerprint(id),
+				UserId: token.UserId,
+				Scope:  token.Scope,
+				Start:  token.Start,
+				End:    token.End,
+			})
+		})
+		if err != nil {
+			switch err.(type) {
+			case TokenPatchError, TokenLifetimeError:
+				response := fmt.Sprintf("Invalid patch for token: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			case TokenScopeError:
+				response := fmt.Sprintf("Invalid patch for token: %s", err.Error())
+				http.Error(writer, response, http.StatusForbidden)
+
+				return
+			}
+
+			if err == pg.ErrNoRows {
+				http.Error(writer, "Token not found", http.StatusNotFound)
+
+				return
+			}
+
+			response := fmt.Sprintf("Unable to update token: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		setAuditDetail(request, detail)
+		_ = json.NewEncoder(writer).Encode(token)
+	}
+}
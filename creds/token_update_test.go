@@ -0,0 +1,115 @@
+package creds
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestApplyTokenPatch(t *testing.T) {
+	token := Token{Scope: "reader", Metadata: map[string]string{"team": "ops", "ticket": "OPS-1"}}
+
+	patch := decodePatch(`{"scope": "reader writer", "end": "2030-01-01T00:00:00Z", "metadata": {"ticket": null, "owner": "ci"}}`)
+	if err := applyTokenPatch(&token, patch); err != nil {
+		log.Panicf("Unable to apply patch: %s", err.Error())
+	}
+	if token.Scope != "reader writer" || !token.End.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		log.Panicf("Patch not applied: %+v", token)
+	}
+	if len(token.Metadata) != 2 || token.Metadata["team"] != "ops" || token.Metadata["owner"] != "ci" {
+		log.Panicf("Metadata not merged: %v", token.Metadata)
+	}
+
+	if err := applyTokenPatch(&token, decodePatch(`{"metadata": null}`)); err != nil {
+		log.Panicf("Unable to clear metadata: %s", err.Error())
+	}
+	if token.Metadata != nil {
+		log.Panicf("Metadata not cleared: %v", token.Metadata)
+	}
+
+	invalidPatches := []string{
+		`{"userId": "5c4f1cd5-0b1b-4bd5-a6e2-4a8c43bb0a6b"}`,
+		`{"jkt": ""}`,
+		`{"scope": null}`,
+		`{"end": null}`,
+		`{"start": "yesterday"}`,
+		`{"metadata": {"": "empty"}}`,
+		`{"metadata": {"count": 1}}`,
+	}
+	for _, patch := range invalidPatches {
+		patched := token
+		if err := applyTokenPatch(&patched, decodePatch(patch)); err == nil {
+			log.Panicf("Invalid patch applied: %s", patch)
+		}
+	}
+}
+
+func TestAddedScopes(t *testing.T) {
+	added := addedScopes("reader writer", "writer admin reader deploy")
+	if len(added) != 2 || added[0] != "admin" || added[1] != "deploy" {
+		log.Panicf("Unexpected added scopes: %v", added)
+	}
+
+	if len(addedScopes("reader writer", "reader")) != 0 {
+		log.Panicln("Removing scopes counted as adding them")
+	}
+}
+
+func TestCheckTokenLifetime(t *testing.T) {
+	settings := DefaultSettings()
+	start := time.Now()
+
+	if err := checkTokenLifetime(settings, start, start.AddDate(10, 0, 0)); err != nil {
+		log.Panicf("Lifetime limited without a maximum: %s", err.Error())
+	}
+	if err := checkTokenLifetime(settings, start, start); err == nil {
+		log.Panicln("Token allowed to end when it starts")
+	}
+
+	settings.MaxTokenLifetime = 90 * 24 * time.Hour
+	if err := checkTokenLifetime(settings, start, start.Add(settings.MaxTokenLifetime)); err != nil {
+		log.Panicf("Token not allowed the maximum lifetime: %s", err.Error())
+	}
+	if err := checkTokenLifetime(settings, start, start.Add(settings.MaxTokenLifetime+time.Second)); err == nil {
+		log.Panicln("Token allowed past the maximum lifetime")
+	}
+}
+
+func TestPatchToken(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Patched", "patched", "reader", "writer")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	tokenId, err := insertToken(setup.database, userId, "reader", time.Now(), time.Now().Add(time.Hour), tokenBinding{})
+	if err != nil {
+		log.Panicf("Unable to add token: %s", err.Error())
+	}
+
+	url := fmt.Sprintf("/tokens/%s", tokenId)
+	headers := []headerEntry{bearerToken(setup.adminToken)}
+
+	end := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	patch := fmt.Sprintf(`{"scope": "reader writer", "end": "%s", "metadata": {"ticket": "OPS-1"}}`, end.Format(time.RFC3339))
+	expectStatus("PATCH", url, patch, headers, router, http.StatusOK)
+
+	token, err := getTokenById(setup.database, tokenId)
+	if err != nil {
+		log.Panicf("Unable to get token: %s", err.Error())
+	}
+	if token.Scope != "reader writer" || !token.End.Equal(end) || token.Metadata["ticket"] != "OPS-1" {
+		log.Panicf("Patch not stored: %+v", token)
+	}
+
+	expectStatus("PATCH", url, `{"scope": "reader writer admin"}`, headers, router, http.StatusForbidden)
+	expectStatus("PATCH", url, `{"end": "2000-01-01T00:00:00Z"}`, headers, router, http.StatusBadRequest)
+	expectStatus("PATCH", url, `{"userId": "5c4f1cd5-0b1b-4bd5-a6e2-4a8c43bb0a6b"}`, headers, router, http.StatusBadRequest)
+}
@@ -0,0 +1,495 @@
+package creds
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+// RFC 6238 with the parameters every authenticator app supports: HMAC-SHA1, 6 digits and a 30 second step.
+const (
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpAllowedDrift  = 1
+	totpSecretLength  = 20
+	recoveryCodeCount = 10
+)
+
+type TotpEnrollment struct {
+	UserId          uuid.UUID `json:"userId" pg:"type:uuid,pk"`
+	User            *User     `json:"-" pg:"rel:has-one"`
+	EncryptedSecret []byte    `json:"-" pg:",notnull"`
+	Confirmed       bool      `json:"confirmed" pg:",notnull,use_zero"`
+	LastCounter     int64     `json:"-" pg:",notnull,use_zero"`
+	CreatedAt       time.Time `json:"createdAt" pg:",notnull"`
+}
+
+type RecoveryCode struct {
+	Id       uuid.UUID `pg:"type:uuid,pk"`
+	UserId   uuid.UUID `pg:"type:uuid,notnull"`
+	User     *User     `pg:"rel:has-one"`
+	CodeHash string    `pg:",notnull,unique"`
+	UsedAt   time.Time
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTotpSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func totpProvisioningUri(issuer string, username string, secret []byte) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, username))
+	query := url.Values{}
+	query.Set("secret", base32NoPadding.EncodeToString(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", totpDigits))
+	query.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+func totpCounter(at time.Time) int64 {
+	return at.Unix() / totpPeriod
+}
+
+func totpCode(secret []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, truncated%1000000)
+}
+
+// Checks a code against the steps around `at`, returning the matched counter. Codes for counters at or before
+// `lastCounter` have already been used and are rejected so a code can't be replayed within its window.
+func verifyTotpCode(secret []byte, code string, at time.Time, lastCounter int64) (int64, bool) {
+	current := totpCounter(at)
+	for drift := int64(-totpAllowedDrift); drift <= totpAllowedDrift; drift++ {
+		counter := current + drift
+		if counter <= lastCounter {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		bytes := make([]byte, 5)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32NoPadding.EncodeToString(bytes))
+		codes = append(codes, fmt.Sprintf("%s-%s", code[:4], code[4:]))
+	}
+
+	return codes, nil
+}
+
+// Recovery codes are random, so a plain hash is enough; there is nothing to gain from a slow password hash here.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func totpAssociatedData(userId uuid.UUID) []byte {
+	return []byte(fmt.Sprintf("totp:%s", userId))
+}
+
+func getTotpEnrollment(database *pg.DB, userId uuid.UUID) (*TotpEnrollment, error) {
+	enrollment := &TotpEnrollment{UserId: userId}
+
+	if err := database.Model(enrollment).WherePK().Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return enrollment, nil
+}
+
+// Replaces any existing enrollment and recovery codes for the user, returning the new secret and recovery codes.
+func enrollTotp(database *pg.DB, keyring *keyring, userId uuid.UUID) ([]byte, []string, error) {
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedSecret, err := keyring.encrypt(secret, totpAssociatedData(userId))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		enrollment := TotpEnrollment{
+			UserId:          userId,
+			EncryptedSecret: encryptedSecret,
+			Confirmed:       false,
+			LastCounter:     0,
+			CreatedAt:       time.Now(),
+		}
+		if _, err := transaction.Model(&enrollment).
+			OnConflict("(user_id) DO UPDATE").
+			Set("encrypted_secret = EXCLUDED.encrypted_secret").
+			Set("confirmed = EXCLUDED.confirmed").
+			Set("last_counter = EXCLUDED.last_counter").
+			Set("created_at = EXCLUDED.created_at").
+			Insert(); err != nil {
+			return err
+		}
+
+		if _, err := transaction.Model((*RecoveryCode)(nil)).Where("user_id = ?", userId).Delete(); err != nil {
+			return err
+		}
+
+		for _, code := range codes {
+			recoveryCode := RecoveryCode{Id: uuid.New(), UserId: userId, CodeHash: hashRecoveryCode(code)}
+			if _, err := transaction.Model(&recoveryCode).Insert(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return secret, codes, nil
+}
+
+func deleteTotpEnrollment(database *pg.DB, userId uuid.UUID) (bool, error) {
+	found := false
+	err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		result, err := transaction.Model((*TotpEnrollment)(nil)).Where("user_id = ?", userId).Delete()
+		if err != nil {
+			return err
+		}
+		found = result.RowsAffected() != 0
+
+		_, err = transaction.Model((*RecoveryCode)(nil)).Where("user_id = ?", userId).Delete()
+
+		return err
+	})
+
+	return found, err
+}
+
+// Verifies a TOTP code or an unused recovery code for an enrollment. Successful TOTP codes advance the enrollment's
+// last used counter and recovery codes are marked as used, both conditionally so concurrent requests can't both pass.
+func verifySecondFactor(database *pg.DB, keyring *keyring, enrollment *TotpEnrollment, code string) (bool, error) {
+	secret, err := keyring.decrypt(enrollment.EncryptedSecret, totpAssociatedData(enrollment.UserId))
+	if err != nil {
+		return false, err
+	}
+
+	if counter, ok := verifyTotpCode(secret, code, time.Now(), enrollment.LastCounter); ok {
+		result, err := database.Model((*TotpEnrollment)(nil)).
+			Set("last_counter = ?", counter).
+			Where("user_id = ? AND last_counter < ?", enrollment.UserId, counter).
+			Update()
+		if err != nil {
+			return false, err
+		}
+		enrollment.LastCounter = counter
+
+		return result.RowsAffected() != 0, nil
+	}
+
+	result, err := database.Model((*RecoveryCode)(nil)).
+		Set("used_at = ?", time.Now()).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", enrollment.UserId, hashRecoveryCode(code)).
+		Update()
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() != 0, nil
+}
+
+// Whether a session with `sessionScope` may only be issued to users with a second factor. This only covers login
+// sessions; tokens issued through `POST /tokens` get whatever scope the admin gives them, MFA or not.
+func requiresMfa(sessionScope string, mfaRequiredScopes []string) bool {
+	for _, scope := range parseScopes(sessionScope) {
+		for _, requiredScope := range mfaRequiredScopes {
+			if scope == requiredScope {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type totpChangeParameters struct {
+	Code string
+}
+
+// Replacing or removing a confirmed enrollment turns off the user's second factor, so the user's own token isn't
+// enough for it; a current TOTP or recovery code has to be given as well. Admins can always change enrollments, so
+// users who lost their authenticator can be helped. Writes an error response and returns false when not allowed.
+func authorizeTotpChange(
+	writer http.ResponseWriter,
+	request *http.Request,
+	database *pg.DB,
+	adminScope string,
+	keyring *keyring,
+	userId uuid.UUID,
+) bool {
+	token, err := authenticateRequest(database, request)
+	if err != nil || !(token.hasScope(adminScope) || token.UserId == userId) {
+		response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+		http.Error(writer, response, http.StatusUnauthorized)
+
+		return false
+	}
+	if token.hasScope(adminScope) {
+		return true
+	}
+
+	enrollment, err := getTotpEnrollment(database, userId)
+	if err != nil {
+		response := fmt.Sprintf("Error getting TOTP enrollment: %s", err.Error())
+		http.Error(writer, response, http.StatusInternalServerError)
+
+		return false
+	}
+	if enrollment == nil || !enrollment.Confirmed {
+		return true
+	}
+
+	var parameters totpChangeParameters
+	if request.ContentLength != 0 {
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for changing TOTP: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return false
+		}
+	}
+
+	verified, err := verifySecondFactor(database, keyring, enrollment, parameters.Code)
+	if err != nil {
+		if err == errSealed {
+			http.Error(writer, sealedResponse, http.StatusServiceUnavailable)
+
+			return false
+		}
+		response := fmt.Sprintf("Unable to verify second factor: %s", err.Error())
+		http.Error(writer, response, http.StatusInternalServerError)
+
+		return false
+	}
+	if !verified {
+		http.Error(writer, "A current TOTP or recovery code is needed to change a confirmed enrollment", http.StatusForbidden)
+
+		return false
+	}
+
+	return true
+}
+
+type totpEnrollmentResponse struct {
+	Secret          string   `json:"secret"`
+	ProvisioningUri string   `json:"provisioningUri"`
+	RecoveryCodes   []string `json:"recoveryCodes"`
+}
+
+func handleEnrollTotp(database *pg.DB, adminScope string, keyring *keyring, settings Settings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		if !authorizeTotpChange(writer, request, database, adminScope, keyring, id) {
+			return
+		}
+
+		user, err := getUserById(database, id)
+		if err != nil {
+			if err == pg.ErrNoRows {
+				response := fmt.Sprintf("User with id '%s' not found", id)
+				http.Error(writer, response, http.StatusNotFound)
+
+				return
+			}
+			response := fmt.Sprintf("Error getting user: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if !user.Kind.policy().interactiveLogin {
+			response := fmt.Sprintf("Users of kind '%s' can't enroll in MFA", user.Kind)
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		secret, codes, err := enrollTotp(database, keyring, id)
+		if err != nil {
+			response := fmt.Sprintf("Unable to enroll user in TOTP: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(totpEnrollmentResponse{
+			Secret:          base32NoPadding.EncodeToString(secret),
+			ProvisioningUri: totpProvisioningUri(settings.TotpIssuer, user.Username, secret),
+			RecoveryCodes:   codes,
+		})
+	}
+}
+
+type confirmTotpParameters struct {
+	Code string
+}
+
+func handleConfirmTotp(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		token := getAdminTokenId(request)
+		if !requestIsAdminOrUser(database, request, adminScope, id) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", token)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters confirmTotpParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for confirming TOTP: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		enrollment, err := getTotpEnrollment(database, id)
+		if err != nil {
+			response := fmt.Sprintf("Error getting TOTP enrollment: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if enrollment == nil {
+			response := fmt.Sprintf("User with id '%s' is not enrolled in TOTP", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+
+		secret, err := keyring.decrypt(enrollment.EncryptedSecret, totpAssociatedData(id))
+		if err != nil {
+			response := fmt.Sprintf("Unable to decrypt TOTP secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		counter, ok := verifyTotpCode(secret, parameters.Code, time.Now(), enrollment.LastCounter)
+		if !ok {
+			http.Error(writer, "Invalid TOTP code", http.StatusBadRequest)
+
+			return
+		}
+
+		if _, err := database.Model((*TotpEnrollment)(nil)).
+			Set("confirmed = TRUE").
+			Set("last_counter = ?", counter).
+			Where("user_id = ?", id).
+			Update(); err != nil {
+			response := fmt.Sprintf("Unable to confirm TOTP enrollment: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+	}
+}
+
+func handleDeleteTotp(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		if !authorizeTotpChange(writer, request, database, adminScope, keyring, id) {
+			return
+		}
+
+		found, err := deleteTotpEnrollment(database, id)
+		if err != nil {
+			response := fmt.Sprintf("Unable to remove TOTP enrollment: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if !found {
+			response := fmt.Sprintf("User with id '%s' is not enrolled in TOTP", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
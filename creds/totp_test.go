@@ -0,0 +1,161 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestTotpCode(t *testing.T) {
+	// Test vectors from RFC 6238, appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		code := totpCode(secret, totpCounter(time.Unix(unix, 0)))
+		if code != expected {
+			log.Panicf("Unexpected TOTP code for %d: %s (expected %s)", unix, code, expected)
+		}
+	}
+}
+
+func TestVerifyTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	code := totpCode(secret, totpCounter(now)-1)
+
+	counter, ok := verifyTotpCode(secret, code, now, 0)
+	if !ok || counter != totpCounter(now)-1 {
+		log.Panicf("Code from the previous step isn't accepted: %s", code)
+	}
+
+	if _, ok := verifyTotpCode(secret, code, now, counter); ok {
+		log.Panicf("Already used code is accepted: %s", code)
+	}
+
+	if _, ok := verifyTotpCode(secret, code, now.Add(2*totpPeriod*time.Second), 0); ok {
+		log.Panicf("Code outside of the allowed drift is accepted: %s", code)
+	}
+}
+
+func TestRequiresMfa(t *testing.T) {
+	required := []string{"admin", "deploy"}
+	if !requiresMfa("reader deploy", required) {
+		log.Panicln("Session with a required scope doesn't need MFA")
+	}
+	if requiresMfa("reader", required) || requiresMfa("", required) || requiresMfa("deploy", nil) {
+		log.Panicln("Session without a required scope needs MFA")
+	}
+}
+
+func TestChangeConfirmedTotp(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Enrolled", "enrolled")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	userToken, err := insertToken(setup.database, userId, "", time.Now(), time.Now().Add(time.Hour), tokenBinding{})
+	if err != nil {
+		log.Panicf("Unable to add token: %s", err.Error())
+	}
+
+	url := fmt.Sprintf("/user/%s/totp", userId)
+	userHeaders := []headerEntry{bearerToken(userToken)}
+	recorder := expectStatus("POST", url, "", userHeaders, router, http.StatusOK)
+	enrollment := totpEnrollmentResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(&enrollment); err != nil {
+		log.Panicf("Unable to decode enrollment: %s", err.Error())
+	}
+	secret, err := base32NoPadding.DecodeString(enrollment.Secret)
+	if err != nil {
+		log.Panicf("Unable to decode secret: %s", err.Error())
+	}
+
+	// Unconfirmed enrollments can be replaced without a code, there is no second factor to lose yet
+	expectStatus("DELETE", url, "", userHeaders, router, http.StatusOK)
+	recorder = expectStatus("POST", url, "", userHeaders, router, http.StatusOK)
+	if err := json.NewDecoder(recorder.Body).Decode(&enrollment); err != nil {
+		log.Panicf("Unable to decode enrollment: %s", err.Error())
+	}
+	if secret, err = base32NoPadding.DecodeString(enrollment.Secret); err != nil {
+		log.Panicf("Unable to decode secret: %s", err.Error())
+	}
+	confirmation := fmt.Sprintf(`{"code": "%s"}`, totpCode(secret, totpCounter(time.Now())))
+	expectStatus("POST", url+"/confirm", confirmation, userHeaders, router, http.StatusOK)
+
+	expectStatus("DELETE", url, "", userHeaders, router, http.StatusForbidden)
+	expectStatus("POST", url, "", userHeaders, router, http.StatusForbidden)
+	expectStatus("DELETE", url, `{"code": "aaaa-aaaa"}`, userHeaders, router, http.StatusForbidden)
+	if enrolled, err := getTotpEnrollment(setup.database, userId); err != nil || enrolled == nil || !enrolled.Confirmed {
+		log.Panicf("Confirmed enrollment changed without a code: %+v, %v", enrolled, err)
+	}
+
+	recoveryCode := fmt.Sprintf(`{"code": "%s"}`, enrollment.RecoveryCodes[0])
+	expectStatus("DELETE", url, recoveryCode, userHeaders, router, http.StatusOK)
+
+	// Admins can remove enrollments for users who lost their authenticator
+	expectStatus("POST", url, "", userHeaders, router, http.StatusOK)
+	expectStatus("DELETE", url, "", []headerEntry{bearerToken(setup.adminToken)}, router, http.StatusOK)
+}
+
+func TestSecondFactorWhileSealed(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	keyring, _ := setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Sealed Out", "sealed-out")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	passwordHash, err := hashPassword("a long enough password", setup.settings.PasswordParameters)
+	if err != nil {
+		log.Panicf("Unable to hash password: %s", err.Error())
+	}
+	if _, err := setUserPasswordHash(setup.database, userId, passwordHash); err != nil {
+		log.Panicf("Unable to set password: %s", err.Error())
+	}
+
+	url := fmt.Sprintf("/user/%s/totp", userId)
+	adminHeaders := []headerEntry{bearerToken(setup.adminToken)}
+	recorder := expectStatus("POST", url, "", adminHeaders, router, http.StatusOK)
+	enrollment := totpEnrollmentResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(&enrollment); err != nil {
+		log.Panicf("Unable to decode enrollment: %s", err.Error())
+	}
+	secret, err := base32NoPadding.DecodeString(enrollment.Secret)
+	if err != nil {
+		log.Panicf("Unable to decode secret: %s", err.Error())
+	}
+	code := totpCode(secret, totpCounter(time.Now()))
+	expectStatus("POST", url+"/confirm", fmt.Sprintf(`{"code": "%s"}`, code), adminHeaders, router, http.StatusOK)
+
+	if _, err := keyring.initializeSeal(setup.database, 3, 2); err != nil {
+		log.Panicf("Unable to initialize sealing: %s", err.Error())
+	}
+	if err := keyring.sealKeyring(); err != nil {
+		log.Panicf("Unable to seal: %s", err.Error())
+	}
+
+	login := fmt.Sprintf(`{"username": "sealed-out", "password": "a long enough password", "code": "%s"}`, code)
+	recorder = expectStatus("POST", "/login", login, []headerEntry{}, router, http.StatusServiceUnavailable)
+	if !strings.Contains(recorder.Body.String(), sealedResponse) {
+		log.Panicf("Unexpected response while sealed: %s", recorder.Body.String())
+	}
+	expectStatus("DELETE", url, "", adminHeaders, router, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,490 @@
+package creds
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+type TransitKeyType string
+
+const (
+	Aes256GcmKey TransitKeyType = "aes256-gcm"
+	Ed25519Key   TransitKeyType = "ed25519"
+)
+
+type transitOperation string
+
+const (
+	transitEncrypt transitOperation = "encrypt"
+	transitDecrypt transitOperation = "decrypt"
+	transitRewrap  transitOperation = "rewrap"
+	transitSign    transitOperation = "sign"
+	transitVerify  transitOperation = "verify"
+)
+
+// One version of a named key that services use through the transit endpoints. The key material is encrypted with
+// the master key and never leaves the process; ciphertexts and signatures carry the version they were made with.
+type TransitKey struct {
+	Name         string         `json:"name" pg:",pk"`
+	Version      int            `json:"version" pg:",pk"`
+	Type         TransitKeyType `json:"type" pg:",notnull"`
+	EncryptedKey []byte         `json:"-" pg:",notnull"`
+	CreatedAt    time.Time      `json:"createdAt" pg:",notnull"`
+}
+
+type NoSuchTransitKeyError struct {
+	Name    string
+	Version int
+}
+
+func (noSuchTransitKeyError NoSuchTransitKeyError) Error() string {
+	if noSuchTransitKeyError.Version == 0 {
+		return fmt.Sprintf("Transit key '%s' does not exist", noSuchTransitKeyError.Name)
+	}
+
+	return fmt.Sprintf("Version %d of transit key '%s' does not exist", noSuchTransitKeyError.Version, noSuchTransitKeyError.Name)
+}
+
+var errInvalidTransitValue = errors.New("values have to look like 'creds:v<version>:<base64>'")
+var errWrongTransitKeyType = errors.New("operation isn't supported by this type of key")
+var errTransitDecryptionFailed = errors.New("ciphertext can't be decrypted with this key and context")
+
+const transitValuePrefix = "creds:v"
+
+func formatTransitValue(version int, value []byte) string {
+	return fmt.Sprintf("%s%d:%s", transitValuePrefix, version, base64.StdEncoding.EncodeToString(value))
+}
+
+func parseTransitValue(value string) (int, []byte, error) {
+	if !strings.HasPrefix(value, transitValuePrefix) {
+		return 0, nil, errInvalidTransitValue
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, transitValuePrefix), ":", 2)
+	if len(parts) != 2 {
+		return 0, nil, errInvalidTransitValue
+	}
+
+	version, err := strconv.Atoi(parts[0])
+	if err != nil || version < 1 {
+		return 0, nil, errInvalidTransitValue
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, nil, errInvalidTransitValue
+	}
+
+	return version, bytes, nil
+}
+
+func transitKeyAssociatedData(name string, version int) []byte {
+	return []byte(fmt.Sprintf("transit:%s:%d", name, version))
+}
+
+// Ciphertexts are bound to the key name and the caller's optional context, so they can't be decrypted as if they
+// belonged to another key or context.
+func transitCiphertextAssociatedData(name string, context []byte) []byte {
+	return append([]byte(fmt.Sprintf("transit:%s:", name)), context...)
+}
+
+// Usage of a key is given by scopes like `transit:encrypt:billing-key`
+func tokenCanUseTransitKey(token *Token, adminScope string, operation transitOperation, name string) bool {
+	return token.hasScope(adminScope) || token.hasScope(fmt.Sprintf("transit:%s:%s", operation, name))
+}
+
+func generateTransitKeyMaterial(keyType TransitKeyType) ([]byte, error) {
+	switch keyType {
+	case Aes256GcmKey, Ed25519Key:
+		// An ed25519 key is stored as its seed
+		material := make([]byte, 32)
+		if _, err := rand.Read(material); err != nil {
+			return nil, err
+		}
+
+		return material, nil
+	default:
+		return nil, fmt.Errorf("unknown key type '%s'", keyType)
+	}
+}
+
+// Adds a new version of a key, creating the key if `keyType` is given and it doesn't exist yet. New versions keep
+// the type of the key. Returns the new version.
+func addTransitKeyVersion(database *pg.DB, keyring *keyring, name string, keyType TransitKeyType) (int, error) {
+	version := 0
+	err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		if _, err := transaction.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "transit:"+name); err != nil {
+			return err
+		}
+
+		latest := TransitKey{}
+		err := transaction.Model(&latest).Where("name = ?", name).Order("version DESC").Limit(1).Select()
+		if err != nil && err != pg.ErrNoRows {
+			return err
+		}
+		if err == pg.ErrNoRows {
+			if keyType == "" {
+				return NoSuchTransitKeyError{Name: name}
+			}
+		} else {
+			if keyType != "" {
+				return fmt.Errorf("transit key '%s' already exists", name)
+			}
+			keyType = latest.Type
+		}
+
+		material, err := generateTransitKeyMaterial(keyType)
+		if err != nil {
+			return err
+		}
+
+		key := TransitKey{Name: name, Version: latest.Version + 1, Type: keyType, CreatedAt: time.Now()}
+		key.EncryptedKey, err = keyring.encrypt(material, transitKeyAssociatedData(key.Name, key.Version))
+		if err != nil {
+			return err
+		}
+
+		if _, err := transaction.Model(&key).Insert(); err != nil {
+			return err
+		}
+		version = key.Version
+
+		return nil
+	})
+
+	return version, err
+}
+
+// Gets a version of a key with its decrypted material, or the latest version when `version` is 0
+func getTransitKey(database *pg.DB, keyring *keyring, name string, version int) (*TransitKey, []byte, error) {
+	key := &TransitKey{}
+	query := database.Model(key).Where("name = ?", name)
+	if version == 0 {
+		query = query.Order("version DESC").Limit(1)
+	} else {
+		query = query.Where("version = ?", version)
+	}
+
+	if err := query.Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil, NoSuchTransitKeyError{Name: name, Version: version}
+		}
+
+		return nil, nil, err
+	}
+
+	material, err := keyring.decrypt(key.EncryptedKey, transitKeyAssociatedData(key.Name, key.Version))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, material, nil
+}
+
+func transitEncryptWithKey(key *TransitKey, material []byte, plaintext []byte, context []byte) (string, error) {
+	if key.Type != Aes256GcmKey {
+		return "", errWrongTransitKeyType
+	}
+
+	ciphertext, err := encryptWithKey(material, plaintext, transitCiphertextAssociatedData(key.Name, context))
+	if err != nil {
+		return "", err
+	}
+
+	return formatTransitValue(key.Version, ciphertext), nil
+}
+
+func transitDecryptWithKey(key *TransitKey, material []byte, ciphertext []byte, context []byte) ([]byte, error) {
+	if key.Type != Aes256GcmKey {
+		return nil, errWrongTransitKeyType
+	}
+
+	plaintext, err := decryptWithKey(material, ciphertext, transitCiphertextAssociatedData(key.Name, context))
+	if err != nil {
+		return nil, errTransitDecryptionFailed
+	}
+
+	return plaintext, nil
+}
+
+func transitSignWithKey(key *TransitKey, material []byte, input []byte) (string, error) {
+	if key.Type != Ed25519Key {
+		return "", errWrongTransitKeyType
+	}
+
+	return formatTransitValue(key.Version, ed25519.Sign(ed25519.NewKeyFromSeed(material), input)), nil
+}
+
+func transitVerifyWithKey(key *TransitKey, material []byte, input []byte, signature []byte) (bool, error) {
+	if key.Type != Ed25519Key {
+		return false, errWrongTransitKeyType
+	}
+
+	publicKey := ed25519.NewKeyFromSeed(material).Public().(ed25519.PublicKey)
+
+	return ed25519.Verify(publicKey, input, signature), nil
+}
+
+func writeTransitError(writer http.ResponseWriter, err error) {
+	switch err.(type) {
+	case NoSuchTransitKeyError:
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	default:
+		if err == errWrongTransitKeyType || err == errInvalidTransitValue || err == errTransitDecryptionFailed {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		response := fmt.Sprintf("Unable to use transit key: %s", err.Error())
+		http.Error(writer, response, http.StatusInternalServerError)
+	}
+}
+
+type addTransitKeyParameters struct {
+	Name string
+	Type TransitKeyType
+}
+
+func handleAddTransitKey(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters addTransitKeyParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for adding transit key: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		if !engineNamePattern.MatchString(parameters.Name) {
+			http.Error(writer, "'name' has to be a lowercase identifier", http.StatusBadRequest)
+
+			return
+		}
+		if parameters.Type == "" {
+			parameters.Type = Aes256GcmKey
+		}
+		if parameters.Type != Aes256GcmKey && parameters.Type != Ed25519Key {
+			response := fmt.Sprintf("'type' has to be '%s' or '%s'", Aes256GcmKey, Ed25519Key)
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		if _, err := addTransitKeyVersion(database, keyring, parameters.Name, parameters.Type); err != nil {
+			response := fmt.Sprintf("Unable to add transit key: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+	}
+}
+
+// Lists every version of every key, without any key material
+func handleGetTransitKeys(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		keys := make([]TransitKey, 0)
+		if err := database.Model(&keys).Order("name", "version").Select(); err != nil {
+			response := fmt.Sprintf("Error getting transit keys")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(keys)
+	}
+}
+
+type rotateTransitKeyResponse struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+}
+
+// Adds a new version of a key that is used for encrypting and signing from then on. Older versions are kept so that
+// existing ciphertexts can still be decrypted, and rewrapped at leisure.
+func handleRotateTransitKey(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		name := getParameters(request).ByName("Name")
+		version, err := addTransitKeyVersion(database, keyring, name, "")
+		if err != nil {
+			writeTransitError(writer, err)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(rotateTransitKeyResponse{Name: name, Version: version})
+	}
+}
+
+// Input for all transit operations; binary values are base64 encoded
+type transitParameters struct {
+	Plaintext  []byte
+	Ciphertext string
+	Context    []byte
+	Input      []byte
+	Signature  string
+}
+
+type transitResponse struct {
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+	Valid      *bool  `json:"valid,omitempty"`
+}
+
+func handleTransitOperation(
+	database *pg.DB,
+	adminScope string,
+	keyring *keyring,
+	operation transitOperation,
+) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		name := getParameters(request).ByName("Name")
+
+		token, err := authenticateRequest(database, request)
+		if err != nil || !tokenCanUseTransitKey(token, adminScope, operation, name) {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", getAdminTokenId(request))
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters transitParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for %s: %s", operation, err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		response, err := performTransitOperation(database, keyring, name, operation, parameters)
+		if err != nil {
+			writeTransitError(writer, err)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(response)
+	}
+}
+
+func performTransitOperation(
+	database *pg.DB,
+	keyring *keyring,
+	name string,
+	operation transitOperation,
+	parameters transitParameters,
+) (*transitResponse, error) {
+	switch operation {
+	case transitEncrypt:
+		key, material, err := getTransitKey(database, keyring, name, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		ciphertext, err := transitEncryptWithKey(key, material, parameters.Plaintext, parameters.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		return &transitResponse{Ciphertext: ciphertext}, nil
+	case transitDecrypt, transitRewrap:
+		version, ciphertext, err := parseTransitValue(parameters.Ciphertext)
+		if err != nil {
+			return nil, err
+		}
+
+		key, material, err := getTransitKey(database, keyring, name, version)
+		if err != nil {
+			return nil, err
+		}
+
+		plaintext, err := transitDecryptWithKey(key, material, ciphertext, parameters.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		if operation == transitDecrypt {
+			return &transitResponse{Plaintext: plaintext}, nil
+		}
+
+		// Rewrapping hands back a ciphertext made with the latest version without the plaintext leaving the process
+		latestKey, latestMaterial, err := getTransitKey(database, keyring, name, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		rewrapped, err := transitEncryptWithKey(latestKey, latestMaterial, plaintext, parameters.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		return &transitResponse{Ciphertext: rewrapped}, nil
+	case transitSign:
+		key, material, err := getTransitKey(database, keyring, name, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		signature, err := transitSignWithKey(key, material, parameters.Input)
+		if err != nil {
+			return nil, err
+		}
+
+		return &transitResponse{Signature: signature}, nil
+	case transitVerify:
+		version, signature, err := parseTransitValue(parameters.Signature)
+		if err != nil {
+			return nil, err
+		}
+
+		key, material, err := getTransitKey(database, keyring, name, version)
+		if err != nil {
+			return nil, err
+		}
+
+		valid, err := transitVerifyWithKey(key, material, parameters.Input, signature)
+		if err != nil {
+			return nil, err
+		}
+
+		return &transitResponse{Valid: &valid}, nil
+	default:
+		return nil, fmt.Errorf("unknown transit operation '%s'", operation)
+	}
+}
@@ -0,0 +1,86 @@
+package creds
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestTransitValueFormat(t *testing.T) {
+	value := formatTransitValue(3, []byte("ciphertext"))
+	version, bytesValue, err := parseTransitValue(value)
+	if err != nil || version != 3 || string(bytesValue) != "ciphertext" {
+		log.Panicf("Unable to parse '%s': %v", value, err)
+	}
+
+	for _, invalid := range []string{"", "vault:v1:YQ==", "creds:v0:YQ==", "creds:vx:YQ==", "creds:v1", "creds:v1:%%"} {
+		if _, _, err := parseTransitValue(invalid); err == nil {
+			log.Panicf("Invalid value '%s' was parsed", invalid)
+		}
+	}
+}
+
+func TestTransitEncryption(t *testing.T) {
+	material, _ := generateTransitKeyMaterial(Aes256GcmKey)
+	key := &TransitKey{Name: "billing-key", Version: 2, Type: Aes256GcmKey}
+
+	ciphertext, err := transitEncryptWithKey(key, material, []byte("card number"), []byte("customer-1"))
+	if err != nil {
+		log.Panicf("Unable to encrypt: %s", err.Error())
+	}
+
+	version, sealed, err := parseTransitValue(ciphertext)
+	if err != nil || version != 2 {
+		log.Panicf("Ciphertext '%s' doesn't carry the key version", ciphertext)
+	}
+
+	plaintext, err := transitDecryptWithKey(key, material, sealed, []byte("customer-1"))
+	if err != nil || !bytes.Equal(plaintext, []byte("card number")) {
+		log.Panicf("Unable to decrypt: %v", err)
+	}
+
+	if _, err := transitDecryptWithKey(key, material, sealed, []byte("customer-2")); err != errTransitDecryptionFailed {
+		log.Panicf("Ciphertext was decrypted with another context")
+	}
+
+	otherKey := &TransitKey{Name: "other-key", Version: 2, Type: Aes256GcmKey}
+	if _, err := transitDecryptWithKey(otherKey, material, sealed, []byte("customer-1")); err != errTransitDecryptionFailed {
+		log.Panicf("Ciphertext was decrypted as another key")
+	}
+
+	if _, err := transitSignWithKey(key, material, []byte("input")); err != errWrongTransitKeyType {
+		log.Panicf("Encryption key was used for signing")
+	}
+}
+
+func TestTransitSigning(t *testing.T) {
+	material, _ := generateTransitKeyMaterial(Ed25519Key)
+	key := &TransitKey{Name: "release-key", Version: 1, Type: Ed25519Key}
+
+	signature, err := transitSignWithKey(key, material, []byte("release"))
+	if err != nil {
+		log.Panicf("Unable to sign: %s", err.Error())
+	}
+
+	_, signatureBytes, _ := parseTransitValue(signature)
+	if valid, _ := transitVerifyWithKey(key, material, []byte("release"), signatureBytes); !valid {
+		log.Panicf("Valid signature was rejected")
+	}
+	if valid, _ := transitVerifyWithKey(key, material, []byte("tampered"), signatureBytes); valid {
+		log.Panicf("Signature over other input was accepted")
+	}
+}
+
+func TestTokenCanUseTransitKey(t *testing.T) {
+	token := &Token{Scope: "transit:encrypt:billing-key"}
+
+	if !tokenCanUseTransitKey(token, "admin", transitEncrypt, "billing-key") {
+		log.Panicf("Token can't use the key it was given")
+	}
+	if tokenCanUseTransitKey(token, "admin", transitDecrypt, "billing-key") {
+		log.Panicf("Encrypt scope allowed decryption")
+	}
+	if tokenCanUseTransitKey(token, "admin", transitEncrypt, "other-key") {
+		log.Panicf("Token can use another key")
+	}
+}
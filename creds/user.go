@@ -1,24 +1,108 @@
 package creds
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 	"github.com/google/uuid"
 )
 
+type UserKind string
+
+const (
+	HumanUser      UserKind = "human"
+	ServiceAccount UserKind = "service-account"
+)
+
 type User struct {
-	Id       uuid.UUID `json:"id" pg:"type:uuid"`
-	Name     string    `json:"name" pg:",notnull"`
-	Username string    `json:"username" pg:",notnull,unique"`
-	Tokens   []*Token  `json:"tokens" pg:"rel:has-many"`
+	Id              uuid.UUID  `json:"id" pg:"type:uuid"`
+	Name            string     `json:"name" pg:",notnull"`
+	Username        string     `json:"username" pg:",notnull,unique"`
+	Kind            UserKind   `json:"kind" pg:",notnull,default:'human'"`
+	OwnerId         *uuid.UUID `json:"ownerId,omitempty" pg:"type:uuid"`
+	OwnerGroup      string     `json:"ownerGroup,omitempty"`
+	Status          UserStatus `json:"status" pg:",notnull,default:'active'"`
+	StatusReason    string     `json:"statusReason,omitempty"`
+	StatusChangedAt *time.Time `json:"statusChangedAt,omitempty"`
+	PasswordHash    string     `json:"-"`
+	DefaultScopes   []string   `json:"defaultScopes" pg:",array"`
+	Version         int        `json:"version" pg:",notnull,default:1"`
+	CreatedAt       time.Time  `json:"createdAt" pg:",notnull,default:now()"`
+	Tokens          []*Token   `json:"tokens" pg:"rel:has-many"`
+}
+
+// Only active users can log in or use their tokens. Suspending a user is meant to be temporary and leaves their
+// tokens in place, so reactivating them restores access; deactivated users are expected to stay that way and no
+// longer count as owners of anything.
+type UserStatus string
+
+const (
+	ActiveUser      UserStatus = "active"
+	SuspendedUser   UserStatus = "suspended"
+	DeactivatedUser UserStatus = "deactivated"
+)
+
+func (status UserStatus) isValid() bool {
+	return status == ActiveUser || status == SuspendedUser || status == DeactivatedUser
+}
+
+// What each kind of user is allowed to do. Service accounts are used by automation and have to be accounted for by
+// an owning human or group.
+type userKindPolicy struct {
+	interactiveLogin bool
+	requiresOwner    bool
+}
+
+var userKindPolicies = map[UserKind]userKindPolicy{
+	HumanUser:      {interactiveLogin: true, requiresOwner: false},
+	ServiceAccount: {interactiveLogin: false, requiresOwner: true},
+}
+
+func (kind UserKind) isValid() bool {
+	_, ok := userKindPolicies[kind]
+
+	return ok
+}
+
+func (kind UserKind) policy() userKindPolicy {
+	return userKindPolicies[kind]
+}
+
+type InvalidOwnerError struct {
+	OwnerId uuid.UUID
+}
+
+func (invalidOwnerError InvalidOwnerError) Error() string {
+	return fmt.Sprintf("User with Id '%s' does not exist or is not a human user", invalidOwnerError.OwnerId)
+}
+
+type OwnedServiceAccountsError struct {
+	UserId          uuid.UUID
+	ServiceAccounts []uuid.UUID
+}
+
+func (ownedServiceAccountsError OwnedServiceAccountsError) Error() string {
+	return fmt.Sprintf(
+		"User with Id '%s' owns active service accounts %v, reassign or disable them first",
+		ownedServiceAccountsError.UserId,
+		ownedServiceAccountsError.ServiceAccounts,
+	)
 }
 
-func insertUser(database *pg.DB, name string, username string) (uuid.UUID, error) {
+func insertUser(database orm.DB, name string, username string, defaultScopes ...string) (uuid.UUID, error) {
 	id := uuid.New()
 	user := User{
-		Id:       id,
-		Name:     name,
-		Username: username,
-		Tokens:   nil,
+		Id:            id,
+		Name:          name,
+		Username:      username,
+		Kind:          HumanUser,
+		Status:        ActiveUser,
+		DefaultScopes: defaultScopes,
+		Version:       1,
+		CreatedAt:     time.Now(),
+		Tokens:        nil,
 	}
 
 	if _, err := database.Model(&user).Insert(); err != nil {
@@ -28,6 +112,54 @@ func insertUser(database *pg.DB, name string, username string) (uuid.UUID, error
 	return id, nil
 }
 
+func insertServiceAccount(
+	database orm.DB,
+	name string,
+	username string,
+	ownerId *uuid.UUID,
+	ownerGroup string,
+	defaultScopes ...string,
+) (uuid.UUID, error) {
+	if ownerId != nil {
+		if err := validateOwner(database, *ownerId); err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	user := newServiceAccount(name, username, ownerId, ownerGroup, defaultScopes...)
+	if _, err := database.Model(&user).Insert(); err != nil {
+		return uuid.Nil, err
+	}
+
+	return user.Id, nil
+}
+
+func newServiceAccount(name string, username string, ownerId *uuid.UUID, ownerGroup string, defaultScopes ...string) User {
+	return User{
+		Id:            uuid.New(),
+		Name:          name,
+		Username:      username,
+		Kind:          ServiceAccount,
+		OwnerId:       ownerId,
+		OwnerGroup:    ownerGroup,
+		Status:        ActiveUser,
+		DefaultScopes: defaultScopes,
+		Version:       1,
+		CreatedAt:     time.Now(),
+		Tokens:        nil,
+	}
+}
+
+func getUserByUsername(database *pg.DB, username string) (*User, error) {
+	user := &User{}
+
+	if err := database.Model(user).Where("username = ?", username).Select(); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 func getUserById(database *pg.DB, id uuid.UUID) (*User, error) {
 	user := &User{Id: id}
 
@@ -37,3 +169,72 @@ func getUserById(database *pg.DB, id uuid.UUID) (*User, error) {
 
 	return user, nil
 }
+
+// Only human users can own service accounts; ownership chains would make it impossible to tell who is responsible.
+func validateOwner(database orm.DB, ownerId uuid.UUID) error {
+	exists, err := database.Model((*User)(nil)).Where("id = ? AND kind = ?", ownerId, HumanUser).Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return InvalidOwnerError{OwnerId: ownerId}
+	}
+
+	return nil
+}
+
+func setUserPasswordHash(database *pg.DB, id uuid.UUID, passwordHash string) (bool, error) {
+	user := User{Id: id, PasswordHash: passwordHash}
+	result, err := database.Model(&user).Column("password_hash").WherePK().Update()
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() != 0, nil
+}
+
+func getOwnedServiceAccountIds(transaction *pg.Tx, ownerId uuid.UUID) ([]uuid.UUID, error) {
+	serviceAccounts := make([]User, 0)
+	if err := transaction.Model(&serviceAccounts).
+		Where("owner_id = ? AND kind = ? AND status <> ?", ownerId, ServiceAccount, DeactivatedUser).
+		Select(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uuid.UUID, 0, len(serviceAccounts))
+	for _, serviceAccount := range serviceAccounts {
+		ids = append(ids, serviceAccount.Id)
+	}
+
+	return ids, nil
+}
+
+// Changes a user's status and records the change, returning whether the user exists
+func setUserStatus(database *pg.DB, id uuid.UUID, status UserStatus, reason string) (bool, error) {
+	now := time.Now()
+	user := User{Id: id, Status: status, StatusReason: reason, StatusChangedAt: &now}
+
+	found := false
+	err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+		result, err := transaction.Model(&user).
+			Set("status = ?status, status_reason = ?status_reason, status_changed_at = ?status_changed_at").
+			Set("version = version + 1").
+			WherePK().
+			Update()
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return nil
+		}
+		found = true
+
+		return recordEvent(transaction, UserStatusChangedEvent, userEventData{UserId: id, Status: status, Reason: reason})
+	})
+
+	return found, err
+}
+
+func userIsActive(database *pg.DB, id uuid.UUID) (bool, error) {
+	return database.Model((*User)(nil)).Where("id = ? AND status = ?", id, ActiveUser).Exists()
+}
@@ -0,0 +1,232 @@
+package creds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+// The fields of a user that can be patched. Status, kind and passwords have their own endpoints.
+var patchableUserFields = []string{"name", "username", "ownerId", "ownerGroup", "defaultScopes"}
+
+var errVersionMismatch = errors.New("user has been changed since it was read")
+
+type UserPatchError struct {
+	Field  string
+	Reason string
+}
+
+func (userPatchError UserPatchError) Error() string {
+	return fmt.Sprintf("'%s' %s", userPatchError.Field, userPatchError.Reason)
+}
+
+// Entity tag of a user, which changes with every update of it
+func userETag(user *User) string {
+	return strconv.Quote(strconv.Itoa(user.Version))
+}
+
+// Whether an `If-Match` header allows changing the user; a missing header allows any version
+func ifMatchAllows(ifMatch string, user *User) bool {
+	if ifMatch == "" {
+		return true
+	}
+
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == userETag(user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func userPatchFieldValues(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"name":          user.Name,
+		"username":      user.Username,
+		"ownerId":       user.OwnerId,
+		"ownerGroup":    user.OwnerGroup,
+		"defaultScopes": user.DefaultScopes,
+	}
+}
+
+// Applies a JSON Merge Patch (RFC 7396) to a user: fields in the patch replace the user's, `null` clears them and
+// fields that are left out stay as they are.
+func applyUserPatch(user *User, patch map[string]json.RawMessage) error {
+	if field := unknownPatchField(patch, patchableUserFields); field != "" {
+		return UserPatchError{Field: field, Reason: "can't be changed"}
+	}
+
+	if value, ok := patch["name"]; ok {
+		if err := json.Unmarshal(value, &user.Name); err != nil || isNullPatchValue(value) || user.Name == "" {
+			return UserPatchError{Field: "name", Reason: "has to be a non-empty string"}
+		}
+	}
+
+	if value, ok := patch["username"]; ok {
+		if err := json.Unmarshal(value, &user.Username); err != nil || isNullPatchValue(value) || user.Username == "" {
+			return UserPatchError{Field: "username", Reason: "has to be a non-empty string"}
+		}
+	}
+
+	if value, ok := patch["ownerId"]; ok {
+		var ownerId *uuid.UUID
+		if err := json.Unmarshal(value, &ownerId); err != nil {
+			return UserPatchError{Field: "ownerId", Reason: "has to be a user Id or null"}
+		}
+		user.OwnerId = ownerId
+	}
+
+	if value, ok := patch["ownerGroup"]; ok {
+		var ownerGroup *string
+		if err := json.Unmarshal(value, &ownerGroup); err != nil {
+			return UserPatchError{Field: "ownerGroup", Reason: "has to be a string or null"}
+		}
+		user.OwnerGroup = ""
+		if ownerGroup != nil {
+			user.OwnerGroup = *ownerGroup
+		}
+	}
+
+	if value, ok := patch["defaultScopes"]; ok {
+		var defaultScopes []string
+		if err := json.Unmarshal(value, &defaultScopes); err != nil {
+			return UserPatchError{Field: "defaultScopes", Reason: "has to be a list of strings or null"}
+		}
+		user.DefaultScopes = defaultScopes
+	}
+
+	policy := user.Kind.policy()
+	hasOwner := user.OwnerId != nil || user.OwnerGroup != ""
+	if policy.requiresOwner && !hasOwner {
+		return UserPatchError{Field: "ownerId", Reason: "or 'ownerGroup' is required for service accounts"}
+	}
+	if !policy.requiresOwner && hasOwner {
+		return UserPatchError{Field: "ownerId", Reason: "can only be set for service accounts"}
+	}
+
+	return nil
+}
+
+func userChangeDetail(before *User, after *User) (string, error) {
+	return changeDetail(patchableUserFields, userPatchFieldValues(before), userPatchFieldValues(after))
+}
+
+func handlePatchUser(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+		setAuditTarget(request, auditUserTarget(id))
+
+		if !isMergePatch(request) {
+			response := fmt.Sprintf("Unsupported content type '%s', use '%s'", request.Header.Get("Content-Type"), mergePatchType)
+			http.Error(writer, response, http.StatusUnsupportedMediaType)
+
+			return
+		}
+
+		var patch map[string]json.RawMessage
+		if err := json.NewDecoder(request.Body).Decode(&patch); err != nil {
+			response := fmt.Sprintf("Error decoding patch for user: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		user := &User{Id: id}
+		var detail string
+		err = database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+			if err := transaction.Model(user).WherePK().For("UPDATE").Select(); err != nil {
+				return err
+			}
+			if !ifMatchAllows(request.Header.Get("If-Match"), user) {
+				return errVersionMismatch
+			}
+
+			before := *user
+			if err := applyUserPatch(user, patch); err != nil {
+				return err
+			}
+			if user.OwnerId != nil && (before.OwnerId == nil || *before.OwnerId != *user.OwnerId) {
+				if err := validateOwner(transaction, *user.OwnerId); err != nil {
+					return err
+				}
+			}
+
+			user.Version++
+			if _, err := transaction.Model(user).
+				Column("name", "username", "owner_id", "owner_group", "default_scopes", "version").
+				WherePK().
+				Update(); err != nil {
+				return err
+			}
+
+			detail, err = userChangeDetail(&before, user)
+			if err != nil {
+				return err
+			}
+
+			return recordEvent(transaction, UserUpdatedEvent, userEventData{UserId: id, Name: user.Name, Kind: user.Kind})
+		})
+		if err != nil {
+			switch err.(type) {
+			case UserPatchError, InvalidOwnerError:
+				response := fmt.Sprintf("Invalid patch for user: %s", err.Error())
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+
+			if err == pg.ErrNoRows {
+				response := fmt.Sprintf("User with id '%s' not found", id)
+				http.Error(writer, response, http.StatusNotFound)
+
+				return
+			}
+
+			if err == errVersionMismatch {
+				response := fmt.Sprintf("User with id '%s' doesn't match `If-Match`: %s", id, err.Error())
+				http.Error(writer, response, http.StatusPreconditionFailed)
+
+				return
+			}
+
+			if isUniqueViolation(err) {
+				response := fmt.Sprintf("Unable to update user: %s", err.Error())
+				http.Error(writer, response, http.StatusConflict)
+
+				return
+			}
+
+			response := fmt.Sprintf("Unable to update user: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		setAuditDetail(request, detail)
+		writer.Header().Set("ETag", userETag(user))
+		_ = json.NewEncoder(writer).Encode(user)
+	}
+}
@@ -0,0 +1,139 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+func decodePatch(patch string) map[string]json.RawMessage {
+	decoded := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(patch), &decoded); err != nil {
+		log.Panicf("Unable to decode patch: %s", err.Error())
+	}
+
+	return decoded
+}
+
+func TestApplyUserPatch(t *testing.T) {
+	ownerId := uuid.New()
+	user := User{
+		Name:          "Test Testersson",
+		Username:      "test",
+		Kind:          ServiceAccount,
+		OwnerId:       &ownerId,
+		DefaultScopes: []string{"reader"},
+	}
+
+	if err := applyUserPatch(&user, decodePatch(`{"name": "Test Testsson", "ownerGroup": "ops", "ownerId": null}`)); err != nil {
+		log.Panicf("Unable to apply patch: %s", err.Error())
+	}
+	if user.Name != "Test Testsson" || user.Username != "test" || user.OwnerId != nil || user.OwnerGroup != "ops" {
+		log.Panicf("Patch not applied as a merge patch: %+v", user)
+	}
+	if len(user.DefaultScopes) != 1 {
+		log.Panicf("Fields left out of the patch changed: %+v", user)
+	}
+
+	invalidPatches := []string{
+		`{"name": null}`,
+		`{"username": ""}`,
+		`{"kind": "human"}`,
+		`{"status": "active"}`,
+		`{"ownerGroup": null}`,
+		`{"defaultScopes": "reader"}`,
+	}
+	for _, patch := range invalidPatches {
+		patched := user
+		if err := applyUserPatch(&patched, decodePatch(patch)); err == nil {
+			log.Panicf("Invalid patch applied: %s", patch)
+		}
+	}
+
+	human := User{Name: "Human", Username: "human", Kind: HumanUser}
+	if err := applyUserPatch(&human, decodePatch(`{"ownerGroup": "ops"}`)); err == nil {
+		log.Panicln("Human user given an owner")
+	}
+}
+
+func TestUserChangeDetail(t *testing.T) {
+	before := User{Name: "Before", Username: "same"}
+	after := User{Name: "After", Username: "same"}
+
+	detail, err := userChangeDetail(&before, &after)
+	if err != nil {
+		log.Panicf("Unable to describe change: %s", err.Error())
+	}
+	if detail != `{"before":{"name":"Before"},"after":{"name":"After"}}` {
+		log.Panicf("Unexpected change detail: %s", detail)
+	}
+}
+
+func TestIfMatchAllows(t *testing.T) {
+	user := User{Version: 3}
+
+	for ifMatch, allowed := range map[string]bool{
+		"":         true,
+		"*":        true,
+		`"3"`:      true,
+		`"2", "3"`: true,
+		`"2"`:      false,
+		`W/"3"`:    false,
+		"3":        false,
+	} {
+		if ifMatchAllows(ifMatch, &user) != allowed {
+			log.Panicf("Expected `If-Match: %s` to be allowed: %t", ifMatch, allowed)
+		}
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	router := new(httprouter.Router)
+	setupRoutes(router, setup.database, setup.adminScope, setup.settings)
+
+	userId, err := insertUser(setup.database, "Tpyo", "typo")
+	if err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+	if _, err := insertUser(setup.database, "Taken", "taken"); err != nil {
+		log.Panicf("Unable to add user: %s", err.Error())
+	}
+
+	url := fmt.Sprintf("/user/%s", userId)
+	patchUser := func(patch string, ifMatch string, expected int) *httptest.ResponseRecorder {
+		headers := []headerEntry{
+			bearerToken(setup.adminToken),
+			{key: "Content-Type", value: "application/merge-patch+json"},
+		}
+		if ifMatch != "" {
+			headers = append(headers, headerEntry{key: "If-Match", value: ifMatch})
+		}
+
+		return expectStatus("PATCH", url, patch, headers, router, expected)
+	}
+
+	recorder := patchUser(`{"name": "Typo"}`, `"1"`, http.StatusOK)
+	if recorder.Header().Get("ETag") != `"2"` {
+		log.Panicf("Unexpected ETag after patch: %s", recorder.Header().Get("ETag"))
+	}
+
+	user, err := getUserById(setup.database, userId)
+	if err != nil {
+		log.Panicf("Unable to get user: %s", err.Error())
+	}
+	if user.Name != "Typo" || user.Username != "typo" || user.Version != 2 {
+		log.Panicf("Patch not stored: %+v", user)
+	}
+
+	patchUser(`{"name": "Stale"}`, `"1"`, http.StatusPreconditionFailed)
+	patchUser(`{"username": "taken"}`, "", http.StatusConflict)
+	patchUser(`{"name": null}`, "", http.StatusBadRequest)
+}
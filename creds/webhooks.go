@@ -0,0 +1,509 @@
+package creds
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+)
+
+type WebhookDeliveryStatus string
+
+const (
+	PendingDelivery   WebhookDeliveryStatus = "pending"
+	SucceededDelivery WebhookDeliveryStatus = "succeeded"
+	DeadDelivery      WebhookDeliveryStatus = "dead"
+)
+
+// A receiver of lifecycle events. The signing secret is encrypted with the master key and only shown when the
+// subscription is created.
+type WebhookSubscription struct {
+	Id              uuid.UUID   `json:"id" pg:"type:uuid,pk"`
+	Url             string      `json:"url" pg:",notnull"`
+	EventTypes      []EventType `json:"eventTypes" pg:",array"`
+	EncryptedSecret []byte      `json:"-" pg:",notnull"`
+	CreatedAt       time.Time   `json:"createdAt" pg:",notnull"`
+}
+
+// One event on its way to one subscription. Deliveries are made in the background so receivers never hold up the
+// handlers emitting events; the rows double as the delivery log and, once out of attempts, the dead letter list.
+type WebhookDelivery struct {
+	Id             uuid.UUID             `json:"id" pg:"type:uuid,pk"`
+	SubscriptionId uuid.UUID             `json:"subscriptionId" pg:"type:uuid,notnull,unique:subscription_event"`
+	EventId        uuid.UUID             `json:"eventId" pg:"type:uuid,notnull,unique:subscription_event"`
+	EventType      EventType             `json:"eventType" pg:",notnull"`
+	Payload        json.RawMessage       `json:"payload" pg:"type:jsonb,notnull"`
+	Status         WebhookDeliveryStatus `json:"status" pg:",notnull"`
+	Attempts       int                   `json:"attempts" pg:",use_zero,notnull"`
+	NextAttemptAt  time.Time             `json:"nextAttemptAt" pg:",notnull"`
+	LastStatusCode int                   `json:"lastStatusCode,omitempty"`
+	LastError      string                `json:"lastError,omitempty"`
+	CreatedAt      time.Time             `json:"createdAt" pg:",notnull"`
+	DeliveredAt    time.Time             `json:"deliveredAt,omitempty"`
+}
+
+const maximumWebhookAttempts = 8
+const webhookBaseBackoff = 10 * time.Second
+const maximumWebhookBackoff = time.Hour
+
+// Most deliveries sent per run. They're claimed one at a time, so a slow receiver doesn't hold on to the others.
+const webhookDeliveryBatchSize = 20
+
+const webhookDeliveryTimeout = 10 * time.Second
+
+// How long a claimed delivery is left alone by other workers, which has to be longer than a delivery can take
+const webhookClaimDuration = 6 * webhookDeliveryTimeout
+
+var webhookClient = &http.Client{Timeout: webhookDeliveryTimeout}
+
+func webhookSecretAssociatedData(subscriptionId uuid.UUID) []byte {
+	return []byte("webhook:" + subscriptionId.String())
+}
+
+// Receivers check `Creds-Signature`, which is `t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">`, and
+// reject old timestamps to stop replays.
+func signWebhookPayload(secret []byte, timestamp time.Time, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(payload)
+
+	return fmt.Sprintf("t=%d,v1=%s", timestamp.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < maximumWebhookBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maximumWebhookBackoff {
+		backoff = maximumWebhookBackoff
+	}
+
+	return backoff
+}
+
+func subscriptionWantsEvent(subscription WebhookSubscription, eventType EventType) bool {
+	if len(subscription.EventTypes) == 0 {
+		return true
+	}
+
+	for _, wanted := range subscription.EventTypes {
+		if wanted == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Queues deliveries of outbox events to the subscriptions that want them. Queueing the same event twice is a no-op,
+// since the outbox publishes at least once.
+type webhookSink struct {
+	database *pg.DB
+}
+
+func (sink webhookSink) publish(event OutboxEvent, payload []byte) error {
+	subscriptions := make([]WebhookSubscription, 0)
+	if err := sink.database.Model(&subscriptions).Select(); err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		if !subscriptionWantsEvent(subscription, event.Type) {
+			continue
+		}
+
+		delivery := WebhookDelivery{
+			Id:             uuid.New(),
+			SubscriptionId: subscription.Id,
+			EventId:        event.Id,
+			EventType:      event.Type,
+			Payload:        payload,
+			Status:         PendingDelivery,
+			NextAttemptAt:  time.Now(),
+			CreatedAt:      time.Now(),
+		}
+		if _, err := sink.database.Model(&delivery).OnConflict("DO NOTHING").Insert(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Claims the next due delivery so that several instances can deliver at once without sending anything twice.
+// Returns `nil` when nothing is due.
+func claimWebhookDelivery(database *pg.DB) (*WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0, 1)
+	if _, err := database.Query(&deliveries, `
+		UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		time.Now().Add(webhookClaimDuration), PendingDelivery, time.Now(),
+	); err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+
+	return &deliveries[0], nil
+}
+
+func attemptWebhookDelivery(subscription WebhookSubscription, secret []byte, delivery WebhookDelivery) (int, error) {
+	request, err := http.NewRequest("POST", subscription.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Creds-Event-Id", delivery.EventId.String())
+	request.Header.Set("Creds-Event-Type", string(delivery.EventType))
+	request.Header.Set("Creds-Delivery-Id", delivery.Id.String())
+	request.Header.Set("Creds-Signature", signWebhookPayload(secret, time.Now(), delivery.Payload))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("receiver responded with status %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+func deliverWebhooks(database *pg.DB, keyring *keyring) {
+	for sent := 0; sent < webhookDeliveryBatchSize; sent++ {
+		claimed, err := claimWebhookDelivery(database)
+		if err != nil {
+			fmt.Printf("Unable to claim webhook delivery: %s\n", err.Error())
+
+			return
+		}
+		if claimed == nil {
+			return
+		}
+
+		delivery := *claimed
+		delivery.Attempts++
+		statusCode, err := deliverWebhook(database, keyring, delivery)
+		delivery.LastStatusCode = statusCode
+		if err == nil {
+			delivery.Status = SucceededDelivery
+			delivery.DeliveredAt = time.Now()
+			delivery.LastError = ""
+		} else {
+			delivery.LastError = err.Error()
+			if delivery.Attempts >= maximumWebhookAttempts {
+				delivery.Status = DeadDelivery
+			} else {
+				delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts))
+			}
+		}
+
+		if _, err := database.Model(&delivery).
+			Column("status", "attempts", "next_attempt_at", "last_status_code", "last_error", "delivered_at").
+			WherePK().
+			Update(); err != nil {
+			fmt.Printf("Unable to record webhook delivery '%s': %s\n", delivery.Id, err.Error())
+		}
+	}
+}
+
+func deliverWebhook(database *pg.DB, keyring *keyring, delivery WebhookDelivery) (int, error) {
+	subscription := WebhookSubscription{Id: delivery.SubscriptionId}
+	if err := database.Model(&subscription).WherePK().Select(); err != nil {
+		return 0, err
+	}
+
+	secret, err := keyring.decrypt(subscription.EncryptedSecret, webhookSecretAssociatedData(subscription.Id))
+	if err != nil {
+		return 0, err
+	}
+
+	return attemptWebhookDelivery(subscription, secret, delivery)
+}
+
+type addWebhookParameters struct {
+	Url        string
+	EventTypes []EventType
+}
+
+type addWebhookResponse struct {
+	Id     uuid.UUID `json:"id"`
+	Secret string    `json:"secret"`
+}
+
+func handleAddWebhook(database *pg.DB, adminScope string, keyring *keyring) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		var parameters addWebhookParameters
+		if err := json.NewDecoder(request.Body).Decode(&parameters); err != nil {
+			response := fmt.Sprintf("Error decoding parameters for adding webhook: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		receiverUrl, err := url.Parse(parameters.Url)
+		if err != nil || (receiverUrl.Scheme != "https" && receiverUrl.Scheme != "http") || receiverUrl.Host == "" {
+			http.Error(writer, "'url' has to be an absolute HTTP(S) URL", http.StatusBadRequest)
+
+			return
+		}
+		for _, eventType := range parameters.EventTypes {
+			if !isEventType(eventType) {
+				response := fmt.Sprintf("Unknown event type '%s'", eventType)
+				http.Error(writer, response, http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(writer, "Unable to generate secret", http.StatusInternalServerError)
+
+			return
+		}
+
+		subscription := WebhookSubscription{
+			Id:         uuid.New(),
+			Url:        parameters.Url,
+			EventTypes: parameters.EventTypes,
+			CreatedAt:  time.Now(),
+		}
+		subscription.EncryptedSecret, err = keyring.encrypt(secret, webhookSecretAssociatedData(subscription.Id))
+		if err != nil {
+			response := fmt.Sprintf("Unable to encrypt secret: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if _, err := database.Model(&subscription).Insert(); err != nil {
+			response := fmt.Sprintf("Unable to add webhook: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+		setAuditTarget(request, "webhook:"+subscription.Id.String())
+
+		_ = json.NewEncoder(writer).Encode(addWebhookResponse{Id: subscription.Id, Secret: hex.EncodeToString(secret)})
+	}
+}
+
+func isEventType(eventType EventType) bool {
+	for _, known := range eventTypes {
+		if known == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func handleGetWebhooks(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		subscriptions := make([]WebhookSubscription, 0)
+		if err := database.Model(&subscriptions).Order("created_at").Select(); err != nil {
+			response := fmt.Sprintf("Error getting webhooks")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(subscriptions)
+	}
+}
+
+// Removes a subscription along with the deliveries it still had coming
+func handleDeleteWebhook(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		if err := database.RunInTransaction(database.Context(), func(transaction *pg.Tx) error {
+			if _, err := transaction.Model((*WebhookDelivery)(nil)).
+				Where("subscription_id = ? AND status = ?", id, PendingDelivery).
+				Delete(); err != nil {
+				return err
+			}
+
+			result, err := transaction.Model(&WebhookSubscription{Id: id}).WherePK().Delete()
+			if err != nil {
+				return err
+			}
+			if result.RowsAffected() == 0 {
+				return pg.ErrNoRows
+			}
+
+			return nil
+		}); err != nil {
+			if err == pg.ErrNoRows {
+				response := fmt.Sprintf("Webhook with id '%s' not found", id)
+				http.Error(writer, response, http.StatusNotFound)
+
+				return
+			}
+			response := fmt.Sprintf("Unable to delete webhook: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+	}
+}
+
+// The delivery log of one subscription, newest first
+func handleGetWebhookDeliveries(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		deliveries := make([]WebhookDelivery, 0)
+		if err := database.Model(&deliveries).
+			Where("subscription_id = ?", id).
+			Order("created_at DESC").
+			Limit(500).
+			Select(); err != nil {
+			response := fmt.Sprintf("Error getting webhook deliveries")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(deliveries)
+	}
+}
+
+// Deliveries across all subscriptions, filtered by `status`; `status=dead` gives the dead letter list
+func handleGetAllWebhookDeliveries(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		deliveries := make([]WebhookDelivery, 0)
+		query := database.Model(&deliveries).Order("created_at DESC").Limit(500)
+		if status := request.URL.Query().Get("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if err := query.Select(); err != nil {
+			response := fmt.Sprintf("Error getting webhook deliveries")
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(deliveries)
+	}
+}
+
+// Sends a delivery again from scratch, whether it succeeded or ran out of attempts
+func handleReplayWebhookDelivery(database *pg.DB, adminScope string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		adminToken := getAdminTokenId(request)
+		hasAdminScope := requestHasScope(database, request, adminScope)
+		if !hasAdminScope {
+			response := fmt.Sprintf("Incorrect or no authorization token given for this resource: %s", adminToken)
+			http.Error(writer, response, http.StatusUnauthorized)
+
+			return
+		}
+
+		id, err := getIdParameter(request)
+		if err != nil {
+			response := fmt.Sprintf("Unable to get `Id` from parameter: %s", err.Error())
+			http.Error(writer, response, http.StatusBadRequest)
+
+			return
+		}
+
+		result, err := database.Model((*WebhookDelivery)(nil)).
+			Set("status = ?", PendingDelivery).
+			Set("attempts = 0").
+			Set("next_attempt_at = ?", time.Now()).
+			Where("id = ?", id).
+			Update()
+		if err != nil {
+			response := fmt.Sprintf("Unable to replay webhook delivery: %s", err.Error())
+			http.Error(writer, response, http.StatusInternalServerError)
+
+			return
+		}
+
+		if result.RowsAffected() == 0 {
+			response := fmt.Sprintf("Webhook delivery with id '%s' not found", id)
+			http.Error(writer, response, http.StatusNotFound)
+
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package creds
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	if webhookBackoff(1) != webhookBaseBackoff || webhookBackoff(3) != 4*webhookBaseBackoff {
+		log.Panicf("Backoff doesn't double: %s, %s", webhookBackoff(1), webhookBackoff(3))
+	}
+
+	if webhookBackoff(30) != maximumWebhookBackoff {
+		log.Panicf("Backoff isn't capped: %s", webhookBackoff(30))
+	}
+}
+
+func TestSubscriptionWantsEvent(t *testing.T) {
+	if !subscriptionWantsEvent(WebhookSubscription{}, UserDeletedEvent) {
+		log.Panicf("Subscription without filters doesn't get every event")
+	}
+
+	subscription := WebhookSubscription{EventTypes: []EventType{TokenCreatedEvent}}
+	if !subscriptionWantsEvent(subscription, TokenCreatedEvent) || subscriptionWantsEvent(subscription, UserDeletedEvent) {
+		log.Panicf("Event type filter isn't applied")
+	}
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	secret := []byte("shared secret")
+	payload := []byte(`{"type":"user.deleted"}`)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		var timestamp int64
+		var signature string
+		_, err := fmt.Sscanf(strings.Replace(request.Header.Get("Creds-Signature"), ",", " ", 1), "t=%d v1=%s", &timestamp, &signature)
+		if err != nil {
+			http.Error(writer, "no signature", http.StatusBadRequest)
+
+			return
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		_, _ = fmt.Fprintf(mac, "%d.%s", timestamp, body)
+		if hex.EncodeToString(mac.Sum(nil)) != signature || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+			http.Error(writer, "bad signature", http.StatusUnauthorized)
+
+			return
+		}
+	}))
+	defer receiver.Close()
+
+	delivery := WebhookDelivery{Id: uuid.New(), EventId: uuid.New(), EventType: UserDeletedEvent, Payload: payload}
+	if status, err := attemptWebhookDelivery(WebhookSubscription{Url: receiver.URL}, secret, delivery); err != nil {
+		log.Panicf("Delivery was rejected with status %d: %s", status, err.Error())
+	}
+
+	if _, err := attemptWebhookDelivery(WebhookSubscription{Url: receiver.URL}, []byte("wrong"), delivery); err == nil {
+		log.Panicf("Delivery signed with another secret was accepted")
+	}
+}
+
+func TestClaimWebhookDelivery(t *testing.T) {
+	setup := initializeTestData(nil)
+
+	for index := 0; index < 2; index++ {
+		delivery := WebhookDelivery{
+			Id:             uuid.New(),
+			SubscriptionId: uuid.New(),
+			EventId:        uuid.New(),
+			EventType:      TokenCreatedEvent,
+			Payload:        []byte(`{}`),
+			Status:         PendingDelivery,
+			NextAttemptAt:  time.Now().Add(-time.Minute),
+			CreatedAt:      time.Now(),
+		}
+		if _, err := setup.database.Model(&delivery).Insert(); err != nil {
+			log.Panicf("Unable to add delivery: %s", err.Error())
+		}
+	}
+
+	// Every delivery is claimed for longer than sending it can take, and only once
+	first, err := claimWebhookDelivery(setup.database)
+	if err != nil || first == nil {
+		log.Panicf("Unable to claim delivery: %v", err)
+	}
+	if time.Until(first.NextAttemptAt) <= webhookDeliveryTimeout {
+		log.Panicf("Delivery claimed for too short: %s", first.NextAttemptAt)
+	}
+	second, err := claimWebhookDelivery(setup.database)
+	if err != nil || second == nil || second.Id == first.Id {
+		log.Panicf("Unable to claim another delivery: %+v, %v", second, err)
+	}
+	if none, err := claimWebhookDelivery(setup.database); err != nil || none != nil {
+		log.Panicf("Claimed delivery claimed again: %+v, %v", none, err)
+	}
+}
@@ -6,5 +6,6 @@ require (
 	github.com/go-pg/pg/v10 v10.5.0
 	github.com/google/uuid v1.1.2
 	github.com/julienschmidt/httprouter v1.3.0
+	golang.org/x/crypto v0.0.0-20201012173705-84dcc777aaee
 	gopkg.in/guregu/null.v4 v4.0.0
 )
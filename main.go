@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/go-pg/pg/v10/orm"
 
@@ -9,8 +11,6 @@ import (
 )
 
 func main() {
-	port := creds.GetRequiredEnvironmentIntegerEnvironmentVariable("PORT")
-
 	databaseOptions := creds.DatabaseOptions{
 		Host:     creds.GetRequiredEnvironmentVariable("DATABASE_HOST"),
 		Port:     creds.GetRequiredEnvironmentIntegerEnvironmentVariable("DATABASE_PORT"),
@@ -19,7 +19,15 @@ func main() {
 		Password: creds.GetRequiredEnvironmentVariable("DATABASE_PASSWORD"),
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		verifyAuditLog(databaseOptions)
+
+		return
+	}
+
+	port := creds.GetRequiredEnvironmentIntegerEnvironmentVariable("PORT")
 	adminScope := creds.GetRequiredEnvironmentVariable("ADMIN_SCOPE")
+	settings := creds.GetSettingsFromEnvironment()
 	database := creds.ConnectToDatabase(databaseOptions)
 	err := creds.CreateSchema(database, &orm.CreateTableOptions{Temp: false, IfNotExists: true, FKConstraints: true})
 	if err != nil {
@@ -27,5 +35,17 @@ func main() {
 	}
 
 	server := creds.Server{}
-	server.Serve(port, database, adminScope)
+	server.Serve(port, database, adminScope, settings)
+}
+
+// Walks the audit chain and exits with a non-zero status if it's been tampered with
+func verifyAuditLog(databaseOptions creds.DatabaseOptions) {
+	database := creds.ConnectToDatabase(databaseOptions)
+	verified, err := creds.VerifyAuditLog(database)
+	if err != nil {
+		fmt.Printf("Audit log verification failed after %d events: %s\n", verified, err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Verified %d audit events\n", verified)
 }